@@ -0,0 +1,245 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+
+	validation "github.com/go-ozzo/ozzo-validation/v4"
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/router"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+// maxAccountDepth bounds the parent chain walked by the cycle check, so a
+// corrupted hierarchy can't loop forever.
+const maxAccountDepth = 50
+
+// validateAccountParent rejects a parent that is the account itself or one
+// of its descendants.
+func validateAccountParent(app core.App, account *core.Record) error {
+	parentId := account.GetString("parent")
+	for depth := 0; parentId != ""; depth++ {
+		if parentId == account.Id {
+			return validation.Errors{"parent": validation.NewError("validation_parent_cycle", "The parent can't be the account itself or one of its subsidiaries.")}
+		}
+		if depth >= maxAccountDepth {
+			return validation.Errors{"parent": validation.NewError("validation_parent_depth", "The account hierarchy is too deep.")}
+		}
+		parent, err := app.FindRecordById(collectionAccounts, parentId)
+		if err != nil {
+			return validation.Errors{"parent": validation.NewError("validation_parent_missing", "The parent account doesn't exist.")}
+		}
+		parentId = parent.GetString("parent")
+	}
+	return nil
+}
+
+func bindAccountHierarchyHooks(app core.App) {
+	validate := func(e *core.RecordEvent) error {
+		if e.Record.IsNew() || e.Record.GetString("parent") != e.Record.Original().GetString("parent") {
+			if err := validateAccountParent(e.App, e.Record); err != nil {
+				return err
+			}
+		}
+		return e.Next()
+	}
+	app.OnRecordCreate(collectionAccounts).BindFunc(validate)
+	app.OnRecordUpdate(collectionAccounts).BindFunc(validate)
+}
+
+// accountSubtree returns the live accounts under root (root included) mapped
+// to the direct child of root whose branch they belong to; root maps to
+// itself. Archived accounts cut their branch off.
+func accountSubtree(app core.App, root *core.Record) (map[string]string, error) {
+	branches := map[string]string{root.Id: root.Id}
+	frontier := []any{root.Id}
+	for depth := 0; len(frontier) > 0 && depth < maxAccountDepth; depth++ {
+		children, err := app.FindAllRecords(collectionAccounts, dbx.In("parent", frontier...), dbx.HashExp{"archived": false})
+		if err != nil {
+			return nil, err
+		}
+		frontier = frontier[:0]
+		for _, child := range children {
+			if _, seen := branches[child.Id]; seen {
+				continue
+			}
+			branch := branches[child.GetString("parent")]
+			if branch == root.Id {
+				branch = child.Id
+			}
+			branches[child.Id] = branch
+			frontier = append(frontier, child.Id)
+		}
+	}
+	return branches, nil
+}
+
+type accountRollup struct {
+	Account      string  `db:"account" json:"-"`
+	Accounts     int     `db:"-" json:"accounts"`
+	Leads        int     `db:"leads" json:"leads"`
+	OpenLeads    int     `db:"open_leads" json:"openLeads"`
+	OpenDeals    int     `db:"open_deals" json:"openDeals"`
+	OpenPipeline float64 `db:"open_pipeline" json:"openPipeline"`
+	WonDeals     int     `db:"won_deals" json:"wonDeals"`
+	WonRevenue   float64 `db:"won_revenue" json:"wonRevenue"`
+	LastActivity string  `db:"last_activity" json:"lastActivity"`
+}
+
+func (r *accountRollup) add(o accountRollup) {
+	r.Accounts += o.Accounts
+	r.Leads += o.Leads
+	r.OpenLeads += o.OpenLeads
+	r.OpenDeals += o.OpenDeals
+	r.OpenPipeline = roundMoney(r.OpenPipeline + o.OpenPipeline)
+	r.WonDeals += o.WonDeals
+	r.WonRevenue = roundMoney(r.WonRevenue + o.WonRevenue)
+	r.LastActivity = max(r.LastActivity, o.LastActivity)
+}
+
+// accountRollups aggregates the leads, deals and activities of each account
+// in ids, limited to the records auth may see. Amounts are in the base
+// currency: open deals at their close date (or today), won deals at the date
+// they closed.
+func accountRollups(app core.App, auth *core.Record, ids []string) (map[string]accountRollup, error) {
+	in := make([]any, len(ids))
+	for i, id := range ids {
+		in[i] = id
+	}
+	closed := "('won', 'lost')"
+	closedAt := "COALESCE(NULLIF(d.close_date, ''), d.updated)"
+	openAt := dealValuationDateSQL("d", "now")
+
+	leads := []accountRollup{}
+	err := app.DB().
+		Select(
+			"l.account AS account",
+			"COUNT(*) AS leads",
+			"COALESCE(SUM(l.stage NOT IN "+closed+"), 0) AS open_leads",
+		).
+		From(collectionLeads + " l").
+		Where(dbx.And(dbx.In("l.account", in...), dbx.HashExp{"l.archived": false}, ownerScopeExpr(auth, "l.owner"))).
+		GroupBy("l.account").
+		All(&leads)
+	if err != nil {
+		return nil, err
+	}
+
+	deals := []accountRollup{}
+	err = app.DB().
+		Select(
+			"l.account AS account",
+			"COALESCE(SUM(d.stage NOT IN "+closed+"), 0) AS open_deals",
+			"COALESCE(SUM(CASE WHEN d.stage NOT IN "+closed+" THEN "+baseAmountSQL("d.amount", "d.currency", openAt)+" END), 0) AS open_pipeline",
+			"COALESCE(SUM(d.stage = 'won'), 0) AS won_deals",
+			"COALESCE(SUM(CASE WHEN d.stage = 'won' THEN "+baseAmountSQL("d.amount", "d.currency", closedAt)+" END), 0) AS won_revenue",
+		).
+		From(collectionDeals+" d").
+		InnerJoin(collectionLeads+" l", dbx.NewExp("l.id = d.lead")).
+		Where(dbx.And(dbx.In("l.account", in...), dbx.HashExp{"d.archived": false}, ownerScopeExpr(auth, "d.owner"))).
+		GroupBy("l.account").
+		Bind(dbx.Params{"now": types.NowDateTime().String()}).
+		All(&deals)
+	if err != nil {
+		return nil, err
+	}
+
+	activities := []accountRollup{}
+	err = app.DB().
+		Select("l.account AS account", "MAX(a.created) AS last_activity").
+		From(collectionActivities+" a").
+		InnerJoin(collectionLeads+" l", dbx.NewExp("l.id = a.lead")).
+		Where(dbx.And(dbx.In("l.account", in...), dbx.HashExp{"a.archived": false}, ownerScopeExpr(auth, "a.owner"))).
+		GroupBy("l.account").
+		All(&activities)
+	if err != nil {
+		return nil, err
+	}
+
+	rollups := map[string]accountRollup{}
+	for _, id := range ids {
+		rollups[id] = accountRollup{Account: id, Accounts: 1}
+	}
+	for _, rows := range [][]accountRollup{leads, deals, activities} {
+		for _, row := range rows {
+			r := rollups[row.Account]
+			r.add(row)
+			rollups[row.Account] = r
+		}
+	}
+	return rollups, nil
+}
+
+func bindAccountHierarchyRoutes(grp *router.RouterGroup[*core.RequestEvent]) {
+	// the rollup of an account covers it and every live subsidiary under it;
+	// children break the total down per direct subsidiary
+	grp.GET("/accounts/{id}/rollup", func(e *core.RequestEvent) error {
+		account, err := e.App.FindRecordById(collectionAccounts, e.Request.PathValue("id"))
+		if err != nil || account.GetBool("archived") {
+			return e.NotFoundError("Account not found.", err)
+		}
+
+		branches, err := accountSubtree(e.App, account)
+		if err != nil {
+			return e.InternalServerError("Failed to load account hierarchy.", err)
+		}
+		ids := make([]string, 0, len(branches))
+		for id := range branches {
+			ids = append(ids, id)
+		}
+		rollups, err := accountRollups(e.App, e.Auth, ids)
+		if err != nil {
+			return e.InternalServerError("Failed to build account rollup.", err)
+		}
+
+		total := accountRollup{}
+		byBranch := map[string]*accountRollup{}
+		for id, branch := range branches {
+			total.add(rollups[id])
+			if branch == account.Id {
+				continue
+			}
+			if byBranch[branch] == nil {
+				byBranch[branch] = &accountRollup{}
+			}
+			byBranch[branch].add(rollups[id])
+		}
+
+		children := []map[string]any{}
+		for branch, r := range byBranch {
+			child, err := e.App.FindRecordById(collectionAccounts, branch)
+			if err != nil {
+				return e.InternalServerError("Failed to load subsidiary.", err)
+			}
+			children = append(children, map[string]any{
+				"id":     child.Id,
+				"name":   child.GetString("name"),
+				"rollup": r,
+			})
+		}
+		slices.SortFunc(children, func(a, b map[string]any) int {
+			return strings.Compare(a["name"].(string), b["name"].(string))
+		})
+
+		ancestors := []map[string]any{}
+		for parentId, depth := account.GetString("parent"), 0; parentId != "" && depth < maxAccountDepth; depth++ {
+			parent, err := e.App.FindRecordById(collectionAccounts, parentId)
+			if err != nil {
+				break
+			}
+			ancestors = append([]map[string]any{{"id": parent.Id, "name": parent.GetString("name")}}, ancestors...)
+			parentId = parent.GetString("parent")
+		}
+
+		return e.JSON(http.StatusOK, map[string]any{
+			"account":   map[string]any{"id": account.Id, "name": account.GetString("name")},
+			"ancestors": ancestors,
+			"own":       rollups[account.Id],
+			"total":     total,
+			"children":  children,
+			"currency":  baseCurrency(),
+		})
+	}).Bind(requireCRMRole(roleManager, roleRep))
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	"golang.org/x/net/publicsuffix"
+)
+
+// freeMailDomains are consumer mailbox providers. An address on one of them
+// says nothing about the company, so they are never used for account matching.
+var freeMailDomains = map[string]struct{}{
+	"gmail.com": {}, "googlemail.com": {}, "outlook.com": {}, "hotmail.com": {},
+	"live.com": {}, "msn.com": {}, "yahoo.com": {}, "ymail.com": {},
+	"icloud.com": {}, "me.com": {}, "mac.com": {}, "aol.com": {},
+	"proton.me": {}, "protonmail.com": {}, "gmx.com": {}, "gmx.net": {},
+	"mail.com": {}, "yandex.com": {}, "yandex.ru": {}, "zoho.com": {},
+	"hey.com": {}, "fastmail.com": {}, "qq.com": {}, "163.com": {},
+	"rediffmail.com": {}, "hotmail.co.uk": {}, "yahoo.co.uk": {}, "yahoo.co.in": {},
+	"outlook.sa": {}, "emirates.net.ae": {},
+}
+
+func isFreeMailDomain(domain string) bool {
+	_, ok := freeMailDomains[strings.ToLower(strings.TrimSpace(domain))]
+	return ok
+}
+
+func emailDomain(email string) string {
+	_, domain, ok := strings.Cut(strings.ToLower(strings.TrimSpace(email)), "@")
+	if !ok {
+		return ""
+	}
+	return strings.TrimSuffix(strings.TrimSpace(domain), ".")
+}
+
+// corporateEmailDomain returns the domain of email, or "" when the address is
+// on a free-mail provider.
+func corporateEmailDomain(email string) string {
+	domain := emailDomain(email)
+	if domain == "" || isFreeMailDomain(domain) {
+		return ""
+	}
+	return domain
+}
+
+// findAccountByDomain looks up an unarchived account by domain, walking up
+// the labels down to the registrable domain, so "mail.acme.com" also matches
+// an account on "acme.com" but "acme.co.uk" never matches one on "co.uk".
+func findAccountByDomain(app core.App, domain string) (*core.Record, error) {
+	domain = domainFromWebsite(domain)
+	if domain == "" || isFreeMailDomain(domain) {
+		return nil, sql.ErrNoRows
+	}
+
+	// domains without a public suffix (e.g. "localhost") only match as-is
+	registrable, err := publicsuffix.EffectiveTLDPlusOne(domain)
+	if err != nil {
+		registrable = domain
+	}
+
+	for {
+		acc, err := app.FindFirstRecordByFilter(collectionAccounts, "domain={:domain} && archived = false", dbx.Params{"domain": domain})
+		if err == nil || !errors.Is(err, sql.ErrNoRows) {
+			return acc, err
+		}
+
+		_, parent, ok := strings.Cut(domain, ".")
+		if !ok || domain == registrable {
+			return nil, sql.ErrNoRows
+		}
+		domain = parent
+	}
+}
+
+// linkLeadToAccountByEmail sets the lead's account from its corporate email
+// domain when the lead isn't linked yet. The lead is not saved.
+func linkLeadToAccountByEmail(app core.App, lead *core.Record) error {
+	if lead.GetString("account") != "" {
+		return nil
+	}
+
+	domain := corporateEmailDomain(lead.GetString("email"))
+	if domain == "" {
+		return nil
+	}
+
+	acc, err := findAccountByDomain(app, domain)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
+		return err
+	}
+
+	lead.Set("account", acc.Id)
+	if lead.GetString("company") == "" {
+		lead.Set("company", acc.GetString("name"))
+	}
+	return nil
+}
+
+func bindAccountMatchingHooks(app core.App) {
+	// keep stored domains in the same shape findAccountByDomain looks for
+	// and countries as ISO codes for phone normalization
+	normalizeAccount := func(e *core.RecordEvent) error {
+		if raw := e.Record.GetString("domain"); raw != "" {
+			e.Record.Set("domain", domainFromWebsite(raw))
+		}
+		if raw := e.Record.GetString("country"); raw != "" {
+			e.Record.Set("country", normalizeCountry(raw))
+		}
+		return e.Next()
+	}
+	app.OnRecordCreate(collectionAccounts).BindFunc(normalizeAccount)
+	app.OnRecordUpdate(collectionAccounts).BindFunc(normalizeAccount)
+
+	app.OnRecordCreate(collectionLeads).BindFunc(func(e *core.RecordEvent) error {
+		if err := linkLeadToAccountByEmail(e.App, e.Record); err != nil {
+			return err
+		}
+		return e.Next()
+	})
+
+	app.OnRecordUpdate(collectionLeads).BindFunc(func(e *core.RecordEvent) error {
+		if e.Record.GetString("email") != e.Record.Original().GetString("email") {
+			if err := linkLeadToAccountByEmail(e.App, e.Record); err != nil {
+				return err
+			}
+		}
+		return e.Next()
+	})
+}
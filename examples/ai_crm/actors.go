@@ -0,0 +1,92 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/pocketbase/pocketbase/core"
+)
+
+// Change sources next to the lead sources (seed, apify, csv, web_form): who
+// or what saved a record.
+const (
+	changeSourceSuperuser = "superuser"
+	changeSourceUser      = "user"
+	changeSourceAgent     = "agent"
+	changeSourceCron      = "cron"
+	changeSourceSystem    = "system"
+)
+
+// Custom (not persisted) record data keys carrying the change actor from the
+// code that saves a record to the model hooks.
+const (
+	changeSourceKey = "@crmChangeSource"
+	changeActorKey  = "@crmChangeActor"
+)
+
+// setChangeActor tags rec with who is about to save it. actorId is the auth
+// record id, if any.
+func setChangeActor(rec *core.Record, source string, actorId string) {
+	rec.SetRaw(changeSourceKey, source)
+	rec.SetRaw(changeActorKey, actorId)
+}
+
+// copyChangeActor passes the actor of a save on to the records it cascades to.
+func copyChangeActor(from *core.Record, to *core.Record) {
+	source, actorId := changeActorOf(from)
+	setChangeActor(to, source, actorId)
+}
+
+// changeActorOf returns the source and actor id rec was tagged with.
+// Untagged saves come from the system (hooks, migrations, internal jobs).
+func changeActorOf(rec *core.Record) (string, string) {
+	source, _ := rec.GetRaw(changeSourceKey).(string)
+	actorId, _ := rec.GetRaw(changeActorKey).(string)
+	if source == "" {
+		source = changeSourceSystem
+	}
+	return source, actorId
+}
+
+// changeActorAuth loads the superuser or CRM user rec was tagged with, nil
+// when the save doesn't come from one.
+func changeActorAuth(app core.App, rec *core.Record) *core.Record {
+	source, actorId := changeActorOf(rec)
+	if actorId == "" {
+		return nil
+	}
+	col := collectionUsers
+	if source == changeSourceSuperuser {
+		col = core.CollectionNameSuperusers
+	}
+	auth, err := app.FindRecordById(col, actorId)
+	if err != nil {
+		return nil
+	}
+	return auth
+}
+
+// setAuthChangeActor tags rec with the authenticated superuser or CRM user.
+func setAuthChangeActor(rec *core.Record, auth *core.Record) {
+	if auth == nil {
+		return
+	}
+	source := changeSourceUser
+	if auth.IsSuperuser() {
+		source = changeSourceSuperuser
+	}
+	setChangeActor(rec, source, auth.Id)
+}
+
+// bindChangeActorHooks tags the CRM records saved or deleted through the
+// records API with the authenticated superuser or CRM user.
+func bindChangeActorHooks(app core.App) {
+	tag := func(e *core.RecordRequestEvent) error {
+		if strings.HasPrefix(e.Collection.Name, "crm_") {
+			setAuthChangeActor(e.Record, e.Auth)
+		}
+		return e.Next()
+	}
+	app.OnRecordCreateRequest().BindFunc(tag)
+	app.OnRecordUpdateRequest().BindFunc(tag)
+	app.OnRecordDeleteRequest().BindFunc(tag)
+}
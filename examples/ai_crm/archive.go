@@ -0,0 +1,316 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/router"
+	"github.com/pocketbase/pocketbase/tools/search"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+// archiveCollections maps the path segment of the archive routes to the
+// collections that are archived instead of deleted.
+var archiveCollections = map[string]string{
+	"accounts":   collectionAccounts,
+	"leads":      collectionLeads,
+	"deals":      collectionDeals,
+	"activities": collectionActivities,
+}
+
+type archiveChild struct {
+	collection string
+	field      string
+}
+
+// archiveChildren are the records archived, restored and purged together
+// with a record of the collection.
+var archiveChildren = map[string][]archiveChild{
+	collectionLeads: {{collectionDeals, "lead"}, {collectionActivities, "lead"}},
+	collectionDeals: {{collectionActivities, "deal"}},
+}
+
+// archiveParents are the relations that must not point to an archived record
+// when a record is restored.
+var archiveParents = map[string][]archiveChild{
+	collectionDeals:      {{collectionLeads, "lead"}},
+	collectionActivities: {{collectionLeads, "lead"}, {collectionDeals, "deal"}},
+}
+
+// retentionPeriod is how long deleted records stay restorable before the
+// retention job purges them. Override it with AI_CRM_RETENTION_DAYS
+// (default 30).
+func retentionPeriod() time.Duration {
+	days, err := strconv.Atoi(strings.TrimSpace(os.Getenv("AI_CRM_RETENTION_DAYS")))
+	if err != nil || days <= 0 {
+		days = 30
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// archiveRecord hides rec and the records under it (see archiveChildren)
+// with one archived_at stamp, so they are restored together. With deleted
+// set they are also marked deleted, which starts the retention period.
+// Archiving an archived record again keeps its stamp. It returns the number
+// of archived records per collection.
+func archiveRecord(app core.App, rec *core.Record, deleted bool) (map[string]int, error) {
+	stamp := rec.GetDateTime("archived_at")
+	if !rec.GetBool("archived") || stamp.IsZero() {
+		stamp = types.NowDateTime()
+	}
+
+	counts := map[string]int{}
+	var archive func(txApp core.App, r *core.Record) error
+	archive = func(txApp core.App, r *core.Record) error {
+		r.Set("archived", true)
+		r.Set("archived_at", stamp)
+		if deleted && r.GetDateTime("deleted_at").IsZero() {
+			r.Set("deleted_at", stamp)
+		}
+		if r != rec {
+			copyChangeActor(rec, r)
+		}
+		if err := txApp.Save(r); err != nil {
+			return err
+		}
+		counts[r.Collection().Name]++
+
+		for _, child := range archiveChildren[r.Collection().Name] {
+			children, err := txApp.FindRecordsByFilter(
+				child.collection,
+				child.field+"={:id} && (archived=false || archived_at={:stamp})",
+				"",
+				0,
+				0,
+				dbx.Params{"id": r.Id, "stamp": stamp.String()},
+			)
+			if err != nil {
+				return err
+			}
+			for _, c := range children {
+				if err := archive(txApp, c); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+
+	err := app.RunInTransaction(func(txApp core.App) error {
+		return archive(txApp, rec)
+	})
+	return counts, err
+}
+
+// restoreRecord brings back an archived record and the records archived
+// together with it. Records whose parent is still archived can't be
+// restored on their own.
+func restoreRecord(app core.App, rec *core.Record) (map[string]int, error) {
+	if !rec.GetBool("archived") {
+		return nil, errors.New("the record is not archived")
+	}
+	for _, parent := range archiveParents[rec.Collection().Name] {
+		id := rec.GetString(parent.field)
+		if id == "" {
+			continue
+		}
+		p, err := app.FindRecordById(parent.collection, id)
+		if err != nil {
+			return nil, err
+		}
+		if p.GetBool("archived") {
+			return nil, errors.New("the " + parent.field + " of the record is archived; restore it first")
+		}
+	}
+
+	stamp := rec.GetDateTime("archived_at").String()
+	counts := map[string]int{}
+	var restore func(txApp core.App, r *core.Record) error
+	restore = func(txApp core.App, r *core.Record) error {
+		r.Set("archived", false)
+		r.Set("archived_at", "")
+		r.Set("deleted_at", "")
+		if r != rec {
+			copyChangeActor(rec, r)
+		}
+		if err := txApp.Save(r); err != nil {
+			return err
+		}
+		counts[r.Collection().Name]++
+
+		for _, child := range archiveChildren[r.Collection().Name] {
+			children, err := txApp.FindRecordsByFilter(
+				child.collection,
+				child.field+"={:id} && archived=true && archived_at={:stamp}",
+				"",
+				0,
+				0,
+				dbx.Params{"id": r.Id, "stamp": stamp},
+			)
+			if err != nil {
+				return err
+			}
+			for _, c := range children {
+				if err := restore(txApp, c); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+
+	err := app.RunInTransaction(func(txApp core.App) error {
+		return restore(txApp, rec)
+	})
+	return counts, err
+}
+
+// purgeRecord hard-deletes rec and the records under it, counting the
+// deleted records per collection into counts.
+func purgeRecord(app core.App, rec *core.Record, counts map[string]int) error {
+	return app.RunInTransaction(func(txApp core.App) error {
+		for _, child := range archiveChildren[rec.Collection().Name] {
+			children, err := txApp.FindRecordsByFilter(child.collection, child.field+"={:id}", "", 0, 0, dbx.Params{"id": rec.Id})
+			if err != nil {
+				return err
+			}
+			for _, c := range children {
+				copyChangeActor(rec, c)
+				if err := purgeRecord(txApp, c, counts); err != nil {
+					return err
+				}
+			}
+		}
+		if err := txApp.Delete(rec); err != nil {
+			return err
+		}
+		counts[rec.Collection().Name]++
+		return nil
+	})
+}
+
+// purgeDeletedRecords hard-deletes the records deleted before the given
+// time, as the retention job. Parents go first so their children are purged
+// with them.
+func purgeDeletedRecords(app core.App, before time.Time) (map[string]int, error) {
+	counts := map[string]int{}
+	for _, name := range []string{collectionLeads, collectionDeals, collectionActivities, collectionAccounts} {
+		records, err := app.FindRecordsByFilter(
+			name,
+			"deleted_at != '' && deleted_at < {:before}",
+			"deleted_at",
+			0,
+			0,
+			dbx.Params{"before": before.UTC().Format(types.DefaultDateLayout)},
+		)
+		if err != nil {
+			return counts, err
+		}
+		for _, rec := range records {
+			setChangeActor(rec, changeSourceCron, "")
+			if err := purgeRecord(app, rec, counts); err != nil {
+				return counts, err
+			}
+		}
+	}
+	return counts, nil
+}
+
+// bindArchiveHooks turns API deletes of CRM records into soft deletes. A
+// second delete of a deleted record (admins only, see the API rules) purges
+// it right away.
+func bindArchiveHooks(app core.App) {
+	names := make([]string, 0, len(archiveCollections))
+	for _, name := range archiveCollections {
+		names = append(names, name)
+	}
+
+	app.OnRecordDeleteRequest(names...).BindFunc(func(e *core.RecordRequestEvent) error {
+		if e.Record.GetDateTime("deleted_at").IsZero() {
+			if _, err := archiveRecord(e.App, e.Record, true); err != nil {
+				return e.BadRequestError("Failed to delete record.", err)
+			}
+		} else if err := purgeRecord(e.App, e.Record, map[string]int{}); err != nil {
+			return e.BadRequestError("Failed to purge record.", err)
+		}
+		return e.NoContent(http.StatusNoContent)
+	})
+}
+
+func bindArchiveRoutes(grp *router.RouterGroup[*core.RequestEvent]) {
+	// loadArchivable resolves {collection}/{id} to a record the caller may see
+	loadArchivable := func(e *core.RequestEvent) (*core.Record, error) {
+		name, ok := archiveCollections[e.Request.PathValue("collection")]
+		if !ok {
+			return nil, e.NotFoundError("Unknown archive collection.", nil)
+		}
+		rec, err := e.App.FindRecordById(name, e.Request.PathValue("id"))
+		if err != nil || (isOwnedCollection(name) && !canAccessOwned(e.App, e.Auth, rec)) {
+			return nil, e.NotFoundError("Record not found.", err)
+		}
+		return rec, nil
+	}
+
+	grp.GET("/archive/{collection}", func(e *core.RequestEvent) error {
+		name, ok := archiveCollections[e.Request.PathValue("collection")]
+		if !ok {
+			return e.NotFoundError("Unknown archive collection.", nil)
+		}
+		col, err := e.App.FindCollectionByNameOrId(name)
+		if err != nil {
+			return e.InternalServerError("Failed to load collection.", err)
+		}
+
+		scope, params := "", dbx.Params{}
+		if isOwnedCollection(name) {
+			scope, params = ownerScopeFilter(e.Auth)
+		}
+
+		// page, perPage, sort and filter work as in the records list API
+		result, err := listRecords(e, col, joinFilters("archived = true", scope), params, search.SortField{Name: "archived_at", Direction: search.SortDesc})
+		if err != nil {
+			return e.BadRequestError("Failed to list archived records.", err)
+		}
+		return e.JSON(http.StatusOK, result)
+	}).Bind(requireCRMRole(roleManager))
+
+	grp.POST("/archive/{collection}/{id}", func(e *core.RequestEvent) error {
+		rec, err := loadArchivable(e)
+		if err != nil {
+			return err
+		}
+		setAuthChangeActor(rec, e.Auth)
+		counts, err := archiveRecord(e.App, rec, false)
+		if err != nil {
+			return e.BadRequestError("Failed to archive record.", err)
+		}
+		return e.JSON(http.StatusOK, map[string]any{"archived": counts})
+	}).Bind(requireCRMRole(roleManager))
+
+	grp.POST("/restore/{collection}/{id}", func(e *core.RequestEvent) error {
+		rec, err := loadArchivable(e)
+		if err != nil {
+			return err
+		}
+		setAuthChangeActor(rec, e.Auth)
+		counts, err := restoreRecord(e.App, rec)
+		if err != nil {
+			return e.BadRequestError("Failed to restore record: "+err.Error(), err)
+		}
+		return e.JSON(http.StatusOK, map[string]any{"restored": counts})
+	}).Bind(requireCRMRole(roleManager))
+
+	grp.POST("/archive/purge/run", func(e *core.RequestEvent) error {
+		counts, err := purgeDeletedRecords(e.App, time.Now().Add(-retentionPeriod()))
+		if err != nil {
+			return e.InternalServerError("Failed to purge deleted records.", err)
+		}
+		return e.JSON(http.StatusOK, map[string]any{"purged": counts})
+	}).Bind(requireCRMRole())
+}
@@ -0,0 +1,397 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/router"
+)
+
+const (
+	assignRoundRobin = "round_robin"
+	assignWeighted   = "weighted"
+	assignTerritory  = "territory"
+	assignSegment    = "segment"
+)
+
+// assignmentState is the rotation state kept on a crm_assignment_rules record.
+type assignmentState struct {
+	LastUser string             `json:"last_user,omitempty"`
+	Current  map[string]float64 `json:"current,omitempty"`
+}
+
+// availableAssignees returns the rule's users that can take new leads, in
+// the order they are listed on the rule.
+func availableAssignees(app core.App, rule *core.Record) ([]*core.Record, error) {
+	ids := rule.GetStringSlice("users")
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	users, err := app.FindRecordsByIds(collectionUsers, ids)
+	if err != nil {
+		return nil, err
+	}
+
+	available := make([]*core.Record, 0, len(users))
+	for _, id := range ids {
+		for _, u := range users {
+			if u.Id == id && !u.GetBool("out_of_office") {
+				available = append(available, u)
+			}
+		}
+	}
+	return available, nil
+}
+
+// ruleMatchesLead reports whether a territory or segment rule applies to the
+// lead. Round-robin and weighted rules match every lead.
+func ruleMatchesLead(app core.App, rule *core.Record, lead *core.Record) (bool, error) {
+	switch rule.GetString("strategy") {
+	case assignTerritory:
+		territories := []string{}
+		_ = rule.UnmarshalJSONField("territories", &territories)
+		if len(territories) == 0 || lead.GetString("account") == "" {
+			return false, nil
+		}
+		acc, err := app.FindRecordById(collectionAccounts, lead.GetString("account"))
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return false, nil
+			}
+			return false, err
+		}
+		country := acc.GetString("country")
+		city := acc.GetString("city")
+		for _, t := range territories {
+			if (country != "" && normalizeCountry(t) == country) || (city != "" && strings.EqualFold(strings.TrimSpace(t), city)) {
+				return true, nil
+			}
+		}
+		return false, nil
+	case assignSegment:
+		seg, err := app.FindRecordById(collectionSegments, rule.GetString("segment"))
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return false, nil
+			}
+			return false, err
+		}
+		if seg.GetString("collection") != collectionLeads {
+			return false, nil
+		}
+		// the filter is written by managers, so it resolves without hidden fields
+		matches, err := findRecordsAs(app, nil, lead.Collection(), joinFilters("id={:id}", seg.GetString("filter")), dbx.Params{"id": lead.Id}, "", 1)
+		if err != nil {
+			return false, err
+		}
+		return len(matches) > 0, nil
+	default:
+		return true, nil
+	}
+}
+
+// pickAssignee chooses the next user of a rule and advances its rotation
+// state. Weighted rules use smooth weighted round-robin on the users'
+// assignment_weight (0 counts as 1); every other strategy rotates evenly.
+// The rule is not saved.
+func pickAssignee(rule *core.Record, users []*core.Record) *core.Record {
+	if len(users) == 0 {
+		return nil
+	}
+
+	state := assignmentState{}
+	_ = rule.UnmarshalJSONField("state", &state)
+
+	var picked *core.Record
+	if rule.GetString("strategy") == assignWeighted {
+		current := map[string]float64{}
+		total := 0.0
+		for _, u := range users {
+			w := u.GetFloat("assignment_weight")
+			if w <= 0 {
+				w = 1
+			}
+			total += w
+			current[u.Id] = state.Current[u.Id] + w
+			if picked == nil || current[u.Id] > current[picked.Id] {
+				picked = u
+			}
+		}
+		current[picked.Id] -= total
+		state.Current = current
+	} else {
+		next := 0
+		for i, u := range users {
+			if u.Id == state.LastUser {
+				next = (i + 1) % len(users)
+				break
+			}
+		}
+		picked = users[next]
+	}
+
+	state.LastUser = picked.Id
+	rule.Set("state", state)
+
+	return picked
+}
+
+// assignLeadOwner routes a lead without owner through the active assignment
+// rules (lowest priority first) and sets the owner of the first matching
+// rule with an available user. It returns the rule that assigned the lead,
+// or nil. The lead is not saved, the rule is.
+func assignLeadOwner(app core.App, lead *core.Record) (*core.Record, error) {
+	if lead.GetString("owner") != "" {
+		return nil, nil
+	}
+
+	rules, err := app.FindRecordsByFilter(collectionAssignmentRules, "active=true", "priority,created", 0, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, rule := range rules {
+		ok, err := ruleMatchesLead(app, rule, lead)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+
+		users, err := availableAssignees(app, rule)
+		if err != nil {
+			return nil, err
+		}
+		owner := pickAssignee(rule, users)
+		if owner == nil {
+			continue
+		}
+
+		if err := app.Save(rule); err != nil {
+			return nil, err
+		}
+		lead.Set("owner", owner.Id)
+		return rule, nil
+	}
+
+	return nil, nil
+}
+
+// reassignLeads moves leads to a new owner together with their open,
+// unarchived deals and the open tasks the previous owner had on them. An
+// empty newOwner routes the leads through the assignment rules again.
+// Activities keep their owner: they record who did the work, and the
+// response counts the ones that stay with someone else. Every save is made
+// on behalf of auth.
+func reassignLeads(app core.App, auth *core.Record, leadIds []string, newOwner string) (map[string]any, error) {
+	if newOwner != "" {
+		if _, err := app.FindRecordById(collectionUsers, newOwner); err != nil {
+			return nil, err
+		}
+	}
+
+	reassigned := []string{}
+	unassigned := []string{}
+	movedDeals := 0
+	movedTasks := 0
+	keptActivities := 0
+	err := app.RunInTransaction(func(txApp core.App) error {
+		leads, err := txApp.FindRecordsByIds(collectionLeads, leadIds)
+		if err != nil {
+			return err
+		}
+
+		for _, lead := range leads {
+			previous := lead.GetString("owner")
+			lead.Set("owner", newOwner)
+			if newOwner == "" {
+				if _, err := assignLeadOwner(txApp, lead); err != nil {
+					return err
+				}
+			}
+			owner := lead.GetString("owner")
+			if owner == "" {
+				unassigned = append(unassigned, lead.Id)
+			} else {
+				reassigned = append(reassigned, lead.Id)
+			}
+			setAuthChangeActor(lead, auth)
+			if err := txApp.Save(lead); err != nil {
+				return err
+			}
+
+			deals, err := txApp.FindRecordsByFilter(
+				collectionDeals,
+				"lead={:lead} && stage != 'won' && stage != 'lost' && archived = false",
+				"",
+				0,
+				0,
+				dbx.Params{"lead": lead.Id},
+			)
+			if err != nil {
+				return err
+			}
+			for _, deal := range deals {
+				if deal.GetString("owner") == owner {
+					continue
+				}
+				deal.Set("owner", owner)
+				setAuthChangeActor(deal, auth)
+				if err := txApp.Save(deal); err != nil {
+					return err
+				}
+				movedDeals++
+			}
+
+			if previous != owner {
+				tasks, err := txApp.FindRecordsByFilter(
+					collectionTasks,
+					"status = 'open' && assignee = {:previous} && (lead = {:lead} || deal.lead = {:lead})",
+					"",
+					0,
+					0,
+					dbx.Params{"lead": lead.Id, "previous": previous},
+				)
+				if err != nil {
+					return err
+				}
+				for _, task := range tasks {
+					task.Set("assignee", owner)
+					setAuthChangeActor(task, auth)
+					if err := txApp.Save(task); err != nil {
+						return err
+					}
+					movedTasks++
+				}
+			}
+
+			kept, err := txApp.CountRecords(collectionActivities, dbx.HashExp{"lead": lead.Id}, dbx.Not(dbx.HashExp{"owner": owner}))
+			if err != nil {
+				return err
+			}
+			keptActivities += int(kept)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]any{
+		"reassignedLeads": reassigned,
+		"unassignedLeads": unassigned,
+		"movedDeals":      movedDeals,
+		"movedTasks":      movedTasks,
+		"keptActivities":  keptActivities,
+	}, nil
+}
+
+// inheritLeadOwner gives deals and activities created without an owner the
+// owner of their lead.
+func inheritLeadOwner(e *core.RecordEvent) error {
+	if e.Record.GetString("owner") == "" && e.Record.GetString("lead") != "" {
+		lead, err := e.App.FindRecordById(collectionLeads, e.Record.GetString("lead"))
+		if err == nil {
+			e.Record.Set("owner", lead.GetString("owner"))
+		}
+	}
+	return e.Next()
+}
+
+// bindAssignmentHooks assigns every new lead, whichever way it is created
+// (importers, CSV, the records API used by web forms), and passes the lead
+// owner on to its deals and activities.
+func bindAssignmentHooks(app core.App) {
+	app.OnRecordCreate(collectionLeads).BindFunc(func(e *core.RecordEvent) error {
+		if err := e.Next(); err != nil {
+			return err
+		}
+
+		// segment rules query the stored lead, so routing runs after the insert
+		if e.Record.GetString("owner") != "" {
+			return nil
+		}
+		rule, err := assignLeadOwner(e.App, e.Record)
+		if err != nil || rule == nil {
+			return err
+		}
+		return e.App.Save(e.Record)
+	})
+
+	app.OnRecordCreate(collectionDeals).BindFunc(inheritLeadOwner)
+	app.OnRecordCreate(collectionActivities).BindFunc(inheritLeadOwner)
+}
+
+func bindAssignmentRoutes(grp *router.RouterGroup[*core.RequestEvent]) {
+	grp.POST("/assignment/reassign", func(e *core.RequestEvent) error {
+		var body struct {
+			LeadIds   []string `json:"leadIds"`
+			FromOwner string   `json:"fromOwner"`
+			ToOwner   string   `json:"toOwner"`
+		}
+		if err := e.BindBody(&body); err != nil {
+			return e.BadRequestError("Invalid body.", err)
+		}
+
+		// managers can only move their team's live leads, within their team
+		for _, id := range body.LeadIds {
+			lead, err := e.App.FindRecordById(collectionLeads, id)
+			if err != nil || lead.GetBool("archived") || !canAccessOwned(e.App, e.Auth, lead) {
+				return e.NotFoundError("Lead not found.", err)
+			}
+		}
+		if body.ToOwner != "" && crmRole(e.Auth) != roleAdmin && body.ToOwner != e.Auth.Id {
+			owner, err := e.App.FindRecordById(collectionUsers, body.ToOwner)
+			if err != nil {
+				return e.NotFoundError("Owner not found.", err)
+			}
+			if team := e.Auth.GetString("team"); team == "" || owner.GetString("team") != team {
+				return e.ForbiddenError("toOwner is not in your team.", nil)
+			}
+		}
+
+		leadIds := slices.Clone(body.LeadIds)
+		if body.FromOwner != "" {
+			// hand over everything still open, e.g. when a rep leaves (mark
+			// them out_of_office first so the rules don't route leads back)
+			scope, params := ownerScopeFilter(e.Auth)
+			params["owner"] = body.FromOwner
+			leads, err := e.App.FindRecordsByFilter(
+				collectionLeads,
+				joinFilters(scope, "owner={:owner} && stage != 'won' && stage != 'lost' && archived = false"),
+				"",
+				0,
+				0,
+				params,
+			)
+			if err != nil {
+				return e.InternalServerError("Failed to load leads.", err)
+			}
+			for _, l := range leads {
+				leadIds = appendUnique(leadIds, l.Id)
+			}
+		}
+		if len(leadIds) == 0 {
+			return e.BadRequestError("Provide leadIds or fromOwner.", nil)
+		}
+		if body.ToOwner != "" && body.ToOwner == body.FromOwner {
+			return e.BadRequestError("toOwner must differ from fromOwner.", nil)
+		}
+
+		res, err := reassignLeads(e.App, e.Auth, leadIds, body.ToOwner)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return e.NotFoundError("Owner not found.", err)
+			}
+			return e.BadRequestError("Failed to reassign leads.", err)
+		}
+		return e.JSON(http.StatusOK, res)
+	}).Bind(requireCRMRole(roleManager))
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/pocketbase/pocketbase/apis"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/router"
+)
+
+// attachmentCollections maps the path segment of the attachment routes to
+// the collections with an attachments field.
+var attachmentCollections = map[string]string{
+	"deals":      collectionDeals,
+	"activities": collectionActivities,
+}
+
+// attachmentMaxSize is the size limit of a single attachment. Override it
+// with AI_CRM_ATTACHMENT_MAX_MB (default 25).
+func attachmentMaxSize() int64 {
+	mb, err := strconv.Atoi(strings.TrimSpace(os.Getenv("AI_CRM_ATTACHMENT_MAX_MB")))
+	if err != nil || mb <= 0 {
+		mb = 25
+	}
+	return int64(mb) << 20
+}
+
+// configureAttachments applies the attachment size limit to the schema and,
+// when AI_CRM_S3_BUCKET is set, switches the file storage to the
+// S3-compatible bucket described by the AI_CRM_S3_* variables. Without it the
+// storage configured in the admin UI is kept (local pb_data by default).
+func configureAttachments(app core.App) error {
+	maxSize := attachmentMaxSize()
+	for _, name := range attachmentCollections {
+		col, err := app.FindCollectionByNameOrId(name)
+		if err != nil {
+			return err
+		}
+		field, ok := col.Fields.GetByName("attachments").(*core.FileField)
+		if !ok || field.MaxSize == maxSize {
+			continue
+		}
+		field.MaxSize = maxSize
+		if err := app.Save(col); err != nil {
+			return err
+		}
+	}
+
+	bucket := strings.TrimSpace(os.Getenv("AI_CRM_S3_BUCKET"))
+	if bucket == "" {
+		return nil
+	}
+	settings := app.Settings()
+	settings.S3.Enabled = true
+	settings.S3.Bucket = bucket
+	settings.S3.Region = strings.TrimSpace(os.Getenv("AI_CRM_S3_REGION"))
+	settings.S3.Endpoint = strings.TrimSpace(os.Getenv("AI_CRM_S3_ENDPOINT"))
+	settings.S3.AccessKey = strings.TrimSpace(os.Getenv("AI_CRM_S3_ACCESS_KEY"))
+	settings.S3.Secret = strings.TrimSpace(os.Getenv("AI_CRM_S3_SECRET"))
+	settings.S3.ForcePathStyle, _ = strconv.ParseBool(os.Getenv("AI_CRM_S3_FORCE_PATH_STYLE"))
+	return app.Save(settings)
+}
+
+// attachmentList describes the attachments of rec with download URLs signed
+// by token. The file API checks the token's auth record against the view rule
+// of the record, so a URL stops working once the record is archived or moves
+// out of the caller's scope.
+func attachmentList(rec *core.Record, token string) []map[string]any {
+	names := rec.GetStringSlice("attachments")
+	items := make([]map[string]any, 0, len(names))
+	for _, name := range names {
+		items = append(items, map[string]any{
+			"name": name,
+			"url": "/api/files/" + url.PathEscape(rec.Collection().Name) + "/" + url.PathEscape(rec.Id) + "/" +
+				url.PathEscape(name) + "?token=" + url.QueryEscape(token),
+		})
+	}
+	return items
+}
+
+func bindAttachmentRoutes(grp *router.RouterGroup[*core.RequestEvent]) {
+	// loadAttachable resolves {collection}/{id} to a live record the caller may see
+	loadAttachable := func(e *core.RequestEvent) (*core.Record, error) {
+		name, ok := attachmentCollections[e.Request.PathValue("collection")]
+		if !ok {
+			return nil, e.NotFoundError("Unknown attachment collection.", nil)
+		}
+		rec, err := e.App.FindRecordById(name, e.Request.PathValue("id"))
+		if err != nil || rec.GetBool("archived") || !canAccessOwned(e.App, e.Auth, rec) {
+			return nil, e.NotFoundError("Record not found.", err)
+		}
+		return rec, nil
+	}
+
+	respond := func(e *core.RequestEvent, rec *core.Record) error {
+		token, err := e.Auth.NewFileToken()
+		if err != nil {
+			return e.InternalServerError("Failed to generate file token.", err)
+		}
+		return e.JSON(http.StatusOK, map[string]any{
+			"record": rec.Id,
+			"items":  attachmentList(rec, token),
+		})
+	}
+
+	grp.GET("/attachments/{collection}/{id}", func(e *core.RequestEvent) error {
+		rec, err := loadAttachable(e)
+		if err != nil {
+			return err
+		}
+		return respond(e, rec)
+	}).Bind(requireCRMRole(roleManager, roleRep))
+
+	// files are sent as multipart "files"; the schema enforces the size limit,
+	// the MIME allowlist and the max number of attachments
+	grp.POST("/attachments/{collection}/{id}", func(e *core.RequestEvent) error {
+		rec, err := loadAttachable(e)
+		if err != nil {
+			return err
+		}
+		files, err := e.FindUploadedFiles("files")
+		if err != nil {
+			return e.BadRequestError("Missing or invalid files.", err)
+		}
+
+		rec.Set("attachments+", files)
+		setAuthChangeActor(rec, e.Auth)
+		if err := e.App.Save(rec); err != nil {
+			return e.BadRequestError("Failed to upload attachments.", err)
+		}
+		return respond(e, rec)
+	}).Bind(requireCRMRole(roleManager, roleRep), apis.BodyLimit(20*attachmentMaxSize()))
+
+	grp.DELETE("/attachments/{collection}/{id}/{name}", func(e *core.RequestEvent) error {
+		rec, err := loadAttachable(e)
+		if err != nil {
+			return err
+		}
+		name := e.Request.PathValue("name")
+		if !slices.Contains(rec.GetStringSlice("attachments"), name) {
+			return e.NotFoundError("Attachment not found.", nil)
+		}
+
+		rec.Set("attachments-", name)
+		setAuthChangeActor(rec, e.Auth)
+		if err := e.App.Save(rec); err != nil {
+			return e.BadRequestError("Failed to remove attachment.", err)
+		}
+		return respond(e, rec)
+	}).Bind(requireCRMRole(roleManager, roleRep))
+}
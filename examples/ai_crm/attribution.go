@@ -0,0 +1,284 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/router"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+// leadSources are the values of the lead source field.
+var leadSources = []string{leadSourceSeed, leadSourceApify, leadSourceCSV, leadSourceWebForm, leadSourceManual}
+
+// utmParams are the UTM parameters kept for the first and last touch.
+var utmParams = []string{"source", "medium", "campaign", "term", "content"}
+
+// leadTouch holds the UTM parameters of one inbound touch, keyed by
+// utmParams.
+type leadTouch map[string]string
+
+// touchFromValues reads the utm_* values (e.g. query params or CSV columns)
+// through get.
+func touchFromValues(get func(key string) string) leadTouch {
+	touch := leadTouch{}
+	for _, p := range utmParams {
+		if v := strings.TrimSpace(get("utm_" + p)); v != "" {
+			touch[p] = v
+		}
+	}
+	return touch
+}
+
+// applyLeadAttribution records a touch on lead: the source detail and the
+// first-touch UTM parameters are only filled once, the last touch is
+// replaced on new leads and by touches that carry UTM parameters, so a
+// re-import without any doesn't blank it.
+func applyLeadAttribution(lead *core.Record, detail string, touch leadTouch) {
+	now := types.NowDateTime()
+	if detail != "" && lead.GetString("source_detail") == "" {
+		lead.Set("source_detail", detail)
+	}
+	if lead.GetDateTime("first_touch_at").IsZero() {
+		for _, p := range utmParams {
+			lead.Set("first_utm_"+p, touch[p])
+		}
+		lead.Set("first_touch_at", now)
+	}
+	if len(touch) == 0 && !lead.IsNew() {
+		return
+	}
+	for _, p := range utmParams {
+		lead.Set("last_utm_"+p, touch[p])
+	}
+	lead.Set("last_touch_at", now)
+}
+
+// bindAttributionHooks sets the source of new leads from whoever creates
+// them (seed data, an importer, the capture endpoint, anything else is
+// manual) and starts their touch history.
+func bindAttributionHooks(app core.App) {
+	app.OnRecordCreate(collectionLeads).BindFunc(func(e *core.RecordEvent) error {
+		lead := e.Record
+		if lead.GetString("source") == "" {
+			source, _ := changeActorOf(lead)
+			if !slices.Contains(leadSources, source) {
+				source = leadSourceManual
+			}
+			lead.Set("source", source)
+		}
+		if lead.GetDateTime("first_touch_at").IsZero() {
+			lead.Set("first_touch_at", types.NowDateTime())
+		}
+		if lead.GetDateTime("last_touch_at").IsZero() {
+			for _, p := range utmParams {
+				if lead.GetString("last_utm_"+p) == "" {
+					lead.Set("last_utm_"+p, lead.GetString("first_utm_"+p))
+				}
+			}
+			lead.Set("last_touch_at", lead.GetDateTime("first_touch_at"))
+		}
+		return e.Next()
+	})
+}
+
+type attributionRow struct {
+	Source         string  `db:"source" json:"source"`
+	Campaign       string  `db:"campaign" json:"campaign"`
+	Leads          int     `db:"leads" json:"leads"`
+	QualifiedLeads int     `db:"qualified_leads" json:"qualifiedLeads"`
+	WonDeals       int     `db:"won_deals" json:"wonDeals"`
+	WonRevenue     float64 `db:"won_revenue" json:"wonRevenue"`
+}
+
+// attributionReport counts the leads created within [from, to) per source
+// and campaign of their first or last touch (model), how many of them got
+// qualified, and the base currency revenue of their won deals.
+func attributionReport(app core.App, model string, scope dbx.Expression, from string, to string) ([]attributionRow, error) {
+	campaign := "l." + model + "_utm_campaign"
+	where := []dbx.Expression{dbx.HashExp{"l.archived": false}, scope}
+	if from != "" {
+		where = append(where, dbx.NewExp("l.created >= {:from}", dbx.Params{"from": from}))
+	}
+	if to != "" {
+		where = append(where, dbx.NewExp("l.created < {:to}", dbx.Params{"to": to}))
+	}
+
+	// a lead counts as qualified once it reached qualified or a later stage
+	qualified := "(l.stage IN ('qualified', 'proposal', 'won') OR EXISTS (SELECT 1 FROM " + collectionStageHistory +
+		" h WHERE h.lead = l.id AND h.to_stage IN ('qualified', 'proposal', 'won')))"
+
+	leads := []attributionRow{}
+	err := app.DB().
+		Select(
+			"l.source AS source",
+			campaign+" AS campaign",
+			"COUNT(*) AS leads",
+			"COALESCE(SUM("+qualified+"), 0) AS qualified_leads",
+		).
+		From(collectionLeads+" l").
+		Where(dbx.And(where...)).
+		GroupBy("source", "campaign").
+		All(&leads)
+	if err != nil {
+		return nil, err
+	}
+
+	closedAt := "COALESCE(NULLIF(d.close_date, ''), d.updated)"
+	won := []attributionRow{}
+	err = app.DB().
+		Select(
+			"l.source AS source",
+			campaign+" AS campaign",
+			"COUNT(*) AS won_deals",
+			"COALESCE(SUM("+baseAmountSQL("d.amount", "d.currency", closedAt)+"), 0) AS won_revenue",
+		).
+		From(collectionDeals+" d").
+		InnerJoin(collectionLeads+" l", dbx.NewExp("l.id = d.lead")).
+		Where(dbx.And(append(where, dbx.HashExp{"d.stage": "won", "d.archived": false})...)).
+		GroupBy("source", "campaign").
+		All(&won)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, w := range won {
+		i := slices.IndexFunc(leads, func(r attributionRow) bool {
+			return r.Source == w.Source && r.Campaign == w.Campaign
+		})
+		if i < 0 {
+			leads = append(leads, attributionRow{Source: w.Source, Campaign: w.Campaign})
+			i = len(leads) - 1
+		}
+		leads[i].WonDeals = w.WonDeals
+		leads[i].WonRevenue = roundMoney(w.WonRevenue)
+	}
+	slices.SortStableFunc(leads, func(a, b attributionRow) int {
+		if a.Leads != b.Leads {
+			return b.Leads - a.Leads
+		}
+		return strings.Compare(a.Source+a.Campaign, b.Source+b.Campaign)
+	})
+	return leads, nil
+}
+
+// captureKey is the shared secret web forms send to the capture endpoint,
+// set with AI_CRM_CAPTURE_KEY. Capturing is disabled without it.
+func captureKey() string {
+	return strings.TrimSpace(os.Getenv("AI_CRM_CAPTURE_KEY"))
+}
+
+func bindAttributionRoutes(grp *router.RouterGroup[*core.RequestEvent]) {
+	// web forms post their fields and the utm_* params of the page (JSON or
+	// form encoded); the key goes in the X-Capture-Key header
+	grp.POST("/capture/leads", func(e *core.RequestEvent) error {
+		key := captureKey()
+		if key == "" || subtle.ConstantTimeCompare([]byte(e.Request.Header.Get("X-Capture-Key")), []byte(key)) != 1 {
+			return e.ForbiddenError("Lead capture is disabled or the key is invalid.", nil)
+		}
+
+		data := struct {
+			Name        string `json:"name" form:"name"`
+			Email       string `json:"email" form:"email"`
+			Company     string `json:"company" form:"company"`
+			JobTitle    string `json:"job_title" form:"job_title"`
+			Phone       string `json:"phone" form:"phone"`
+			Website     string `json:"website" form:"website"`
+			Form        string `json:"form" form:"form"`
+			UTMSource   string `json:"utm_source" form:"utm_source"`
+			UTMMedium   string `json:"utm_medium" form:"utm_medium"`
+			UTMCampaign string `json:"utm_campaign" form:"utm_campaign"`
+			UTMTerm     string `json:"utm_term" form:"utm_term"`
+			UTMContent  string `json:"utm_content" form:"utm_content"`
+		}{}
+		if err := e.BindBody(&data); err != nil {
+			return e.BadRequestError("Invalid capture payload.", err)
+		}
+		if strings.TrimSpace(data.Name) == "" && strings.TrimSpace(data.Email) == "" {
+			return e.BadRequestError("A name or an email is required.", nil)
+		}
+		if strings.TrimSpace(data.Name) == "" {
+			data.Name, _, _ = strings.Cut(data.Email, "@")
+		}
+
+		utm := map[string]string{
+			"utm_source":   data.UTMSource,
+			"utm_medium":   data.UTMMedium,
+			"utm_campaign": data.UTMCampaign,
+			"utm_term":     data.UTMTerm,
+			"utm_content":  data.UTMContent,
+		}
+		// UTM params on the capture URL fill what the body left out
+		query := e.Request.URL.Query()
+		touch := touchFromValues(func(k string) string {
+			if v := utm[k]; v != "" {
+				return v
+			}
+			return query.Get(k)
+		})
+
+		c := apifyLeadCandidate{
+			FullName:       data.Name,
+			Email:          data.Email,
+			JobTitle:       data.JobTitle,
+			Phone:          data.Phone,
+			CompanyName:    data.Company,
+			CompanyWebsite: data.Website,
+			SourceDetail:   strings.TrimSpace(data.Form),
+			Touch:          touch,
+		}
+
+		accountId := ""
+		if c.CompanyName != "" {
+			acc, _, err := upsertAccount(e.App, leadSourceWebForm, accountDetailsFromCandidate(c))
+			if err != nil {
+				return e.BadRequestError("Failed to capture lead.", err)
+			}
+			accountId = acc.Id
+		}
+		res, err := upsertLead(e.App, leadSourceWebForm, accountId, c)
+		if err != nil {
+			return e.BadRequestError("Failed to capture lead.", err)
+		}
+		return e.JSON(http.StatusOK, map[string]any{"id": res.Lead.Id, "created": res.Created})
+	})
+
+	grp.GET("/reports/attribution", func(e *core.RequestEvent) error {
+		q := e.Request.URL.Query()
+		model := q.Get("model")
+		if model == "" {
+			model = "first"
+		}
+		if model != "first" && model != "last" {
+			return e.BadRequestError("model must be first or last.", nil)
+		}
+
+		scope := ownerScopeExpr(e.Auth, "l.owner")
+		if owner := q.Get("owner"); owner != "" {
+			scope = dbx.And(scope, dbx.HashExp{"l.owner": owner})
+		}
+		rows, err := attributionReport(e.App, model, scope, q.Get("from"), q.Get("to"))
+		if err != nil {
+			return e.InternalServerError("Failed to build attribution report.", err)
+		}
+
+		total := attributionRow{}
+		for _, r := range rows {
+			total.Leads += r.Leads
+			total.QualifiedLeads += r.QualifiedLeads
+			total.WonDeals += r.WonDeals
+			total.WonRevenue = roundMoney(total.WonRevenue + r.WonRevenue)
+		}
+		return e.JSON(http.StatusOK, map[string]any{
+			"model":    model,
+			"items":    rows,
+			"total":    total,
+			"currency": baseCurrency(),
+		})
+	}).Bind(requireCRMRole(roleManager))
+}
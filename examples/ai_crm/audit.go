@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/router"
+	"github.com/pocketbase/pocketbase/tools/search"
+)
+
+type fieldChange struct {
+	Old any `json:"old"`
+	New any `json:"new"`
+}
+
+// isAudited reports whether changes of the collection are audited: every
+// crm_* collection but the audit log, the stage history and the forecast and
+// pipeline snapshots, which are logs themselves.
+func isAudited(name string) bool {
+	return strings.HasPrefix(name, "crm_") && name != collectionAuditLog && name != collectionStageHistory &&
+		name != collectionForecastSnapshots && name != collectionPipelineSnapshots
+}
+
+// auditedFields are the fields of col a diff covers. Autodates change on
+// every save and secrets (passwords, token keys and other hidden fields)
+// must not end up in the log.
+func auditedFields(col *core.Collection) []core.Field {
+	fields := []core.Field{}
+	for _, f := range col.Fields {
+		switch f.(type) {
+		case *core.AutodateField, *core.PasswordField:
+			continue
+		}
+		if f.GetHidden() {
+			continue
+		}
+		fields = append(fields, f)
+	}
+	return fields
+}
+
+// diffRecord returns the changed fields between before and after; before is
+// nil for a create and after is nil for a delete. Values are compared by
+// their JSON form.
+func diffRecord(col *core.Collection, before *core.Record, after *core.Record) map[string]fieldChange {
+	changes := map[string]fieldChange{}
+	for _, f := range auditedFields(col) {
+		name := f.GetName()
+		var oldValue, newValue any
+		if before != nil {
+			oldValue = before.Get(name)
+		}
+		if after != nil {
+			newValue = after.Get(name)
+		}
+
+		oldJSON, _ := json.Marshal(oldValue)
+		newJSON, _ := json.Marshal(newValue)
+		if string(oldJSON) == string(newJSON) {
+			continue
+		}
+		// a create or delete only lists the fields that hold something
+		if (before == nil || after == nil) && (isEmptyJSON(oldJSON) && isEmptyJSON(newJSON)) {
+			continue
+		}
+		changes[name] = fieldChange{Old: oldValue, New: newValue}
+	}
+	return changes
+}
+
+func isEmptyJSON(raw []byte) bool {
+	switch string(raw) {
+	case "null", `""`, "[]", "{}":
+		return true
+	}
+	return false
+}
+
+// writeAudit stores one audit entry for rec, attributed to whoever saved or
+// deleted it.
+func writeAudit(app core.App, rec *core.Record, action string, changes map[string]fieldChange) error {
+	if action == "update" && len(changes) == 0 {
+		return nil
+	}
+
+	col, err := app.FindCollectionByNameOrId(collectionAuditLog)
+	if err != nil {
+		return err
+	}
+
+	source, actorId := changeActorOf(rec)
+
+	entry := core.NewRecord(col)
+	entry.Set("record_collection", rec.Collection().Name)
+	entry.Set("record_id", rec.Id)
+	entry.Set("action", action)
+	entry.Set("changes", changes)
+	entry.Set("source", source)
+	entry.Set("actor", actorId)
+	return app.Save(entry)
+}
+
+// bindAuditHooks writes the field-level diff of every create, update and
+// delete of a CRM record, whatever path it came through.
+func bindAuditHooks(app core.App) {
+	app.OnRecordCreate().BindFunc(func(e *core.RecordEvent) error {
+		if !isAudited(e.Record.Collection().Name) {
+			return e.Next()
+		}
+		if err := e.Next(); err != nil {
+			return err
+		}
+		return writeAudit(e.App, e.Record, "create", diffRecord(e.Record.Collection(), nil, e.Record))
+	})
+
+	app.OnRecordUpdate().BindFunc(func(e *core.RecordEvent) error {
+		if !isAudited(e.Record.Collection().Name) {
+			return e.Next()
+		}
+		before := e.Record.Original()
+		if err := e.Next(); err != nil {
+			return err
+		}
+		return writeAudit(e.App, e.Record, "update", diffRecord(e.Record.Collection(), before, e.Record))
+	})
+
+	app.OnRecordDelete().BindFunc(func(e *core.RecordEvent) error {
+		if !isAudited(e.Record.Collection().Name) {
+			return e.Next()
+		}
+		if err := e.Next(); err != nil {
+			return err
+		}
+		return writeAudit(e.App, e.Record, "delete", diffRecord(e.Record.Collection(), e.Record, nil))
+	})
+}
+
+// canViewAudit reports whether auth may read the audit trail of a record.
+// Owned records follow their owner scope, records of other collections need
+// a manager and records that no longer exist an admin.
+func canViewAudit(app core.App, auth *core.Record, collection string, recordId string) bool {
+	role := crmRole(auth)
+	rec, err := app.FindRecordById(collection, recordId)
+	switch {
+	case role == roleAdmin:
+		return true
+	case err != nil:
+		return false
+	case isOwnedCollection(collection):
+		return canAccessOwned(app, auth, rec)
+	default:
+		return role == roleManager
+	}
+}
+
+func bindAuditRoutes(grp *router.RouterGroup[*core.RequestEvent]) {
+	grp.GET("/audit/{collection}/{id}", func(e *core.RequestEvent) error {
+		collection := e.Request.PathValue("collection")
+		recordId := e.Request.PathValue("id")
+		if !isAudited(collection) || !canViewAudit(e.App, e.Auth, collection, recordId) {
+			return e.NotFoundError("Record not found.", nil)
+		}
+
+		entries, err := e.App.FindRecordsByFilter(
+			collectionAuditLog,
+			"record_collection={:collection} && record_id={:id}",
+			"-created",
+			0,
+			0,
+			dbx.Params{"collection": collection, "id": recordId},
+		)
+		if err != nil {
+			return e.InternalServerError("Failed to load audit log.", err)
+		}
+		return e.JSON(http.StatusOK, map[string]any{"items": entries})
+	}).Bind(requireCRMRole(roleManager, roleRep))
+
+	grp.GET("/audit", func(e *core.RequestEvent) error {
+		q := e.Request.URL.Query()
+		if action := q.Get("action"); action != "" && !slices.Contains([]string{"create", "update", "delete"}, action) {
+			return e.BadRequestError("action must be create, update or delete.", nil)
+		}
+
+		filters := []string{}
+		params := dbx.Params{}
+		for _, p := range []struct{ param, field string }{
+			{"collection", "record_collection"},
+			{"record", "record_id"},
+			{"action", "action"},
+			{"source", "source"},
+			{"actor", "actor"},
+		} {
+			if v := strings.TrimSpace(q.Get(p.param)); v != "" {
+				filters = append(filters, p.field+"={:"+p.param+"}")
+				params[p.param] = v
+			}
+		}
+		if field := strings.TrimSpace(q.Get("field")); field != "" {
+			// changes is a JSON object keyed by field name
+			filters = append(filters, "changes ~ {:field}")
+			params["field"] = strconv.Quote(field) + ":"
+		}
+		if from := q.Get("from"); from != "" {
+			filters = append(filters, "created >= {:from}")
+			params["from"] = from
+		}
+		if to := q.Get("to"); to != "" {
+			filters = append(filters, "created < {:to}")
+			params["to"] = to
+		}
+
+		col, err := e.App.FindCollectionByNameOrId(collectionAuditLog)
+		if err != nil {
+			return e.InternalServerError("Failed to load audit collection.", err)
+		}
+
+		// page, perPage, sort and filter work as in the records list API
+		result, err := listRecords(e, col, joinFilters(filters...), params, search.SortField{Name: "created", Direction: search.SortDesc})
+		if err != nil {
+			return e.BadRequestError("Failed to list audit log.", err)
+		}
+		return e.JSON(http.StatusOK, result)
+	}).Bind(requireCRMRole())
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/router"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+// maxCSVImportSize caps uploaded CSV files (10MB).
+const maxCSVImportSize = 10 << 20
+
+// maxCSVExportRows caps a single export.
+const maxCSVExportRows = 10000
+
+// exportCollections maps the export path segment to its collection.
+var exportCollections = map[string]string{
+	"leads":    collectionLeads,
+	"accounts": collectionAccounts,
+	"deals":    collectionDeals,
+}
+
+// csvLeadColumns maps normalized CSV headers to the lead input they fill.
+// Any other header is matched against the lead custom fields.
+var csvLeadColumns = map[string]string{
+	"name":            "name",
+	"full_name":       "name",
+	"fullname":        "name",
+	"email":           "email",
+	"email_address":   "email",
+	"company":         "company",
+	"company_name":    "company",
+	"job_title":       "job_title",
+	"title":           "job_title",
+	"position":        "job_title",
+	"phone":           "phone",
+	"mobile":          "phone",
+	"phone_number":    "phone",
+	"linkedin":        "linkedin",
+	"linkedin_url":    "linkedin",
+	"website":         "website",
+	"company_website": "website",
+	"domain":          "website",
+	"observed_at":     "observed_at",
+	"scraped_at":      "observed_at",
+	"updated_at":      "observed_at",
+}
+
+func normalizeCSVHeader(h string) string {
+	h = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(h, "\ufeff")))
+	return strings.NewReplacer(" ", "_", "-", "_").Replace(h)
+}
+
+// exportColumns lists the fields written to a CSV export: every field except
+// JSON blobs, passwords and files.
+func exportColumns(col *core.Collection) []string {
+	cols := []string{}
+	for _, f := range col.Fields {
+		switch f.(type) {
+		case *core.JSONField, *core.PasswordField, *core.FileField:
+			continue
+		}
+		cols = append(cols, f.GetName())
+	}
+	return cols
+}
+
+func writeRecordsCSV(w io.Writer, columns []string, records []*core.Record) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(columns); err != nil {
+		return err
+	}
+	row := make([]string, len(columns))
+	for _, r := range records {
+		for i, c := range columns {
+			if f, ok := r.Collection().Fields.GetByName(c).(core.MultiValuer); ok && f.IsMultiple() {
+				row[i] = strings.Join(r.GetStringSlice(c), "|")
+			} else {
+				row[i] = r.GetString(c)
+			}
+		}
+		if err := cw.Write(row); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+type csvImportError struct {
+	Row   int    `json:"row"`
+	Error string `json:"error"`
+}
+
+// importLeadsCSV upserts one lead per CSV row through the same merge policy
+// as the Apify importer (source "csv", with detail as the source detail).
+// Custom field columns are validated per row; a row with an invalid value is
+// skipped and reported. utm_* columns record the touch of the lead, and an
+// observed_at column dates the row for keep_newest merges.
+func importLeadsCSV(app core.App, r io.Reader, detail string) (map[string]any, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	cr.TrimLeadingSpace = true
+
+	header, err := cr.Read()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CSV header: %w", err)
+	}
+	for i, h := range header {
+		header[i] = normalizeCSVHeader(h)
+	}
+
+	defs, err := loadCustomFieldDefs(app, collectionLeads)
+	if err != nil {
+		return nil, err
+	}
+
+	created := 0
+	updated := 0
+	conflicts := 0
+	rowErrors := []csvImportError{}
+	failed := 0
+	fail := func(row int, err error) {
+		failed++
+		if len(rowErrors) < 100 {
+			rowErrors = append(rowErrors, csvImportError{Row: row, Error: err.Error()})
+		}
+	}
+
+	for rowNum := 2; ; rowNum++ {
+		cells, err := cr.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			fail(rowNum, err)
+			continue
+		}
+
+		values := map[string]string{}
+		for i, h := range header {
+			if i < len(cells) && h != "" {
+				values[h] = strings.TrimSpace(cells[i])
+			}
+		}
+
+		input := map[string]string{}
+		for h, v := range values {
+			if target, ok := csvLeadColumns[h]; ok && input[target] == "" {
+				input[target] = v
+			}
+		}
+		if input["name"] == "" {
+			fail(rowNum, errors.New("missing name"))
+			continue
+		}
+
+		custom, err := parseCustomFieldValues(defs, values)
+		if err != nil {
+			fail(rowNum, err)
+			continue
+		}
+
+		var observedAt types.DateTime
+		if raw := input["observed_at"]; raw != "" {
+			observedAt, err = types.ParseDateTime(raw)
+			if err != nil || observedAt.IsZero() {
+				fail(rowNum, fmt.Errorf("invalid observed_at %q", raw))
+				continue
+			}
+		}
+
+		c := apifyLeadCandidate{
+			FullName:       input["name"],
+			Email:          input["email"],
+			JobTitle:       input["job_title"],
+			Linkedin:       input["linkedin"],
+			Phone:          input["phone"],
+			CompanyName:    input["company"],
+			CompanyWebsite: input["website"],
+			SourceDetail:   detail,
+			Touch:          touchFromValues(func(k string) string { return values[k] }),
+			ObservedAt:     observedAt.Time(),
+		}
+
+		accountId := ""
+		if c.CompanyName != "" {
+			acc, _, err := upsertAccount(app, leadSourceCSV, accountDetailsFromCandidate(c))
+			if err != nil {
+				fail(rowNum, err)
+				continue
+			}
+			accountId = acc.Id
+		}
+
+		res, err := upsertLead(app, leadSourceCSV, accountId, c)
+		if err != nil {
+			fail(rowNum, err)
+			continue
+		}
+		conflicts += res.Conflicts
+		if res.Created {
+			created++
+		} else {
+			updated++
+		}
+
+		if applyCustomFieldValues(defs, res.Lead, custom, !res.Created) {
+			if err := app.Save(res.Lead); err != nil {
+				fail(rowNum, err)
+			}
+		}
+	}
+
+	return map[string]any{
+		"createdLeads": created,
+		"updatedLeads": updated,
+		"conflicts":    conflicts,
+		"failed":       failed,
+		"errors":       rowErrors,
+	}, nil
+}
+
+func bindCSVRoutes(grp *router.RouterGroup[*core.RequestEvent]) {
+	grp.GET("/export/{collection}", func(e *core.RequestEvent) error {
+		name, ok := exportCollections[e.Request.PathValue("collection")]
+		if !ok {
+			return e.NotFoundError("Unknown export collection.", nil)
+		}
+		col, err := e.App.FindCollectionByNameOrId(name)
+		if err != nil {
+			return e.InternalServerError("Failed to load collection.", err)
+		}
+
+		q := e.Request.URL.Query()
+		sort := q.Get("sort")
+		if sort == "" {
+			sort = "-created"
+		}
+
+		segmentFilter := ""
+		if segmentId := q.Get("segment"); segmentId != "" {
+			segmentFilter, err = segmentFilterFor(e.App, segmentId, name)
+			if err != nil {
+				return e.BadRequestError("Invalid segment.", err)
+			}
+		}
+
+		scope, params := "", dbx.Params{}
+		if isOwnedCollection(name) {
+			scope, params = ownerScopeFilter(e.Auth)
+		}
+
+		records, err := findRecordsAs(e.App, e.Auth, col, joinFilters("archived = false", scope, segmentFilter, q.Get("filter")), params, sort, maxCSVExportRows)
+		if err != nil {
+			return e.BadRequestError("Invalid filter or sort.", err)
+		}
+
+		columns := exportColumns(col)
+		if name == collectionDeals {
+			if err := setDealContactsColumn(e.App, records); err != nil {
+				return e.InternalServerError("Failed to load deal contacts.", err)
+			}
+			columns = append(columns, "contacts")
+		}
+
+		e.Response.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		e.Response.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.csv"`, name))
+		e.Response.WriteHeader(http.StatusOK)
+		return writeRecordsCSV(e.Response, columns, records)
+	}).Bind(requireCRMRole(roleManager))
+
+	grp.POST("/import/leads", func(e *core.RequestEvent) error {
+		e.Request.Body = http.MaxBytesReader(e.Response, e.Request.Body, maxCSVImportSize)
+
+		var src io.Reader = e.Request.Body
+		detail := "CSV import"
+		if strings.HasPrefix(e.Request.Header.Get("Content-Type"), "multipart/form-data") {
+			f, header, err := e.Request.FormFile("file")
+			if err != nil {
+				return e.BadRequestError("Missing CSV file.", err)
+			}
+			defer f.Close()
+			src = f
+			detail = "CSV import: " + header.Filename
+		}
+
+		res, err := importLeadsCSV(e.App, src, detail)
+		if err != nil {
+			return e.BadRequestError("CSV import failed.", err)
+		}
+		return e.JSON(http.StatusOK, res)
+	}).Bind(requireCRMRole(roleManager))
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	validation "github.com/go-ozzo/ozzo-validation/v4"
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+var currencyCodePattern = regexp.MustCompile(`^[A-Z]{3}$`)
+
+// baseCurrency is the currency every pipeline and forecast aggregation is
+// reported in. Override it with AI_CRM_BASE_CURRENCY (default AED).
+func baseCurrency() string {
+	if v := strings.ToUpper(strings.TrimSpace(os.Getenv("AI_CRM_BASE_CURRENCY"))); currencyCodePattern.MatchString(v) {
+		return v
+	}
+	return "AED"
+}
+
+// exchangeRateSQL returns an SQL expression for the rate converting one unit
+// of currencyExpr into the base currency on dateExpr (a stored date string).
+// It takes the latest rate effective on that date, falling back to the
+// earliest known rate for older dates, and uses the inverse pair when only
+// that one is recorded. It is NULL when the pair has no rate at all.
+func exchangeRateSQL(currencyExpr string, dateExpr string) string {
+	// baseCurrency is always [A-Z]{3}, so it is safe to inline
+	base := "'" + baseCurrency() + "'"
+	// SQLite can't resolve outer columns in the ORDER BY of a subquery inside
+	// an aggregate, so the date is only compared in WHERE
+	pick := func(col string, from string, to string) string {
+		pair := "SELECT " + col + " FROM " + collectionExchangeRates + " r WHERE r.from_currency = " + from + " AND r.to_currency = " + to
+		return "COALESCE((" + pair + " AND r.effective_date <= " + dateExpr + " ORDER BY r.effective_date DESC LIMIT 1), (" +
+			pair + " ORDER BY r.effective_date ASC LIMIT 1))"
+	}
+	return "(CASE WHEN COALESCE(" + currencyExpr + ", '') IN ('', " + base + ") THEN 1.0 ELSE COALESCE(" +
+		pick("r.rate", currencyExpr, base) + ", " +
+		pick("1.0 / NULLIF(r.rate, 0)", base, currencyExpr) + ") END)"
+}
+
+// baseAmountSQL converts amountExpr from currencyExpr into the base currency
+// at dateExpr. Amounts without a known rate are NULL, so SUM() skips them.
+func baseAmountSQL(amountExpr string, currencyExpr string, dateExpr string) string {
+	return "(" + amountExpr + " * " + exchangeRateSQL(currencyExpr, dateExpr) + ")"
+}
+
+// dealValuationDateSQL is the date a deal amount is converted at: its close
+// date, or the snapshot date when the deal has none.
+func dealValuationDateSQL(alias string, snapshotParam string) string {
+	return "COALESCE(NULLIF(" + alias + ".close_date, ''), {:" + snapshotParam + "})"
+}
+
+// exchangeRate returns the rate converting currency into the base currency
+// at the given time (see exchangeRateSQL).
+func exchangeRate(app core.App, currency string, at time.Time) (float64, error) {
+	var rate sql.NullFloat64
+	err := app.DB().
+		NewQuery("SELECT " + exchangeRateSQL("{:currency}", "{:at}")).
+		Bind(dbx.Params{"currency": currency, "at": at.UTC().Format(types.DefaultDateLayout)}).
+		Row(&rate)
+	if err != nil {
+		return 0, err
+	}
+	if !rate.Valid {
+		return 0, fmt.Errorf("no exchange rate from %s to %s", currency, baseCurrency())
+	}
+	return rate.Float64, nil
+}
+
+// bindCurrencyHooks defaults deals to the base currency and rejects
+// currencies that can't be converted, so aggregations never silently drop
+// a deal.
+func bindCurrencyHooks(app core.App) {
+	checkDeal := func(e *core.RecordEvent) error {
+		currency := strings.ToUpper(strings.TrimSpace(e.Record.GetString("currency")))
+		if currency == "" {
+			currency = baseCurrency()
+		}
+		e.Record.Set("currency", currency)
+
+		if e.Record.IsNew() || currency != e.Record.Original().GetString("currency") {
+			if _, err := exchangeRate(e.App, currency, time.Now()); err != nil {
+				return validation.Errors{"currency": validation.NewError("validation_missing_exchange_rate", err.Error())}
+			}
+		}
+		return e.Next()
+	}
+	app.OnRecordCreate(collectionDeals).BindFunc(checkDeal)
+	app.OnRecordUpdate(collectionDeals).BindFunc(checkDeal)
+
+	normalizeRate := func(e *core.RecordEvent) error {
+		for _, f := range []string{"from_currency", "to_currency"} {
+			e.Record.Set(f, strings.ToUpper(strings.TrimSpace(e.Record.GetString(f))))
+		}
+		if e.Record.GetString("from_currency") == e.Record.GetString("to_currency") {
+			return validation.Errors{"to_currency": validation.NewError("validation_same_currency", "The currencies of a rate must differ.")}
+		}
+		return e.Next()
+	}
+	app.OnRecordCreate(collectionExchangeRates).BindFunc(normalizeRate)
+	app.OnRecordUpdate(collectionExchangeRates).BindFunc(normalizeRate)
+}
+
+// convertFromBase converts a base currency amount into currency at the given
+// time, for defaults such as catalog prices (which are in the base currency).
+func convertFromBase(app core.App, amount float64, currency string, at time.Time) (float64, error) {
+	rate, err := exchangeRate(app, currency, at)
+	if err != nil {
+		return 0, err
+	}
+	if rate == 0 {
+		return 0, errors.New("exchange rate is zero")
+	}
+	return roundMoney(amount / rate), nil
+}
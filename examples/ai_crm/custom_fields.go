@@ -0,0 +1,314 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/router"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+// customFieldPrefix namespaces user-defined fields so they can never clash
+// with built-in ones ("budget" is stored as "cf_budget").
+const customFieldPrefix = "cf_"
+
+var customFieldCollections = []string{collectionLeads, collectionAccounts, collectionDeals}
+
+// customFieldDef is the parsed form of a crm_custom_fields record.
+type customFieldDef struct {
+	Collection string
+	Name       string
+	Type       string
+	Options    []string
+}
+
+func (d customFieldDef) FieldName() string {
+	return customFieldPrefix + d.Name
+}
+
+func customFieldDefFromRecord(rec *core.Record) customFieldDef {
+	options := []string{}
+	_ = rec.UnmarshalJSONField("options", &options)
+	return customFieldDef{
+		Collection: rec.GetString("collection"),
+		Name:       rec.GetString("name"),
+		Type:       rec.GetString("type"),
+		Options:    options,
+	}
+}
+
+func (d customFieldDef) schemaField() (core.Field, error) {
+	switch d.Type {
+	case "text":
+		return &core.TextField{Name: d.FieldName(), Max: 2000}, nil
+	case "number":
+		return &core.NumberField{Name: d.FieldName()}, nil
+	case "select":
+		if len(d.Options) == 0 {
+			return nil, errors.New("select fields need at least one option")
+		}
+		return &core.SelectField{Name: d.FieldName(), Values: d.Options, MaxSelect: 1}, nil
+	case "date":
+		return &core.DateField{Name: d.FieldName()}, nil
+	case "bool":
+		return &core.BoolField{Name: d.FieldName()}, nil
+	default:
+		return nil, fmt.Errorf("unsupported custom field type %q", d.Type)
+	}
+}
+
+// parseValue converts raw text (from a CSV cell or JSON body) into the value
+// stored in the field, rejecting anything that doesn't fit the type.
+func (d customFieldDef) parseValue(raw string) (any, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return nil, nil
+	}
+
+	switch d.Type {
+	case "number":
+		v, err := strconv.ParseFloat(strings.ReplaceAll(raw, ",", ""), 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %q is not a number", d.Name, raw)
+		}
+		return v, nil
+	case "select":
+		for _, o := range d.Options {
+			if strings.EqualFold(o, raw) {
+				return o, nil
+			}
+		}
+		return nil, fmt.Errorf("%s: %q is not one of %s", d.Name, raw, strings.Join(d.Options, ", "))
+	case "date":
+		for _, layout := range []string{time.RFC3339, types.DefaultDateLayout, time.DateTime, time.DateOnly, "02/01/2006"} {
+			if t, err := time.Parse(layout, raw); err == nil {
+				return t.UTC(), nil
+			}
+		}
+		return nil, fmt.Errorf("%s: %q is not a date", d.Name, raw)
+	case "bool":
+		switch strings.ToLower(raw) {
+		case "1", "true", "yes", "y":
+			return true, nil
+		case "0", "false", "no", "n":
+			return false, nil
+		}
+		return nil, fmt.Errorf("%s: %q is not a boolean", d.Name, raw)
+	default:
+		if len(raw) > 2000 {
+			return nil, fmt.Errorf("%s: value is longer than 2000 characters", d.Name)
+		}
+		return raw, nil
+	}
+}
+
+// isEmpty reports whether rec holds no value for the field. Zero numbers
+// and false booleans count as empty.
+func (d customFieldDef) isEmpty(rec *core.Record) bool {
+	switch d.Type {
+	case "number":
+		return rec.GetFloat(d.FieldName()) == 0
+	case "date":
+		return rec.GetDateTime(d.FieldName()).IsZero()
+	case "bool":
+		return !rec.GetBool(d.FieldName())
+	default:
+		return rec.GetString(d.FieldName()) == ""
+	}
+}
+
+// loadCustomFieldDefs returns the custom field definitions of a collection.
+func loadCustomFieldDefs(app core.App, collection string) ([]customFieldDef, error) {
+	recs, err := app.FindRecordsByFilter(collectionCustomFields, "collection={:collection}", "name", 0, 0, dbx.Params{"collection": collection})
+	if err != nil {
+		return nil, err
+	}
+	defs := make([]customFieldDef, 0, len(recs))
+	for _, r := range recs {
+		defs = append(defs, customFieldDefFromRecord(r))
+	}
+	return defs, nil
+}
+
+// parseCustomFieldValues validates values (keyed by custom field name, with
+// or without the "cf_" prefix) against defs and returns them keyed by their
+// stored field name. Unknown keys and empty values are ignored.
+func parseCustomFieldValues(defs []customFieldDef, values map[string]string) (map[string]any, error) {
+	parsed := map[string]any{}
+	errs := []string{}
+	for _, d := range defs {
+		raw, ok := values[d.Name]
+		if !ok {
+			raw, ok = values[d.FieldName()]
+		}
+		if !ok {
+			continue
+		}
+
+		v, err := d.parseValue(raw)
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		if v != nil {
+			parsed[d.FieldName()] = v
+		}
+	}
+	if len(errs) > 0 {
+		return nil, errors.New(strings.Join(errs, "; "))
+	}
+	return parsed, nil
+}
+
+// applyCustomFieldValues sets parsed values on rec. With onlyEmpty, fields
+// that already hold a value are left untouched. It reports whether rec changed.
+func applyCustomFieldValues(defs []customFieldDef, rec *core.Record, parsed map[string]any, onlyEmpty bool) bool {
+	changed := false
+	for _, d := range defs {
+		v, ok := parsed[d.FieldName()]
+		if !ok || (onlyEmpty && !d.isEmpty(rec)) {
+			continue
+		}
+		rec.Set(d.FieldName(), v)
+		changed = true
+	}
+	return changed
+}
+
+// bindCustomFieldHooks keeps the target collection schemas in sync with the
+// crm_custom_fields registry, whether it is edited through the API below or
+// the admin UI.
+func bindCustomFieldHooks(app core.App) {
+	app.OnRecordCreate(collectionCustomFields).BindFunc(func(e *core.RecordEvent) error {
+		d := customFieldDefFromRecord(e.Record)
+		if !slices.Contains(customFieldCollections, d.Collection) {
+			return fmt.Errorf("custom fields are not supported on %q", d.Collection)
+		}
+
+		col, err := e.App.FindCollectionByNameOrId(d.Collection)
+		if err != nil {
+			return err
+		}
+		if col.Fields.GetByName(d.FieldName()) != nil {
+			return fmt.Errorf("field %q already exists on %s", d.FieldName(), d.Collection)
+		}
+
+		field, err := d.schemaField()
+		if err != nil {
+			return err
+		}
+		col.Fields.Add(field)
+		if err := e.App.Save(col); err != nil {
+			return err
+		}
+
+		return e.Next()
+	})
+
+	app.OnRecordUpdate(collectionCustomFields).BindFunc(func(e *core.RecordEvent) error {
+		before := customFieldDefFromRecord(e.Record.Original())
+		after := customFieldDefFromRecord(e.Record)
+		if before.Collection != after.Collection || before.Name != after.Name || before.Type != after.Type {
+			return errors.New("collection, name and type of a custom field can't be changed; delete it and define a new one")
+		}
+
+		if after.Type == "select" && !slices.Equal(before.Options, after.Options) {
+			col, err := e.App.FindCollectionByNameOrId(after.Collection)
+			if err != nil {
+				return err
+			}
+			field, err := after.schemaField()
+			if err != nil {
+				return err
+			}
+			col.Fields.Add(field)
+			if err := e.App.Save(col); err != nil {
+				return err
+			}
+		}
+
+		return e.Next()
+	})
+
+	app.OnRecordDelete(collectionCustomFields).BindFunc(func(e *core.RecordEvent) error {
+		d := customFieldDefFromRecord(e.Record)
+		col, err := e.App.FindCollectionByNameOrId(d.Collection)
+		if err != nil {
+			return err
+		}
+		if col.Fields.GetByName(d.FieldName()) != nil {
+			col.Fields.RemoveByName(d.FieldName())
+			if err := e.App.Save(col); err != nil {
+				return err
+			}
+		}
+		return e.Next()
+	})
+}
+
+func bindCustomFieldRoutes(grp *router.RouterGroup[*core.RequestEvent]) {
+	grp.GET("/custom-fields", func(e *core.RequestEvent) error {
+		filter := ""
+		params := dbx.Params{}
+		if col := strings.TrimSpace(e.Request.URL.Query().Get("collection")); col != "" {
+			filter = "collection={:collection}"
+			params["collection"] = col
+		}
+		items, err := e.App.FindRecordsByFilter(collectionCustomFields, filter, "collection,name", 0, 0, params)
+		if err != nil {
+			return e.InternalServerError("Failed to list custom fields.", err)
+		}
+		return e.JSON(http.StatusOK, map[string]any{"items": items})
+	}).Bind(requireCRMRole(roleManager, roleRep))
+
+	grp.POST("/custom-fields", func(e *core.RequestEvent) error {
+		var body struct {
+			Collection string   `json:"collection"`
+			Name       string   `json:"name"`
+			Label      string   `json:"label"`
+			Type       string   `json:"type"`
+			Options    []string `json:"options"`
+		}
+		if err := e.BindBody(&body); err != nil {
+			return e.BadRequestError("Invalid body.", err)
+		}
+
+		def := customFieldDef{Collection: body.Collection, Name: body.Name, Type: strings.TrimSpace(body.Type), Options: body.Options}
+		if _, err := def.schemaField(); err != nil {
+			return e.BadRequestError(err.Error(), nil)
+		}
+
+		col, err := e.App.FindCollectionByNameOrId(collectionCustomFields)
+		if err != nil {
+			return e.InternalServerError("Failed to load custom fields collection.", err)
+		}
+		rec := core.NewRecord(col)
+		rec.Set("collection", strings.TrimSpace(body.Collection))
+		rec.Set("name", strings.ToLower(strings.TrimSpace(body.Name)))
+		rec.Set("label", strings.TrimSpace(body.Label))
+		rec.Set("type", strings.TrimSpace(body.Type))
+		rec.Set("options", body.Options)
+		if err := e.App.Save(rec); err != nil {
+			return e.BadRequestError("Failed to define custom field.", err)
+		}
+		return e.JSON(http.StatusOK, rec)
+	}).Bind(requireCRMRole())
+
+	grp.DELETE("/custom-fields/{id}", func(e *core.RequestEvent) error {
+		rec, err := e.App.FindRecordById(collectionCustomFields, e.Request.PathValue("id"))
+		if err != nil {
+			return e.NotFoundError("Custom field not found.", err)
+		}
+		if err := e.App.Delete(rec); err != nil {
+			return e.BadRequestError("Failed to delete custom field.", err)
+		}
+		return e.NoContent(http.StatusNoContent)
+	}).Bind(requireCRMRole())
+}
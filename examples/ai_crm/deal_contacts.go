@@ -0,0 +1,409 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/router"
+)
+
+// dealContactOutreach is the default agent message per buying role, used
+// when no active outreach template exists for its "contact_<role>" action.
+// The messages get the contact name and the deal title.
+var dealContactOutreach = map[string]string{
+	"champion":       "Hi %s,\n\nThanks for backing %s internally. Is there anything you need from us to bring the rest of the team along?\n\nBest,\nYou",
+	"economic_buyer": "Hi %s,\n\nAhead of a decision on %s, here is a short summary of the expected return and the pricing options. Happy to walk you through it.\n\nBest,\nYou",
+	"decision_maker": "Hi %s,\n\nCould we find 20 minutes to confirm the scope and timeline of %s?\n\nBest,\nYou",
+	"technical":      "Hi %s,\n\nFor %s, could you share your integration and security requirements so we can address them early?\n\nBest,\nYou",
+	"legal":          "Hi %s,\n\nPlease find the contract for %s attached for review. Let us know of any redlines.\n\nBest,\nYou",
+	"procurement":    "Hi %s,\n\nTo move %s forward, which vendor onboarding documents do you need from us?\n\nBest,\nYou",
+	"influencer":     "Hi %s,\n\nWe would value your input on %s. Any questions we can answer?\n\nBest,\nYou",
+	"other":          "Hi %s,\n\nA quick note to keep you in the loop on %s.\n\nBest,\nYou",
+}
+
+// findDealContacts returns the contacts of a deal, primary first, with their
+// lead expanded.
+func findDealContacts(app core.App, dealId string) ([]*core.Record, error) {
+	contacts, err := app.FindRecordsByFilter(collectionDealContacts, "deal={:deal}", "-is_primary,created", 0, 0, dbx.Params{"deal": dealId})
+	if err != nil {
+		return nil, err
+	}
+	for _, err := range app.ExpandRecords(contacts, []string{"lead"}, nil) {
+		return nil, err
+	}
+	return contacts, nil
+}
+
+// ensureDealLeadContact adds the lead of a deal to its contacts, as primary
+// when the deal has none yet.
+func ensureDealLeadContact(app core.App, deal *core.Record) error {
+	leadId := deal.GetString("lead")
+	if leadId == "" {
+		return nil
+	}
+	_, err := app.FindFirstRecordByFilter(collectionDealContacts, "deal={:deal} && lead={:lead}", dbx.Params{"deal": deal.Id, "lead": leadId})
+	if err == nil || !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+
+	_, err = app.FindFirstRecordByFilter(collectionDealContacts, "deal={:deal} && is_primary=true", dbx.Params{"deal": deal.Id})
+	hasPrimary := err == nil
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+
+	col, err := app.FindCollectionByNameOrId(collectionDealContacts)
+	if err != nil {
+		return err
+	}
+	contact := core.NewRecord(col)
+	contact.Set("deal", deal.Id)
+	contact.Set("lead", leadId)
+	contact.Set("is_primary", !hasPrimary)
+	copyChangeActor(deal, contact)
+	return app.Save(contact)
+}
+
+// bindDealContactHooks keeps the lead of a deal among its contacts and a
+// single primary contact per deal.
+func bindDealContactHooks(app core.App) {
+	ensure := func(e *core.RecordEvent) error {
+		leadChanged := e.Record.IsNew() || e.Record.GetString("lead") != e.Record.Original().GetString("lead")
+		if err := e.Next(); err != nil {
+			return err
+		}
+		if !leadChanged {
+			return nil
+		}
+		return ensureDealLeadContact(e.App, e.Record)
+	}
+	app.OnRecordCreate(collectionDeals).BindFunc(ensure)
+	app.OnRecordUpdate(collectionDeals).BindFunc(ensure)
+
+	primary := func(e *core.RecordEvent) error {
+		if err := e.Next(); err != nil {
+			return err
+		}
+		if !e.Record.GetBool("is_primary") {
+			return nil
+		}
+		others, err := e.App.FindRecordsByFilter(
+			collectionDealContacts,
+			"deal={:deal} && is_primary=true && id!={:id}",
+			"",
+			0,
+			0,
+			dbx.Params{"deal": e.Record.GetString("deal"), "id": e.Record.Id},
+		)
+		if err != nil {
+			return err
+		}
+		for _, other := range others {
+			other.Set("is_primary", false)
+			copyChangeActor(e.Record, other)
+			if err := e.App.Save(other); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	app.OnRecordCreate(collectionDealContacts).BindFunc(primary)
+	app.OnRecordUpdate(collectionDealContacts).BindFunc(primary)
+
+	// a contact moved to a lead that is already on the deal (lead merges)
+	// absorbs the existing contact instead of clashing with it
+	app.OnRecordUpdate(collectionDealContacts).BindFunc(func(e *core.RecordEvent) error {
+		leadId := e.Record.GetString("lead")
+		if leadId == e.Record.Original().GetString("lead") {
+			return e.Next()
+		}
+		existing, err := e.App.FindFirstRecordByFilter(
+			collectionDealContacts,
+			"deal={:deal} && lead={:lead} && id!={:id}",
+			dbx.Params{"deal": e.Record.GetString("deal"), "lead": leadId, "id": e.Record.Id},
+		)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+		if existing != nil {
+			// the contact already on the lead wins; the moved one fills gaps
+			for _, field := range []string{"role", "notes"} {
+				if v := existing.GetString(field); v != "" {
+					e.Record.Set(field, v)
+				}
+			}
+			e.Record.Set("is_primary", e.Record.GetBool("is_primary") || existing.GetBool("is_primary"))
+			copyChangeActor(e.Record, existing)
+			if err := e.App.Delete(existing); err != nil {
+				return err
+			}
+		}
+		return e.Next()
+	})
+}
+
+// dealContactSummary is the view of a contact in deal views and timelines.
+func dealContactSummary(contact *core.Record) map[string]any {
+	summary := map[string]any{
+		"id":        contact.Id,
+		"lead":      contact.GetString("lead"),
+		"role":      contact.GetString("role"),
+		"isPrimary": contact.GetBool("is_primary"),
+		"notes":     contact.GetString("notes"),
+	}
+	if lead := contact.ExpandedOne("lead"); lead != nil {
+		summary["name"] = lead.GetString("name")
+		summary["email"] = lead.GetString("email")
+		summary["jobTitle"] = lead.GetString("job_title")
+		summary["phone"] = lead.GetString("phone")
+		summary["stage"] = lead.GetString("stage")
+		summary["archived"] = lead.GetBool("archived")
+	}
+	return summary
+}
+
+// dealContactsCSV formats the contacts of a deal for the CSV export as
+// "Name <email> (role, primary)" entries separated by "; ".
+func dealContactsCSV(contacts []*core.Record) string {
+	parts := make([]string, 0, len(contacts))
+	for _, c := range contacts {
+		entry := c.GetString("lead")
+		if lead := c.ExpandedOne("lead"); lead != nil {
+			entry = lead.GetString("name")
+			if email := lead.GetString("email"); email != "" {
+				entry += " <" + email + ">"
+			}
+		}
+		tags := []string{}
+		if role := c.GetString("role"); role != "" {
+			tags = append(tags, role)
+		}
+		if c.GetBool("is_primary") {
+			tags = append(tags, "primary")
+		}
+		if len(tags) > 0 {
+			entry += " (" + strings.Join(tags, ", ") + ")"
+		}
+		parts = append(parts, entry)
+	}
+	return strings.Join(parts, "; ")
+}
+
+// setDealContactsColumn stores the formatted contacts of each deal as the
+// custom "contacts" value the CSV export writes.
+func setDealContactsColumn(app core.App, deals []*core.Record) error {
+	for _, deal := range deals {
+		contacts, err := findDealContacts(app, deal.Id)
+		if err != nil {
+			return err
+		}
+		deal.SetRaw("contacts", dealContactsCSV(contacts))
+	}
+	return nil
+}
+
+// dealTimeline merges the stage changes of a deal with the activities of the
+// deal and of its contacts (those not tied to another deal), newest first.
+// Activities are limited to the ones auth may see.
+func dealTimeline(app core.App, auth *core.Record, deal *core.Record, contacts []*core.Record) ([]map[string]any, error) {
+	byLead := map[string]*core.Record{}
+	leadIds := []any{}
+	for _, c := range contacts {
+		byLead[c.GetString("lead")] = c
+		leadIds = append(leadIds, c.GetString("lead"))
+	}
+
+	exprs := []dbx.Expression{
+		dbx.HashExp{"archived": false},
+		dbx.Or(dbx.HashExp{"deal": deal.Id}, dbx.And(dbx.In("lead", leadIds...), dbx.HashExp{"deal": ""})),
+	}
+	if scope := ownerScopeExpr(auth, "owner"); scope != nil {
+		exprs = append(exprs, scope)
+	}
+	activities, err := app.FindAllRecords(collectionActivities, exprs...)
+	if err != nil {
+		return nil, err
+	}
+
+	history, err := app.FindRecordsByFilter(collectionStageHistory, "deal={:deal}", "changed_at", 0, 0, dbx.Params{"deal": deal.Id})
+	if err != nil {
+		return nil, err
+	}
+
+	items := make([]map[string]any, 0, len(activities)+len(history))
+	for _, a := range activities {
+		item := map[string]any{
+			"kind":    "activity",
+			"at":      a.GetString("created"),
+			"id":      a.Id,
+			"type":    a.GetString("type"),
+			"content": a.GetString("content"),
+			"lead":    a.GetString("lead"),
+		}
+		if c, ok := byLead[a.GetString("lead")]; ok {
+			item["contact"] = dealContactSummary(c)
+		}
+		items = append(items, item)
+	}
+	for _, h := range history {
+		items = append(items, map[string]any{
+			"kind":      "stage_change",
+			"at":        h.GetString("changed_at"),
+			"id":        h.Id,
+			"fromStage": h.GetString("from_stage"),
+			"toStage":   h.GetString("to_stage"),
+			"source":    h.GetString("source"),
+			"actor":     h.GetString("actor"),
+		})
+	}
+	slices.SortStableFunc(items, func(a, b map[string]any) int {
+		return strings.Compare(b["at"].(string), a["at"].(string))
+	})
+	return items, nil
+}
+
+// runDealContactAgent drafts the outreach for the contact of a deal holding
+// role (its primary contact when role is empty; primary contacts win ties)
+// and logs it on the deal. Stages are left alone: they follow the lead of
+// the deal.
+func runDealContactAgent(app core.App, deal *core.Record, role string) (*agentRunResult, error) {
+	contacts, err := findDealContacts(app, deal.Id)
+	if err != nil {
+		return nil, err
+	}
+	var contact *core.Record
+	for _, c := range contacts {
+		if lead := c.ExpandedOne("lead"); lead == nil || lead.GetBool("archived") {
+			continue
+		}
+		if (role == "" && c.GetBool("is_primary")) || (role != "" && c.GetString("role") == role) {
+			contact = c
+			break
+		}
+	}
+	if contact == nil {
+		return nil, fmt.Errorf("the deal has no contact with the %q role", role)
+	}
+	lead := contact.ExpandedOne("lead")
+	stage := lead.GetString("stage")
+
+	if isClosedStage(deal.GetString("stage")) {
+		return &agentRunResult{
+			LeadId:   lead.Id,
+			OldStage: stage,
+			NewStage: stage,
+			Action:   "noop",
+			Message:  "Deal already finalized.",
+			Meta:     map[string]any{"final": true, "dealId": deal.Id},
+		}, nil
+	}
+
+	contactRole := contact.GetString("role")
+	if contactRole == "" {
+		contactRole = "other"
+	}
+	action := "contact_" + contactRole
+	message := fmt.Sprintf(dealContactOutreach[contactRole], safe(lead.GetString("name")), safe(deal.GetString("title")))
+	if tpl, ok := findOutreachTemplate(app, action); ok {
+		message = renderLeadTemplate(app, tpl, lead)
+	}
+
+	col, err := app.FindCollectionByNameOrId(collectionActivities)
+	if err != nil {
+		return nil, err
+	}
+	activity := core.NewRecord(col)
+	activity.Set("type", "outreach_email")
+	activity.Set("lead", lead.Id)
+	activity.Set("deal", deal.Id)
+	activity.Set("content", message)
+	activity.Set("metadata", map[string]any{
+		"agentAction": action,
+		"contactRole": contact.GetString("role"),
+		"dealStage":   deal.GetString("stage"),
+	})
+	setChangeActor(activity, changeSourceAgent, "")
+	if err := app.Save(activity); err != nil {
+		return nil, err
+	}
+
+	return &agentRunResult{
+		LeadId:     lead.Id,
+		OldStage:   stage,
+		NewStage:   stage,
+		Action:     action,
+		Message:    message,
+		ActivityId: activity.Id,
+		Meta: map[string]any{
+			"dealId":    deal.Id,
+			"contactId": contact.Id,
+			"role":      contact.GetString("role"),
+		},
+	}, nil
+}
+
+func bindDealContactRoutes(grp *router.RouterGroup[*core.RequestEvent]) {
+	// loadDeal resolves {id} to a live deal the caller may see
+	loadDeal := func(e *core.RequestEvent) (*core.Record, error) {
+		deal, err := e.App.FindRecordById(collectionDeals, e.Request.PathValue("id"))
+		if err != nil || deal.GetBool("archived") || !canAccessOwned(e.App, e.Auth, deal) {
+			return nil, e.NotFoundError("Deal not found.", err)
+		}
+		return deal, nil
+	}
+
+	grp.GET("/deals/{id}", func(e *core.RequestEvent) error {
+		deal, err := loadDeal(e)
+		if err != nil {
+			return err
+		}
+		contacts, err := findDealContacts(e.App, deal.Id)
+		if err != nil {
+			return e.InternalServerError("Failed to load deal contacts.", err)
+		}
+		items := make([]map[string]any, 0, len(contacts))
+		for _, c := range contacts {
+			items = append(items, dealContactSummary(c))
+		}
+		return e.JSON(http.StatusOK, map[string]any{"deal": deal, "contacts": items})
+	}).Bind(requireCRMRole(roleManager, roleRep))
+
+	grp.GET("/deals/{id}/timeline", func(e *core.RequestEvent) error {
+		deal, err := loadDeal(e)
+		if err != nil {
+			return err
+		}
+		contacts, err := findDealContacts(e.App, deal.Id)
+		if err != nil {
+			return e.InternalServerError("Failed to load deal contacts.", err)
+		}
+		items, err := dealTimeline(e.App, e.Auth, deal, contacts)
+		if err != nil {
+			return e.InternalServerError("Failed to build deal timeline.", err)
+		}
+		return e.JSON(http.StatusOK, map[string]any{"deal": deal.Id, "items": items})
+	}).Bind(requireCRMRole(roleManager, roleRep))
+
+	grp.POST("/agents/run/deals/{id}", func(e *core.RequestEvent) error {
+		deal, err := loadDeal(e)
+		if err != nil {
+			return err
+		}
+		role := strings.TrimSpace(e.Request.URL.Query().Get("role"))
+		if _, ok := dealContactOutreach[role]; role != "" && !ok {
+			return e.BadRequestError("Unknown contact role.", nil)
+		}
+
+		result, err := runDealContactAgent(e.App, deal, role)
+		if err != nil {
+			return e.BadRequestError("Failed to run agent: "+err.Error(), err)
+		}
+		return e.JSON(http.StatusOK, result)
+	}).Bind(requireCRMRole(roleManager, roleRep))
+}
@@ -0,0 +1,554 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/router"
+)
+
+// companySuffixes are legal-form words dropped by normalizeCompanyName so
+// "Acme Labs" and "Acme Labs LLC" compare equal.
+var companySuffixes = []string{
+	"llc", "l.l.c", "fz", "fze", "fzco", "fzc", "fzllc", "dmcc", "ltd", "limited",
+	"inc", "incorporated", "corp", "corporation", "co", "company", "plc", "gmbh",
+	"sa", "ag", "bv", "pte", "pvt", "llp", "est", "establishment", "trading",
+}
+
+type duplicatePair struct {
+	A       string   `json:"a"`
+	B       string   `json:"b"`
+	AName   string   `json:"aName"`
+	BName   string   `json:"bName"`
+	Score   float64  `json:"score"`
+	Reasons []string `json:"reasons"`
+}
+
+func normalizeEmailKey(email string) string {
+	email = strings.ToLower(strings.TrimSpace(email))
+	local, domain, ok := strings.Cut(email, "@")
+	if !ok || local == "" || domain == "" {
+		return ""
+	}
+	if i := strings.Index(local, "+"); i > 0 {
+		local = local[:i]
+	}
+	if domain == "googlemail.com" {
+		domain = "gmail.com"
+	}
+	if domain == "gmail.com" {
+		local = strings.ReplaceAll(local, ".", "")
+	}
+	return local + "@" + domain
+}
+
+func normalizePhoneKey(phone string) string {
+	digits := strings.Map(func(r rune) rune {
+		if r >= '0' && r <= '9' {
+			return r
+		}
+		return -1
+	}, phone)
+	digits = strings.TrimLeft(digits, "0")
+	if len(digits) < 7 {
+		return ""
+	}
+	return digits
+}
+
+func normalizeLinkedinKey(raw string) string {
+	if canonical := canonicalLinkedinURL(raw); canonical != "" {
+		return canonical
+	}
+
+	s := strings.ToLower(strings.TrimSpace(raw))
+	if s == "" {
+		return ""
+	}
+	s = strings.TrimPrefix(s, "https://")
+	s = strings.TrimPrefix(s, "http://")
+	if i := strings.IndexAny(s, "?#"); i >= 0 {
+		s = s[:i]
+	}
+	s = strings.TrimRight(s, "/")
+	if i := strings.Index(s, "linkedin.com/"); i >= 0 {
+		s = s[i:]
+	}
+	return s
+}
+
+// normalizeCompanyName lowercases name, strips punctuation and trailing legal
+// suffixes, and collapses whitespace.
+func normalizeCompanyName(name string) string {
+	name = strings.ToLower(strings.TrimSpace(name))
+	name = strings.ReplaceAll(name, "&", " and ")
+	name = strings.ReplaceAll(name, "l.l.c", "llc")
+	name = strings.ReplaceAll(name, "fz-llc", "fzllc")
+
+	cleaned := strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return r
+		}
+		return ' '
+	}, name)
+
+	words := strings.Fields(cleaned)
+	if len(words) > 0 && words[0] == "the" {
+		words = words[1:]
+	}
+	for len(words) > 1 && slices.Contains(companySuffixes, words[len(words)-1]) {
+		words = words[:len(words)-1]
+	}
+	return strings.Join(words, " ")
+}
+
+func normalizePersonName(name string) string {
+	return strings.Join(strings.Fields(strings.ToLower(name)), " ")
+}
+
+// jaroWinkler returns the Jaro-Winkler similarity of a and b in the [0, 1] range.
+func jaroWinkler(a, b string) float64 {
+	ra, rb := []rune(a), []rune(b)
+	if len(ra) == 0 && len(rb) == 0 {
+		return 1
+	}
+	if len(ra) == 0 || len(rb) == 0 {
+		return 0
+	}
+
+	window := max(len(ra), len(rb))/2 - 1
+	if window < 0 {
+		window = 0
+	}
+
+	matchedA := make([]bool, len(ra))
+	matchedB := make([]bool, len(rb))
+	matches := 0
+	for i := range ra {
+		lo := max(0, i-window)
+		hi := min(len(rb), i+window+1)
+		for j := lo; j < hi; j++ {
+			if matchedB[j] || ra[i] != rb[j] {
+				continue
+			}
+			matchedA[i] = true
+			matchedB[j] = true
+			matches++
+			break
+		}
+	}
+	if matches == 0 {
+		return 0
+	}
+
+	transpositions := 0
+	j := 0
+	for i := range ra {
+		if !matchedA[i] {
+			continue
+		}
+		for !matchedB[j] {
+			j++
+		}
+		if ra[i] != rb[j] {
+			transpositions++
+		}
+		j++
+	}
+
+	m := float64(matches)
+	jaro := (m/float64(len(ra)) + m/float64(len(rb)) + (m-float64(transpositions)/2)/m) / 3
+
+	prefix := 0
+	for prefix < min(4, len(ra), len(rb)) && ra[prefix] == rb[prefix] {
+		prefix++
+	}
+
+	return jaro + float64(prefix)*0.1*(1-jaro)
+}
+
+// pairCollector accumulates scored pairs keyed by their (ordered) record ids.
+type pairCollector map[string]*duplicatePair
+
+func (c pairCollector) add(a, b *core.Record, nameField string, score float64, reason string) {
+	if a.Id == b.Id {
+		return
+	}
+	if a.Id > b.Id {
+		a, b = b, a
+	}
+	k := a.Id + "|" + b.Id
+	p, ok := c[k]
+	if !ok {
+		p = &duplicatePair{A: a.Id, B: b.Id, AName: a.GetString(nameField), BName: b.GetString(nameField)}
+		c[k] = p
+	}
+	p.Score = max(p.Score, score)
+	if !slices.Contains(p.Reasons, reason) {
+		p.Reasons = append(p.Reasons, reason)
+	}
+}
+
+func (c pairCollector) addBuckets(buckets map[string][]*core.Record, nameField string, score float64, reason string) {
+	for _, recs := range buckets {
+		for i := 0; i < len(recs); i++ {
+			for j := i + 1; j < len(recs); j++ {
+				c.add(recs[i], recs[j], nameField, score, reason)
+			}
+		}
+	}
+}
+
+func (c pairCollector) sorted(minScore float64) []*duplicatePair {
+	out := make([]*duplicatePair, 0, len(c))
+	for _, p := range c {
+		if p.Score >= minScore {
+			out = append(out, p)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Score != out[j].Score {
+			return out[i].Score > out[j].Score
+		}
+		return out[i].A+out[i].B < out[j].A+out[j].B
+	})
+	return out
+}
+
+func findDuplicateLeads(app core.App, minScore float64) ([]*duplicatePair, error) {
+	leads, err := app.FindAllRecords(collectionLeads, dbx.HashExp{"archived": false})
+	if err != nil {
+		return nil, err
+	}
+
+	byEmail := map[string][]*core.Record{}
+	byPhone := map[string][]*core.Record{}
+	byLinkedin := map[string][]*core.Record{}
+	byCompany := map[string][]*core.Record{}
+	for _, l := range leads {
+		if k := normalizeEmailKey(l.GetString("email")); k != "" {
+			byEmail[k] = append(byEmail[k], l)
+		}
+		if k := normalizePhoneKey(l.GetString("phone")); k != "" {
+			byPhone[k] = append(byPhone[k], l)
+		}
+		if k := normalizeLinkedinKey(l.GetString("linkedin")); k != "" {
+			byLinkedin[k] = append(byLinkedin[k], l)
+		}
+		company := normalizeCompanyName(l.GetString("company"))
+		if company == "" {
+			company = "account:" + l.GetString("account")
+		}
+		byCompany[company] = append(byCompany[company], l)
+	}
+
+	pairs := pairCollector{}
+	pairs.addBuckets(byEmail, "name", 1, "email")
+	pairs.addBuckets(byLinkedin, "name", 0.98, "linkedin")
+	pairs.addBuckets(byPhone, "name", 0.95, "phone")
+
+	// fuzzy names are only compared within the same company to keep the pairwise pass small
+	for company, recs := range byCompany {
+		if company == "account:" {
+			continue
+		}
+		for i := 0; i < len(recs); i++ {
+			for j := i + 1; j < len(recs); j++ {
+				sim := jaroWinkler(normalizePersonName(recs[i].GetString("name")), normalizePersonName(recs[j].GetString("name")))
+				if sim >= minScore {
+					pairs.add(recs[i], recs[j], "name", sim, "name+company")
+				}
+			}
+		}
+	}
+
+	return pairs.sorted(minScore), nil
+}
+
+func findDuplicateAccounts(app core.App, minScore float64) ([]*duplicatePair, error) {
+	accounts, err := app.FindAllRecords(collectionAccounts, dbx.HashExp{"archived": false})
+	if err != nil {
+		return nil, err
+	}
+
+	byDomain := map[string][]*core.Record{}
+	byName := map[string][]*core.Record{}
+	byFirstWord := map[string][]*core.Record{}
+	for _, a := range accounts {
+		if d := domainFromWebsite(a.GetString("domain")); d != "" {
+			byDomain[d] = append(byDomain[d], a)
+		}
+		key := normalizeCompanyName(a.GetString("name"))
+		if key == "" {
+			continue
+		}
+		byName[key] = append(byName[key], a)
+		first, _, _ := strings.Cut(key, " ")
+		byFirstWord[first] = append(byFirstWord[first], a)
+	}
+
+	pairs := pairCollector{}
+	pairs.addBuckets(byDomain, "name", 1, "domain")
+	pairs.addBuckets(byName, "name", 0.97, "name")
+
+	for _, recs := range byFirstWord {
+		for i := 0; i < len(recs); i++ {
+			for j := i + 1; j < len(recs); j++ {
+				sim := jaroWinkler(normalizeCompanyName(recs[i].GetString("name")), normalizeCompanyName(recs[j].GetString("name")))
+				if sim >= minScore {
+					pairs.add(recs[i], recs[j], "name", sim, "fuzzy_name")
+				}
+			}
+		}
+	}
+
+	return pairs.sorted(minScore), nil
+}
+
+// historyCollections record what happened to a record at the time, so a
+// merge leaves their relations on the duplicate.
+var historyCollections = []string{
+	collectionMergeLog,
+	collectionStageHistory,
+	collectionAuditLog,
+	collectionForecastSnapshots,
+	collectionPipelineSnapshots,
+}
+
+// accountMergeFields are the account fields a merge fills from the
+// duplicates: the domain, the fields the importers enrich and the notes.
+var accountMergeFields = []string{"domain", "website", "linkedin", "industry", "address", "city", "country", "employee_range", "source_rating", "notes"}
+
+// repointRelations moves every relation that references one of fromIds in
+// target to toId, across all collections except the history ones, on behalf
+// of auth. It returns the number of updated records per "collection.field".
+func repointRelations(app core.App, auth *core.Record, target *core.Collection, fromIds []string, toId string) (map[string]int, error) {
+	collections, err := app.FindAllCollections()
+	if err != nil {
+		return nil, err
+	}
+
+	counts := map[string]int{}
+	for _, col := range collections {
+		if col.IsView() || slices.Contains(historyCollections, col.Name) {
+			continue
+		}
+		for _, f := range col.Fields {
+			rel, ok := f.(*core.RelationField)
+			if !ok || rel.CollectionId != target.Id {
+				continue
+			}
+
+			for _, fromId := range fromIds {
+				op := "="
+				if rel.IsMultiple() {
+					op = "?="
+				}
+				recs, err := app.FindRecordsByFilter(col, fmt.Sprintf("%s %s {:id}", rel.Name, op), "", 0, 0, dbx.Params{"id": fromId})
+				if err != nil {
+					return nil, err
+				}
+				for _, r := range recs {
+					ids := r.GetStringSlice(rel.Name)
+					next := make([]string, 0, len(ids))
+					for _, id := range ids {
+						if id == fromId {
+							id = toId
+						}
+						if (col.Id == target.Id && id == r.Id) || slices.Contains(next, id) {
+							continue
+						}
+						next = append(next, id)
+					}
+					r.Set(rel.Name, next)
+					setAuthChangeActor(r, auth)
+					if err := app.Save(r); err != nil {
+						return nil, err
+					}
+					counts[col.Name+"."+rel.Name]++
+				}
+			}
+		}
+	}
+
+	return counts, nil
+}
+
+// mergeRecords folds the duplicates into survivor: empty survivor fields are
+// filled from the duplicates, every relation pointing at a duplicate is moved
+// to the survivor, the duplicates are archived (restorable until the purge)
+// and a crm_merge_log entry is written. Every save is made on behalf of auth.
+func mergeRecords(app core.App, auth *core.Record, collection string, entity string, survivorId string, duplicateIds []string, fillFields []string) (map[string]any, error) {
+	if survivorId == "" || len(duplicateIds) == 0 {
+		return nil, errors.New("survivor and duplicates are required")
+	}
+	if slices.Contains(duplicateIds, survivorId) {
+		return nil, errors.New("survivor can't also be a duplicate")
+	}
+
+	var result map[string]any
+	err := app.RunInTransaction(func(txApp core.App) error {
+		survivor, err := txApp.FindRecordById(collection, survivorId)
+		if err != nil {
+			return err
+		}
+
+		dups := make([]*core.Record, 0, len(duplicateIds))
+		snapshots := make([]map[string]any, 0, len(duplicateIds))
+		for _, id := range duplicateIds {
+			d, err := txApp.FindRecordById(collection, id)
+			if err != nil {
+				return err
+			}
+			dups = append(dups, d)
+			snapshots = append(snapshots, d.FieldsData())
+		}
+
+		// zero numbers count as empty, like unset text
+		isEmpty := func(rec *core.Record, field string) bool {
+			if _, ok := rec.Collection().Fields.GetByName(field).(*core.NumberField); ok {
+				return rec.GetFloat(field) == 0
+			}
+			return rec.GetString(field) == ""
+		}
+
+		filled := []string{}
+		for _, field := range fillFields {
+			if !isEmpty(survivor, field) {
+				continue
+			}
+			for _, d := range dups {
+				if !isEmpty(d, field) {
+					survivor.Set(field, d.Get(field))
+					filled = append(filled, field)
+					break
+				}
+			}
+		}
+		setAuthChangeActor(survivor, auth)
+		if err := txApp.Save(survivor); err != nil {
+			return err
+		}
+
+		repointed, err := repointRelations(txApp, auth, survivor.Collection(), duplicateIds, survivor.Id)
+		if err != nil {
+			return err
+		}
+
+		// the duplicates stay restorable until the retention job purges them
+		for _, d := range dups {
+			setAuthChangeActor(d, auth)
+			if _, err := archiveRecord(txApp, d, true); err != nil {
+				return err
+			}
+		}
+
+		logCol, err := txApp.FindCollectionByNameOrId(collectionMergeLog)
+		if err != nil {
+			return err
+		}
+		entry := core.NewRecord(logCol)
+		entry.Set("entity", entity)
+		entry.Set("survivor", survivor.Id)
+		entry.Set("merged_ids", duplicateIds)
+		entry.Set("snapshots", snapshots)
+		entry.Set("repointed", repointed)
+		entry.Set("actor", actorLabel(auth))
+		if err := txApp.Save(entry); err != nil {
+			return err
+		}
+
+		result = map[string]any{
+			"survivor":  survivor.Id,
+			"merged":    duplicateIds,
+			"filled":    filled,
+			"repointed": repointed,
+			"logId":     entry.Id,
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// actorLabel identifies auth in the merge log as "collection:id".
+func actorLabel(auth *core.Record) string {
+	if auth == nil {
+		return ""
+	}
+	return auth.Collection().Name + ":" + auth.Id
+}
+
+func bindDuplicateRoutes(grp *router.RouterGroup[*core.RequestEvent]) {
+	minScoreParam := func(e *core.RequestEvent) (float64, error) {
+		raw := e.Request.URL.Query().Get("minScore")
+		if raw == "" {
+			return 0.9, nil
+		}
+		v, err := strconv.ParseFloat(raw, 64)
+		if err != nil || v <= 0 || v > 1 {
+			return 0, errors.New("minScore must be in (0, 1]")
+		}
+		return v, nil
+	}
+
+	grp.GET("/duplicates/leads", func(e *core.RequestEvent) error {
+		minScore, err := minScoreParam(e)
+		if err != nil {
+			return e.BadRequestError("Invalid minScore.", err)
+		}
+		pairs, err := findDuplicateLeads(e.App, minScore)
+		if err != nil {
+			return e.InternalServerError("Failed to find duplicate leads.", err)
+		}
+		return e.JSON(http.StatusOK, map[string]any{"items": pairs})
+	}).Bind(requireCRMRole())
+
+	grp.GET("/duplicates/accounts", func(e *core.RequestEvent) error {
+		minScore, err := minScoreParam(e)
+		if err != nil {
+			return e.BadRequestError("Invalid minScore.", err)
+		}
+		pairs, err := findDuplicateAccounts(e.App, minScore)
+		if err != nil {
+			return e.InternalServerError("Failed to find duplicate accounts.", err)
+		}
+		return e.JSON(http.StatusOK, map[string]any{"items": pairs})
+	}).Bind(requireCRMRole())
+
+	mergeHandler := func(collection string, entity string, fillFields []string) func(e *core.RequestEvent) error {
+		return func(e *core.RequestEvent) error {
+			var body struct {
+				Survivor   string   `json:"survivor"`
+				Duplicates []string `json:"duplicates"`
+			}
+			if err := e.BindBody(&body); err != nil {
+				return e.BadRequestError("Invalid body.", err)
+			}
+
+			res, err := mergeRecords(e.App, e.Auth, collection, entity, strings.TrimSpace(body.Survivor), body.Duplicates, fillFields)
+			if err != nil {
+				if errors.Is(err, sql.ErrNoRows) {
+					return e.NotFoundError("Record not found.", err)
+				}
+				return e.BadRequestError("Failed to merge "+entity+"s.", err)
+			}
+			return e.JSON(http.StatusOK, res)
+		}
+	}
+
+	grp.POST("/duplicates/leads/merge", mergeHandler(collectionLeads, "lead", leadMergeFields)).Bind(requireCRMRole())
+	grp.POST("/duplicates/accounts/merge", mergeHandler(collectionAccounts, "account", accountMergeFields)).Bind(requireCRMRole())
+}
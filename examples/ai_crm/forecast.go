@@ -0,0 +1,343 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/router"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+// forecastPeriodPatterns validates the period keys of each forecast
+// granularity, e.g. 2026-10 and 2026-Q4.
+var forecastPeriodPatterns = map[string]*regexp.Regexp{
+	"month":   regexp.MustCompile(`^\d{4}-(0[1-9]|1[0-2])$`),
+	"quarter": regexp.MustCompile(`^\d{4}-Q[1-4]$`),
+}
+
+// forecastPeriodSQL is the SQL period key of dateExpr for granularity.
+func forecastPeriodSQL(granularity string, dateExpr string) string {
+	if granularity == "quarter" {
+		return "(strftime('%Y', " + dateExpr + ") || '-Q' || ((CAST(strftime('%m', " + dateExpr + ") AS INTEGER) + 2) / 3))"
+	}
+	return "strftime('%Y-%m', " + dateExpr + ")"
+}
+
+// forecastPeriodStart is the start of the period containing t.
+func forecastPeriodStart(granularity string, t time.Time) time.Time {
+	t = t.UTC()
+	month := t.Month()
+	if granularity == "quarter" {
+		month = (month-1)/3*3 + 1
+	}
+	return time.Date(t.Year(), month, 1, 0, 0, 0, 0, time.UTC)
+}
+
+type forecastRow struct {
+	Period    string  `db:"period" json:"period"`
+	Owner     string  `db:"owner" json:"owner,omitempty"`
+	OpenDeals int     `db:"open_deals" json:"openDeals"`
+	Commit    float64 `db:"commit" json:"commit"`
+	BestCase  float64 `db:"best_case" json:"bestCase"`
+	Pipeline  float64 `db:"pipeline" json:"pipeline"`
+	Weighted  float64 `db:"weighted" json:"weighted"`
+	ClosedWon float64 `db:"closed_won" json:"closedWon"`
+}
+
+func (r *forecastRow) add(o forecastRow) {
+	r.OpenDeals += o.OpenDeals
+	r.Commit = roundMoney(r.Commit + o.Commit)
+	r.BestCase = roundMoney(r.BestCase + o.BestCase)
+	r.Pipeline = roundMoney(r.Pipeline + o.Pipeline)
+	r.Weighted = roundMoney(r.Weighted + o.Weighted)
+	r.ClosedWon = roundMoney(r.ClosedWon + o.ClosedWon)
+}
+
+// forecastFilter narrows the forecast to the periods of deals closing (or
+// won) within [From, To), or to a single Period, and to an owner.
+type forecastFilter struct {
+	Granularity string
+	From        string
+	To          string
+	Period      string
+	Owner       string
+}
+
+// forecastRows aggregates per period and owner the open deals with a close
+// date and the won deals visible through scope. Open deals past their close
+// date still count, in the period of now, since they can only close from
+// then on. Each open deal takes the probability and category of its stage
+// from crm_forecast_stages, the owner's row winning over the default one.
+// Categories are cumulative: best case includes commit and pipeline includes
+// both, omitted deals are left out. Open deals are valued in the base
+// currency at their close date, won deals at the date they were won.
+func forecastRows(app core.App, scope dbx.Expression, filter forecastFilter, now time.Time) ([]forecastRow, error) {
+	open := "d.stage NOT IN ('won', 'lost')"
+	wonAt := dealWonAtSQL("d")
+	date := "(CASE WHEN d.stage = 'won' THEN " + wonAt + " ELSE MAX(d.close_date, {:current}) END)"
+	period := forecastPeriodSQL(filter.Granularity, date)
+
+	probability := "COALESCE(po.probability, pd.probability, 0)"
+	category := "COALESCE(po.category, pd.category, 'pipeline')"
+	amount := baseAmountSQL("d.amount", "d.currency", dealValuationDateSQL("d", "now"))
+	sumOpen := func(categories ...string) string {
+		return "COALESCE(SUM(CASE WHEN " + open + " AND " + category + " IN ('" + strings.Join(categories, "', '") + "') THEN " + amount + " END), 0)"
+	}
+
+	where := []dbx.Expression{
+		dbx.HashExp{"d.archived": false},
+		dbx.NewExp("(d.stage = 'won' OR (" + open + " AND d.close_date != ''))"),
+		scope,
+	}
+	if filter.From != "" {
+		where = append(where, dbx.NewExp(date+" >= {:from}", dbx.Params{"from": filter.From}))
+	}
+	if filter.To != "" {
+		where = append(where, dbx.NewExp(date+" < {:to}", dbx.Params{"to": filter.To}))
+	}
+	if filter.Period != "" {
+		where = append(where, dbx.NewExp(period+" = {:period}", dbx.Params{"period": filter.Period}))
+	}
+	if filter.Owner != "" {
+		where = append(where, dbx.HashExp{"d.owner": filter.Owner})
+	}
+
+	rows := []forecastRow{}
+	err := app.DB().
+		Select(
+			period+" AS period",
+			"d.owner AS owner",
+			"COALESCE(SUM("+open+" AND "+category+" != 'omitted'), 0) AS open_deals",
+			sumOpen("commit")+" AS [[commit]]",
+			sumOpen("commit", "best_case")+" AS best_case",
+			sumOpen("commit", "best_case", "pipeline")+" AS pipeline",
+			"COALESCE(SUM(CASE WHEN "+open+" AND "+category+" != 'omitted' THEN "+amount+" * "+probability+" / 100.0 END), 0) AS weighted",
+			"COALESCE(SUM(CASE WHEN d.stage = 'won' THEN "+baseAmountSQL("d.amount", "d.currency", wonAt)+" END), 0) AS closed_won",
+		).
+		From(collectionDeals+" d").
+		LeftJoin(collectionForecastStages+" po", dbx.NewExp("po.stage = d.stage AND po.owner = d.owner AND d.owner != ''")).
+		LeftJoin(collectionForecastStages+" pd", dbx.NewExp("pd.stage = d.stage AND pd.owner = ''")).
+		Where(dbx.And(where...)).
+		GroupBy("period", "d.owner").
+		OrderBy("period", "d.owner").
+		Bind(dbx.Params{
+			"now":     types.NowDateTime().String(),
+			"current": forecastPeriodStart(filter.Granularity, now).Format(types.DefaultDateLayout),
+		}).
+		All(&rows)
+	if err != nil {
+		return nil, err
+	}
+
+	// add rounds the amounts
+	for i, row := range rows {
+		rows[i] = forecastRow{Period: row.Period, Owner: row.Owner}
+		rows[i].add(row)
+	}
+	return rows, nil
+}
+
+// forecastByPeriod sums rows over the owners of each period.
+func forecastByPeriod(rows []forecastRow) ([]forecastRow, forecastRow) {
+	periods := []forecastRow{}
+	total := forecastRow{}
+	for _, row := range rows {
+		i := slices.IndexFunc(periods, func(p forecastRow) bool { return p.Period == row.Period })
+		if i < 0 {
+			periods = append(periods, forecastRow{Period: row.Period})
+			i = len(periods) - 1
+		}
+		periods[i].add(row)
+		total.add(row)
+	}
+	return periods, total
+}
+
+// snapshotForecast stores the monthly and quarterly forecast per owner from
+// the period of now onwards (past due deals included), replacing the
+// snapshots already taken that day.
+func snapshotForecast(app core.App, now time.Time) (map[string]int, error) {
+	col, err := app.FindCollectionByNameOrId(collectionForecastSnapshots)
+	if err != nil {
+		return nil, err
+	}
+
+	day := now.UTC().Truncate(24 * time.Hour)
+	date, err := types.ParseDateTime(day)
+	if err != nil {
+		return nil, err
+	}
+
+	created := map[string]int{}
+	err = app.RunInTransaction(func(txApp core.App) error {
+		for granularity := range forecastPeriodPatterns {
+			from := forecastPeriodStart(granularity, now).Format(types.DefaultDateLayout)
+			rows, err := forecastRows(txApp, nil, forecastFilter{Granularity: granularity, From: from}, now)
+			if err != nil {
+				return err
+			}
+
+			old, err := txApp.FindRecordsByFilter(col, "snapshot_date = {:date} && granularity = {:granularity}", "", 0, 0,
+				dbx.Params{"date": date.String(), "granularity": granularity})
+			if err != nil {
+				return err
+			}
+			for _, rec := range old {
+				if err := txApp.Delete(rec); err != nil {
+					return err
+				}
+			}
+
+			for _, row := range rows {
+				rec := core.NewRecord(col)
+				rec.Set("snapshot_date", date)
+				rec.Set("granularity", granularity)
+				rec.Set("period", row.Period)
+				rec.Set("owner", row.Owner)
+				rec.Set("open_deals", row.OpenDeals)
+				rec.Set("commit", row.Commit)
+				rec.Set("best_case", row.BestCase)
+				rec.Set("pipeline", row.Pipeline)
+				rec.Set("weighted", row.Weighted)
+				rec.Set("closed_won", row.ClosedWon)
+				rec.Set("currency", baseCurrency())
+				if err := txApp.Save(rec); err != nil {
+					return err
+				}
+			}
+			created[granularity] = len(rows)
+		}
+		return nil
+	})
+	return created, err
+}
+
+// forecastSnapshot is the forecast of a period as it stood on a snapshot
+// date.
+type forecastSnapshot struct {
+	SnapshotDate string `db:"snapshot_date" json:"snapshotDate"`
+	forecastRow
+}
+
+// forecastSnapshotHistory sums the snapshots of one period per snapshot
+// date, over the owners visible through scope.
+func forecastSnapshotHistory(app core.App, scope dbx.Expression, granularity string, period string, owner string) ([]forecastSnapshot, error) {
+	where := []dbx.Expression{dbx.HashExp{"s.granularity": granularity, "s.period": period}, scope}
+	if owner != "" {
+		where = append(where, dbx.HashExp{"s.owner": owner})
+	}
+
+	rows := []forecastSnapshot{}
+	err := app.DB().
+		Select(
+			"s.snapshot_date AS snapshot_date",
+			"s.period AS period",
+			"COALESCE(SUM(s.open_deals), 0) AS open_deals",
+			"COALESCE(SUM(s.[[commit]]), 0) AS [[commit]]",
+			"COALESCE(SUM(s.best_case), 0) AS best_case",
+			"COALESCE(SUM(s.pipeline), 0) AS pipeline",
+			"COALESCE(SUM(s.weighted), 0) AS weighted",
+			"COALESCE(SUM(s.closed_won), 0) AS closed_won",
+		).
+		From(collectionForecastSnapshots + " s").
+		Where(dbx.And(where...)).
+		GroupBy("s.snapshot_date").
+		OrderBy("s.snapshot_date").
+		All(&rows)
+	if err != nil {
+		return nil, err
+	}
+
+	// add rounds the amounts
+	for i, row := range rows {
+		rows[i].forecastRow = forecastRow{Period: row.Period}
+		rows[i].add(row.forecastRow)
+	}
+	return rows, nil
+}
+
+func bindForecastRoutes(grp *router.RouterGroup[*core.RequestEvent]) {
+	granularityOf := func(e *core.RequestEvent) (string, error) {
+		granularity := e.Request.URL.Query().Get("granularity")
+		if granularity == "" {
+			granularity = "month"
+		}
+		if _, ok := forecastPeriodPatterns[granularity]; !ok {
+			return "", e.BadRequestError("granularity must be month or quarter.", nil)
+		}
+		return granularity, nil
+	}
+
+	grp.GET("/reports/forecast", func(e *core.RequestEvent) error {
+		granularity, err := granularityOf(e)
+		if err != nil {
+			return err
+		}
+
+		q := e.Request.URL.Query()
+		filter := forecastFilter{Granularity: granularity, From: q.Get("from"), To: q.Get("to"), Owner: q.Get("owner")}
+		if filter.From == "" && filter.To == "" {
+			filter.From = forecastPeriodStart(granularity, time.Now()).Format(types.DefaultDateLayout)
+		}
+		rows, err := forecastRows(e.App, ownerScopeExpr(e.Auth, "d.owner"), filter, time.Now())
+		if err != nil {
+			return e.InternalServerError("Failed to build forecast.", err)
+		}
+
+		periods, total := forecastByPeriod(rows)
+		return e.JSON(http.StatusOK, map[string]any{
+			"granularity": granularity,
+			"items":       periods,
+			"byOwner":     rows,
+			"total":       total,
+			"currency":    baseCurrency(),
+		})
+	}).Bind(requireCRMRole(roleManager, roleRep))
+
+	// the forecast of a period as snapshotted each week, next to where it
+	// stands now (closedWon being the actual result so far)
+	grp.GET("/reports/forecast/history", func(e *core.RequestEvent) error {
+		granularity, err := granularityOf(e)
+		if err != nil {
+			return err
+		}
+
+		q := e.Request.URL.Query()
+		period := q.Get("period")
+		if !forecastPeriodPatterns[granularity].MatchString(period) {
+			return e.BadRequestError("period must look like 2026-10 (month) or 2026-Q4 (quarter).", nil)
+		}
+
+		snapshots, err := forecastSnapshotHistory(e.App, ownerScopeExpr(e.Auth, "s.owner"), granularity, period, q.Get("owner"))
+		if err != nil {
+			return e.InternalServerError("Failed to load forecast snapshots.", err)
+		}
+		rows, err := forecastRows(e.App, ownerScopeExpr(e.Auth, "d.owner"), forecastFilter{Granularity: granularity, Period: period, Owner: q.Get("owner")}, time.Now())
+		if err != nil {
+			return e.InternalServerError("Failed to build forecast.", err)
+		}
+		_, current := forecastByPeriod(rows)
+		current.Period = period
+
+		return e.JSON(http.StatusOK, map[string]any{
+			"granularity": granularity,
+			"period":      period,
+			"snapshots":   snapshots,
+			"current":     current,
+			"currency":    baseCurrency(),
+		})
+	}).Bind(requireCRMRole(roleManager, roleRep))
+
+	grp.POST("/reports/forecast/snapshot", func(e *core.RequestEvent) error {
+		res, err := snapshotForecast(e.App, time.Now())
+		if err != nil {
+			return e.InternalServerError("Failed to snapshot the forecast.", err)
+		}
+		return e.JSON(http.StatusOK, res)
+	}).Bind(requireCRMRole())
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+
+	validation "github.com/go-ozzo/ozzo-validation/v4"
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/router"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+// lostFields are the loss details of a lead or deal, cleared when it is
+// reopened.
+var lostFields = []string{"lost_reason", "lost_competitor", "lost_notes", "lost_stage", "lost_at"}
+
+// lossCollections maps the path segment of the loss report to its
+// collection.
+var lossCollections = map[string]string{
+	"leads": collectionLeads,
+	"deals": collectionDeals,
+}
+
+// copyLostDetails passes the reason, competitor and notes of a loss on to a
+// record the stage sync closes with it.
+func copyLostDetails(from *core.Record, to *core.Record) {
+	for _, field := range []string{"lost_reason", "lost_competitor", "lost_notes"} {
+		if to.GetString(field) == "" {
+			to.Set(field, from.GetString(field))
+		}
+	}
+}
+
+// applyLostDetails requires an active lost reason (and a competitor when the
+// reason asks for one) from a lead or deal moving to lost, and stamps when
+// and at which stage it was lost. Reopening clears the details.
+func applyLostDetails(app core.App, rec *core.Record) error {
+	previous := ""
+	if !rec.IsNew() {
+		previous = rec.Original().GetString("stage")
+	}
+	stage := rec.GetString("stage")
+
+	if stage != "lost" {
+		if previous == "lost" {
+			for _, field := range lostFields {
+				rec.Set(field, "")
+			}
+		}
+		return nil
+	}
+	entering := previous != "lost"
+	if !entering && rec.GetString("lost_reason") == rec.Original().GetString("lost_reason") &&
+		rec.GetString("lost_competitor") == rec.Original().GetString("lost_competitor") {
+		return nil
+	}
+
+	reasonId := rec.GetString("lost_reason")
+	if reasonId == "" {
+		return validation.Errors{"lost_reason": validation.NewError("validation_lost_reason_required", "Pick a lost reason to move the record to lost.")}
+	}
+	reason, err := app.FindRecordById(collectionLostReasons, reasonId)
+	if err != nil || (!reason.GetBool("active") && reasonId != rec.Original().GetString("lost_reason")) {
+		return validation.Errors{"lost_reason": validation.NewError("validation_lost_reason_invalid", "The lost reason is not an active option.")}
+	}
+	if reason.GetBool("requires_competitor") && rec.GetString("lost_competitor") == "" {
+		return validation.Errors{"lost_competitor": validation.NewError("validation_lost_competitor_required", "Name the competitor for this lost reason.")}
+	}
+
+	if entering {
+		rec.Set("lost_stage", previous)
+		rec.Set("lost_at", types.NowDateTime())
+	}
+	return nil
+}
+
+func bindLostReasonHooks(app core.App) {
+	apply := func(e *core.RecordEvent) error {
+		if err := applyLostDetails(e.App, e.Record); err != nil {
+			return err
+		}
+		return e.Next()
+	}
+	for _, name := range lossCollections {
+		app.OnRecordCreate(name).BindFunc(apply)
+		app.OnRecordUpdate(name).BindFunc(apply)
+	}
+}
+
+type lossRow struct {
+	Key    string  `db:"key" json:"key"`
+	Label  string  `db:"label" json:"label"`
+	Count  int     `db:"count" json:"count"`
+	Amount float64 `db:"amount" json:"amount"`
+}
+
+// lossDimensions are the breakdowns of the loss report: the SQL key and
+// label of each, over the lost record r, its lead l, reason lr and owner u.
+var lossDimensions = []struct {
+	name  string
+	key   string
+	label string
+}{
+	{"reason", "r.lost_reason", "COALESCE(MAX(lr.name), '')"},
+	{"stage", "r.lost_stage", "r.lost_stage"},
+	{"source", "l.source", "l.source"},
+	{"owner", "r.owner", "COALESCE(MAX(u.name), '')"},
+	{"competitor", "r.lost_competitor", "r.lost_competitor"},
+}
+
+// lossReport breaks down the records of collection lost within [from, to)
+// by each of lossDimensions. Deal amounts are in the base currency at the
+// date they were lost.
+func lossReport(app core.App, collection string, scope dbx.Expression, from string, to string) (map[string][]lossRow, lossRow, error) {
+	where := []dbx.Expression{dbx.HashExp{"r.stage": "lost", "r.archived": false}, scope}
+	if from != "" {
+		where = append(where, dbx.NewExp("r.lost_at >= {:from}", dbx.Params{"from": from}))
+	}
+	if to != "" {
+		where = append(where, dbx.NewExp("r.lost_at < {:to}", dbx.Params{"to": to}))
+	}
+
+	amount := "(0)"
+	if collection == collectionDeals {
+		amount = "COALESCE(SUM(" + baseAmountSQL("r.amount", "r.currency", "COALESCE(NULLIF(r.lost_at, ''), r.updated)") + "), 0)"
+	}
+
+	query := func(key string, label string) ([]lossRow, error) {
+		q := app.DB().
+			Select(key+" AS key", label+" AS label", "COUNT(*) AS count", amount+" AS amount").
+			From(collection+" r").
+			LeftJoin(collectionLostReasons+" lr", dbx.NewExp("lr.id = r.lost_reason")).
+			LeftJoin(collectionUsers+" u", dbx.NewExp("u.id = r.owner"))
+		if collection == collectionDeals {
+			q.LeftJoin(collectionLeads+" l", dbx.NewExp("l.id = r.lead"))
+		} else {
+			q.LeftJoin(collectionLeads+" l", dbx.NewExp("l.id = r.id"))
+		}
+		rows := []lossRow{}
+		err := q.Where(dbx.And(where...)).GroupBy("key").OrderBy("count DESC", "amount DESC").All(&rows)
+		for i := range rows {
+			rows[i].Amount = roundMoney(rows[i].Amount)
+		}
+		return rows, err
+	}
+
+	breakdown := map[string][]lossRow{}
+	for _, d := range lossDimensions {
+		rows, err := query(d.key, d.label)
+		if err != nil {
+			return nil, lossRow{}, err
+		}
+		breakdown[d.name] = rows
+	}
+
+	totals, err := query("('')", "('')")
+	if err != nil {
+		return nil, lossRow{}, err
+	}
+	total := lossRow{}
+	if len(totals) > 0 {
+		total = totals[0]
+	}
+	return breakdown, total, nil
+}
+
+func bindLostReasonRoutes(grp *router.RouterGroup[*core.RequestEvent]) {
+	grp.GET("/reports/losses/{collection}", func(e *core.RequestEvent) error {
+		name, ok := lossCollections[e.Request.PathValue("collection")]
+		if !ok {
+			return e.NotFoundError("Unknown loss report collection.", nil)
+		}
+
+		q := e.Request.URL.Query()
+		scope := ownerScopeExpr(e.Auth, "r.owner")
+		if owner := q.Get("owner"); owner != "" {
+			scope = dbx.And(scope, dbx.HashExp{"r.owner": owner})
+		}
+		breakdown, total, err := lossReport(e.App, name, scope, q.Get("from"), q.Get("to"))
+		if err != nil {
+			return e.InternalServerError("Failed to build loss report.", err)
+		}
+
+		stages := leadStageOrder
+		if name == collectionDeals {
+			stages = dealStageOrder
+		}
+		slices.SortStableFunc(breakdown["stage"], func(a, b lossRow) int {
+			return stageIndex(stages, a.Key) - stageIndex(stages, b.Key)
+		})
+
+		return e.JSON(http.StatusOK, map[string]any{
+			"total":     total,
+			"breakdown": breakdown,
+			"currency":  baseCurrency(),
+		})
+	}).Bind(requireCRMRole(roleManager))
+}
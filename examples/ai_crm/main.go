@@ -23,8 +23,10 @@ import (
 	"github.com/pocketbase/pocketbase"
 	"github.com/pocketbase/pocketbase/apis"
 	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/plugins/migratecmd"
 	"github.com/pocketbase/pocketbase/tools/hook"
-	"github.com/pocketbase/pocketbase/tools/types"
+
+	_ "crm/migrations"
 )
 
 const (
@@ -32,6 +34,33 @@ const (
 	collectionLeads      = "crm_leads"
 	collectionDeals      = "crm_deals"
 	collectionActivities = "crm_activities"
+
+	collectionMergeRules     = "crm_merge_rules"
+	collectionMergeConflicts = "crm_merge_conflicts"
+	collectionMergeLog       = "crm_merge_log"
+
+	collectionCustomFields      = "crm_custom_fields"
+	collectionOutreachTemplates = "crm_outreach_templates"
+
+	collectionTags     = "crm_tags"
+	collectionSegments = "crm_segments"
+
+	collectionUsers           = "crm_users"
+	collectionAssignmentRules = "crm_assignment_rules"
+
+	collectionTasks = "crm_tasks"
+
+	collectionProducts      = "crm_products"
+	collectionDealLineItems = "crm_deal_line_items"
+	collectionDealContacts  = "crm_deal_contacts"
+	collectionLostReasons   = "crm_lost_reasons"
+	collectionExchangeRates = "crm_exchange_rates"
+	collectionStageHistory  = "crm_stage_history"
+	collectionAuditLog      = "crm_audit_log"
+
+	collectionForecastStages    = "crm_forecast_stages"
+	collectionForecastSnapshots = "crm_forecast_snapshots"
+	collectionPipelineSnapshots = "crm_pipeline_snapshots"
 )
 
 func main() {
@@ -39,16 +68,18 @@ func main() {
 	log.Printf("ai_crm starting (dataDir=%s)", dataDir)
 	app := pocketbase.NewWithConfig(pocketbase.Config{DefaultDataDir: dataDir})
 
-	app.OnBootstrap().BindFunc(func(be *core.BootstrapEvent) error {
-		if err := be.Next(); err != nil {
-			return err
-		}
-		return ensureCRMSchema(be.App)
-	})
+	// the CRM schema lives in ./migrations and is applied on serve;
+	// "migrate up|down" runs it manually
+	migratecmd.MustRegister(app, app.RootCmd, migratecmd.Config{})
+
+	bindAICRMHooks(app)
 
 	app.OnServe().Bind(&hook.Handler[*core.ServeEvent]{
 		Priority: -10,
 		Func: func(se *core.ServeEvent) error {
+			if err := configureAttachments(se.App); err != nil {
+				return err
+			}
 			bindAICRMRoutes(se)
 			bindAICRMJobs(se)
 			return se.Next()
@@ -151,7 +182,7 @@ func bindAICRMRoutes(se *core.ServeEvent) {
 			return e.InternalServerError("Failed to seed demo data.", err)
 		}
 		return e.JSON(http.StatusOK, res)
-	}).Bind(apis.RequireSuperuserAuth())
+	}).Bind(requireCRMRole())
 
 	grp.POST("/agents/run/{leadId}", func(e *core.RequestEvent) error {
 		leadId := strings.TrimSpace(e.Request.PathValue("leadId"))
@@ -159,13 +190,18 @@ func bindAICRMRoutes(se *core.ServeEvent) {
 			return e.BadRequestError("Missing leadId.", nil)
 		}
 
+		lead, err := e.App.FindRecordById(collectionLeads, leadId)
+		if err != nil || !canAccessOwned(e.App, e.Auth, lead) {
+			return e.NotFoundError("Lead not found.", err)
+		}
+
 		result, err := runLeadAgent(e.App, leadId)
 		if err != nil {
 			return e.InternalServerError("Failed to run agent.", err)
 		}
 
 		return e.JSON(http.StatusOK, result)
-	}).Bind(apis.RequireSuperuserAuth())
+	}).Bind(requireCRMRole(roleManager, roleRep))
 
 	grp.POST("/apify/import", func(e *core.RequestEvent) error {
 		res, err := importApifyDubaiEcommerceCSuite(e.App)
@@ -176,7 +212,7 @@ func bindAICRMRoutes(se *core.ServeEvent) {
 			})
 		}
 		return e.JSON(http.StatusOK, res)
-	}).Bind(apis.RequireSuperuserAuth())
+	}).Bind(requireCRMRole())
 
 	grp.POST("/purge/demo", func(e *core.RequestEvent) error {
 		res, err := purgeDemoLeads(e.App)
@@ -184,7 +220,50 @@ func bindAICRMRoutes(se *core.ServeEvent) {
 			return e.InternalServerError("Failed to purge demo leads.", err)
 		}
 		return e.JSON(http.StatusOK, res)
-	}).Bind(apis.RequireSuperuserAuth())
+	}).Bind(requireCRMRole())
+
+	bindMergeRoutes(grp)
+	bindDuplicateRoutes(grp)
+	bindNormalizationRoutes(grp)
+	bindCustomFieldRoutes(grp)
+	bindCSVRoutes(grp)
+	bindSegmentRoutes(grp)
+	bindAssignmentRoutes(grp)
+	bindTaskRoutes(grp)
+	bindProductRoutes(grp)
+	bindStageHistoryRoutes(grp)
+	bindArchiveRoutes(grp)
+	bindAuditRoutes(grp)
+	bindAttachmentRoutes(grp)
+	bindAccountHierarchyRoutes(grp)
+	bindDealContactRoutes(grp)
+	bindLostReasonRoutes(grp)
+	bindAttributionRoutes(grp)
+	bindPipelineRoutes(grp)
+	bindForecastRoutes(grp)
+	bindPipelineSnapshotRoutes(grp)
+}
+
+func bindAICRMHooks(app core.App) {
+	bindMergeHooks(app)
+	bindNormalizationHooks(app)
+	bindAccountMatchingHooks(app)
+	bindCustomFieldHooks(app)
+	bindSegmentHooks(app)
+	bindAssignmentHooks(app)
+	bindRoleHooks(app)
+	bindTaskHooks(app)
+	bindCurrencyHooks(app)
+	bindProductHooks(app)
+	bindChangeActorHooks(app)
+	bindStageHistoryHooks(app)
+	bindStageSyncHooks(app)
+	bindArchiveHooks(app)
+	bindAuditHooks(app)
+	bindAccountHierarchyHooks(app)
+	bindDealContactHooks(app)
+	bindLostReasonHooks(app)
+	bindAttributionHooks(app)
 }
 
 func bindAICRMJobs(se *core.ServeEvent) {
@@ -198,20 +277,44 @@ func bindAICRMJobs(se *core.ServeEvent) {
 		// fire-and-forget style job; keep it resilient
 		_, _ = runAgentForPendingLeads(se.App, 5)
 	})
+
+	se.App.Cron().MustAdd("aiCrmTaskReminders", "*/5 * * * *", func() {
+		if _, err := sendTaskReminders(se.App); err != nil {
+			se.App.Logger().Warn("ai_crm task reminders failed", "error", err)
+		}
+	})
+
+	se.App.Cron().MustAdd("aiCrmRetention", "30 3 * * *", func() {
+		if _, err := purgeDeletedRecords(se.App, time.Now().Add(-retentionPeriod())); err != nil {
+			se.App.Logger().Warn("ai_crm retention purge failed", "error", err)
+		}
+	})
+
+	se.App.Cron().MustAdd("aiCrmPipelineSnapshot", "15 4 * * *", func() {
+		if _, err := snapshotPipeline(se.App, time.Now()); err != nil {
+			se.App.Logger().Warn("ai_crm pipeline snapshot failed", "error", err)
+		}
+	})
+
+	se.App.Cron().MustAdd("aiCrmForecastSnapshot", "0 4 * * 1", func() {
+		if _, err := snapshotForecast(se.App, time.Now()); err != nil {
+			se.App.Logger().Warn("ai_crm forecast snapshot failed", "error", err)
+		}
+	})
 }
 
+// purgeDemoLeads deletes the demo leads with their deals and activities, and
+// the accounts left without leads. Deletes are soft: the records can be
+// restored until the retention job purges them.
 func purgeDemoLeads(app core.App) (map[string]any, error) {
 	demoDomains := []string{"example.com", "acme.test", "company.test", "demo.local", "corp.test"}
 	filterParts := make([]string, 0, len(demoDomains))
 	for _, d := range demoDomains {
 		filterParts = append(filterParts, fmt.Sprintf("email ~ '@%s'", strings.ReplaceAll(d, "'", "''")))
 	}
-	filter := "(" + strings.Join(filterParts, " || ") + ")"
+	filter := "(" + strings.Join(filterParts, " || ") + ") && archived = false"
 
-	deletedLeads := 0
-	deletedDeals := 0
-	deletedActivities := 0
-	deletedAccounts := 0
+	deleted := map[string]int{}
 	accountIds := map[string]struct{}{}
 
 	limit := 200
@@ -230,38 +333,19 @@ func purgeDemoLeads(app core.App) (map[string]any, error) {
 				accountIds[accId] = struct{}{}
 			}
 
-			acts, err := app.FindRecordsByFilter(collectionActivities, fmt.Sprintf("lead='%s'", strings.ReplaceAll(lead.Id, "'", "''")), "", 500, 0)
-			if err != nil {
-				return nil, err
-			}
-			for _, a := range acts {
-				if err := app.Delete(a); err != nil {
-					return nil, err
-				}
-				deletedActivities++
-			}
-
-			deals, err := app.FindRecordsByFilter(collectionDeals, fmt.Sprintf("lead='%s'", strings.ReplaceAll(lead.Id, "'", "''")), "", 500, 0)
+			counts, err := archiveRecord(app, lead, true)
 			if err != nil {
 				return nil, err
 			}
-			for _, d := range deals {
-				if err := app.Delete(d); err != nil {
-					return nil, err
-				}
-				deletedDeals++
+			for name, n := range counts {
+				deleted[name] += n
 			}
-
-			if err := app.Delete(lead); err != nil {
-				return nil, err
-			}
-			deletedLeads++
 		}
 
 	}
 
 	for accId := range accountIds {
-		left, err := app.FindRecordsByFilter(collectionLeads, fmt.Sprintf("account='%s'", strings.ReplaceAll(accId, "'", "''")), "", 1, 0)
+		left, err := app.FindRecordsByFilter(collectionLeads, "account={:account} && archived = false", "", 1, 0, dbx.Params{"account": accId})
 		if err != nil {
 			return nil, err
 		}
@@ -269,228 +353,23 @@ func purgeDemoLeads(app core.App) (map[string]any, error) {
 			continue
 		}
 		acc, err := app.FindRecordById(collectionAccounts, accId)
-		if err != nil {
+		if err != nil || acc.GetBool("archived") {
 			continue
 		}
-		if err := app.Delete(acc); err != nil {
+		if _, err := archiveRecord(app, acc, true); err != nil {
 			return nil, err
 		}
-		deletedAccounts++
+		deleted[collectionAccounts]++
 	}
 
 	return map[string]any{
-		"deletedLeads":      deletedLeads,
-		"deletedDeals":      deletedDeals,
-		"deletedActivities": deletedActivities,
-		"deletedAccounts":   deletedAccounts,
+		"deletedLeads":      deleted[collectionLeads],
+		"deletedDeals":      deleted[collectionDeals],
+		"deletedActivities": deleted[collectionActivities],
+		"deletedAccounts":   deleted[collectionAccounts],
 	}, nil
 }
 
-func ensureCRMSchema(app core.App) error {
-	if _, err := ensureAccountsCollection(app); err != nil {
-		return err
-	}
-	if _, err := ensureLeadsCollection(app); err != nil {
-		return err
-	}
-	if _, err := ensureDealsCollection(app); err != nil {
-		return err
-	}
-	if _, err := ensureActivitiesCollection(app); err != nil {
-		return err
-	}
-	return nil
-}
-
-func superuserOnlyRule() *string {
-	return types.Pointer("@request.auth.collectionName = '_superusers'")
-}
-
-func ensureAccountsCollection(app core.App) (*core.Collection, error) {
-	if col, ok, err := findCollection(app, collectionAccounts); err != nil {
-		return nil, err
-	} else if ok {
-		return col, nil
-	}
-
-	col := core.NewBaseCollection(collectionAccounts)
-	col.ListRule = superuserOnlyRule()
-	col.ViewRule = superuserOnlyRule()
-	col.CreateRule = superuserOnlyRule()
-	col.UpdateRule = superuserOnlyRule()
-	col.DeleteRule = superuserOnlyRule()
-
-	col.Fields.Add(
-		&core.TextField{Name: "name", Required: true, Presentable: true, Max: 255},
-		&core.TextField{Name: "domain", Max: 255},
-		&core.TextField{Name: "notes"},
-		&core.AutodateField{Name: "created", OnCreate: true},
-		&core.AutodateField{Name: "updated", OnCreate: true, OnUpdate: true},
-	)
-
-	if err := app.Save(col); err != nil {
-		return nil, err
-	}
-
-	return col, nil
-}
-
-func ensureLeadsFieldsUpgrade(app core.App, col *core.Collection) error {
-	changed := false
-	if col.Fields.GetByName("job_title") == nil {
-		col.Fields.Add(&core.TextField{Name: "job_title", Max: 255})
-		changed = true
-	}
-	if col.Fields.GetByName("phone") == nil {
-		col.Fields.Add(&core.TextField{Name: "phone", Max: 255})
-		changed = true
-	}
-	if col.Fields.GetByName("linkedin") == nil {
-		col.Fields.Add(&core.TextField{Name: "linkedin", Max: 1024})
-		changed = true
-	}
-	if !changed {
-		return nil
-	}
-	return app.Save(col)
-}
-
-func ensureLeadsCollection(app core.App) (*core.Collection, error) {
-	if col, ok, err := findCollection(app, collectionLeads); err != nil {
-		return nil, err
-	} else if ok {
-		if err := ensureLeadsFieldsUpgrade(app, col); err != nil {
-			return nil, err
-		}
-		return col, nil
-	}
-
-	accounts, err := app.FindCollectionByNameOrId(collectionAccounts)
-	if err != nil {
-		return nil, err
-	}
-
-	col := core.NewBaseCollection(collectionLeads)
-	col.ListRule = superuserOnlyRule()
-	col.ViewRule = superuserOnlyRule()
-	col.CreateRule = superuserOnlyRule()
-	col.UpdateRule = superuserOnlyRule()
-	col.DeleteRule = superuserOnlyRule()
-
-	col.Fields.Add(
-		&core.TextField{Name: "name", Required: true, Presentable: true, Max: 255},
-		&core.EmailField{Name: "email"},
-		&core.TextField{Name: "company", Max: 255},
-		&core.RelationField{Name: "account", CollectionId: accounts.Id, MaxSelect: 1},
-		&core.TextField{Name: "job_title", Max: 255},
-		&core.TextField{Name: "phone", Max: 255},
-		&core.TextField{Name: "linkedin", Max: 1024},
-		&core.SelectField{Name: "stage", Required: true, Values: []string{"new", "outreached", "replied", "qualified", "proposal", "won", "lost"}},
-		&core.NumberField{Name: "score", Min: floatPointer(0), Max: floatPointer(100)},
-		&core.DateField{Name: "last_contacted"},
-		&core.JSONField{Name: "agent_state"},
-		&core.AutodateField{Name: "created", OnCreate: true},
-		&core.AutodateField{Name: "updated", OnCreate: true, OnUpdate: true},
-	)
-
-	if err := app.Save(col); err != nil {
-		return nil, err
-	}
-
-	return col, nil
-}
-
-func ensureDealsCollection(app core.App) (*core.Collection, error) {
-	if col, ok, err := findCollection(app, collectionDeals); err != nil {
-		return nil, err
-	} else if ok {
-		return col, nil
-	}
-
-	leads, err := app.FindCollectionByNameOrId(collectionLeads)
-	if err != nil {
-		return nil, err
-	}
-
-	col := core.NewBaseCollection(collectionDeals)
-	col.ListRule = superuserOnlyRule()
-	col.ViewRule = superuserOnlyRule()
-	col.CreateRule = superuserOnlyRule()
-	col.UpdateRule = superuserOnlyRule()
-	col.DeleteRule = superuserOnlyRule()
-
-	col.Fields.Add(
-		&core.TextField{Name: "title", Required: true, Presentable: true, Max: 255},
-		&core.RelationField{Name: "lead", CollectionId: leads.Id, MaxSelect: 1, Required: true},
-		&core.SelectField{Name: "stage", Required: true, Values: []string{"qualification", "proposal", "negotiation", "won", "lost"}},
-		&core.NumberField{Name: "amount"},
-		&core.DateField{Name: "close_date"},
-		&core.AutodateField{Name: "created", OnCreate: true},
-		&core.AutodateField{Name: "updated", OnCreate: true, OnUpdate: true},
-	)
-
-	if err := app.Save(col); err != nil {
-		return nil, err
-	}
-
-	return col, nil
-}
-
-func ensureActivitiesCollection(app core.App) (*core.Collection, error) {
-	if col, ok, err := findCollection(app, collectionActivities); err != nil {
-		return nil, err
-	} else if ok {
-		return col, nil
-	}
-
-	leads, err := app.FindCollectionByNameOrId(collectionLeads)
-	if err != nil {
-		return nil, err
-	}
-	deals, err := app.FindCollectionByNameOrId(collectionDeals)
-	if err != nil {
-		return nil, err
-	}
-
-	col := core.NewBaseCollection(collectionActivities)
-	col.ListRule = superuserOnlyRule()
-	col.ViewRule = superuserOnlyRule()
-	col.CreateRule = superuserOnlyRule()
-	col.UpdateRule = superuserOnlyRule()
-	col.DeleteRule = superuserOnlyRule()
-
-	col.Fields.Add(
-		&core.SelectField{Name: "type", Required: true, Values: []string{"outreach_email", "outreach_call", "meeting", "note", "status_change"}},
-		&core.RelationField{Name: "lead", CollectionId: leads.Id, MaxSelect: 1, Required: true},
-		&core.RelationField{Name: "deal", CollectionId: deals.Id, MaxSelect: 1},
-		&core.TextField{Name: "content", Max: 5000},
-		&core.JSONField{Name: "metadata"},
-		&core.AutodateField{Name: "created", OnCreate: true},
-		&core.AutodateField{Name: "updated", OnCreate: true, OnUpdate: true},
-	)
-
-	if err := app.Save(col); err != nil {
-		return nil, err
-	}
-
-	return col, nil
-}
-
-func findCollection(app core.App, nameOrId string) (*core.Collection, bool, error) {
-	col, err := app.FindCollectionByNameOrId(nameOrId)
-	if err == nil {
-		return col, true, nil
-	}
-	if errors.Is(err, sql.ErrNoRows) {
-		return nil, false, nil
-	}
-	return nil, false, err
-}
-
-func floatPointer(v float64) *float64 {
-	return &v
-}
-
 func autoSeedUpTo(app core.App, target int) (int, error) {
 	if target <= 0 {
 		return 0, nil
@@ -551,17 +430,13 @@ func seedDemoDataWithCollections(app core.App, accounts *core.Collection, leads
 	accountIds := make([]string, 0, count)
 	dealIds := make([]string, 0, count)
 
-	leadStages := []string{"new", "outreached", "replied", "qualified", "proposal"}
-	dealStagesByLead := map[string]string{
-		"new":        "qualification",
-		"outreached": "qualification",
-		"replied":    "qualification",
-		"qualified":  "qualification",
-		"proposal":   "proposal",
-		"won":        "won",
-		"lost":       "lost",
+	products, err := ensureDemoProducts(app)
+	if err != nil {
+		return nil, err
 	}
 
+	leadStages := []string{"new", "outreached", "replied", "qualified", "proposal"}
+
 	for i := 0; i < count; i++ {
 		fn := firstNames[rand.IntN(len(firstNames))]
 		ln := lastNames[rand.IntN(len(lastNames))]
@@ -575,6 +450,7 @@ func seedDemoDataWithCollections(app core.App, accounts *core.Collection, leads
 		acc := core.NewRecord(accounts)
 		acc.Set("name", company)
 		acc.Set("domain", domain)
+		setChangeActor(acc, leadSourceSeed, "")
 		if err := app.Save(acc); err != nil {
 			return nil, err
 		}
@@ -586,18 +462,23 @@ func seedDemoDataWithCollections(app core.App, accounts *core.Collection, leads
 		lead.Set("account", acc.Id)
 		lead.Set("stage", stage)
 		lead.Set("score", score)
+		setChangeActor(lead, leadSourceSeed, "")
 		if err := app.Save(lead); err != nil {
 			return nil, err
 		}
 
+		product := products[rand.IntN(len(products))]
 		deal := core.NewRecord(deals)
-		deal.Set("title", company+" / Starter")
+		deal.Set("title", company+" / "+product.GetString("name"))
 		deal.Set("lead", lead.Id)
-		deal.Set("stage", dealStagesByLead[stage])
-		deal.Set("amount", 1000+rand.IntN(50000))
+		deal.Set("stage", dealStageByLeadStage[stage])
+		setChangeActor(deal, leadSourceSeed, "")
 		if err := app.Save(deal); err != nil {
 			return nil, err
 		}
+		if err := addDealLineItem(app, deal.Id, product, float64(1+rand.IntN(3)), float64(rand.IntN(3)*5)); err != nil {
+			return nil, err
+		}
 
 		accountIds = append(accountIds, acc.Id)
 		leadIds = append(leadIds, lead.Id)
@@ -619,6 +500,7 @@ type agentRunResult struct {
 	Action      string         `json:"action"`
 	Message     string         `json:"message"`
 	ActivityId  string         `json:"activityId"`
+	TaskId      string         `json:"taskId,omitempty"`
 	DealCreated bool           `json:"dealCreated"`
 	Meta        map[string]any `json:"meta"`
 }
@@ -634,6 +516,17 @@ func runLeadAgent(app core.App, leadId string) (*agentRunResult, error) {
 		oldStage = "new"
 	}
 
+	if lead.GetBool("archived") {
+		return &agentRunResult{
+			LeadId:   leadId,
+			OldStage: oldStage,
+			NewStage: oldStage,
+			Action:   "noop",
+			Message:  "Lead is archived.",
+			Meta:     map[string]any{"archived": true},
+		}, nil
+	}
+
 	if oldStage == "won" || oldStage == "lost" {
 		return &agentRunResult{
 			LeadId:   leadId,
@@ -646,6 +539,9 @@ func runLeadAgent(app core.App, leadId string) (*agentRunResult, error) {
 	}
 
 	action, message, newStage, activityType := planNextStep(lead, oldStage)
+	if tpl, ok := findOutreachTemplate(app, action); ok {
+		message = renderLeadTemplate(app, tpl, lead)
+	}
 
 	// ensure deal exists once qualified
 	dealCreated := false
@@ -657,11 +553,21 @@ func runLeadAgent(app core.App, leadId string) (*agentRunResult, error) {
 		dealCreated = created
 	}
 
-	activityId, err := createActivity(app, lead, activityType, message, map[string]any{
-		"agentAction": action,
-		"fromStage":   oldStage,
-		"toStage":     newStage,
-	})
+	// steps that need a person become tasks, everything else is logged
+	activityId := ""
+	taskId := ""
+	meta := map[string]any{}
+	if step, ok := agentTaskSteps[action]; ok {
+		taskId, err = createAgentTask(app, lead, step, message)
+		meta["taskPriority"] = step.Priority
+	} else {
+		meta["activityType"] = activityType
+		activityId, err = createActivity(app, lead, activityType, message, map[string]any{
+			"agentAction": action,
+			"fromStage":   oldStage,
+			"toStage":     newStage,
+		})
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -673,15 +579,11 @@ func runLeadAgent(app core.App, leadId string) (*agentRunResult, error) {
 		"old_stage":    oldStage,
 		"new_stage":    newStage,
 	})
+	setChangeActor(lead, changeSourceAgent, "")
 	if err := app.Save(lead); err != nil {
 		return nil, err
 	}
 
-	// if lead is won, mark deal as won too
-	if newStage == "won" {
-		_ = markDealStage(app, lead.Id, "won")
-	}
-
 	return &agentRunResult{
 		LeadId:      lead.Id,
 		OldStage:    oldStage,
@@ -689,8 +591,9 @@ func runLeadAgent(app core.App, leadId string) (*agentRunResult, error) {
 		Action:      action,
 		Message:     message,
 		ActivityId:  activityId,
+		TaskId:      taskId,
 		DealCreated: dealCreated,
-		Meta:        map[string]any{"activityType": activityType},
+		Meta:        meta,
 	}, nil
 }
 
@@ -701,7 +604,7 @@ func runAgentForPendingLeads(app core.App, limit int) (int, error) {
 
 	leads, err := app.FindRecordsByFilter(
 		collectionLeads,
-		"stage != 'won' && stage != 'lost'",
+		"stage != 'won' && stage != 'lost' && archived = false",
 		"-updated",
 		limit,
 		0,
@@ -754,6 +657,7 @@ func createActivity(app core.App, lead *core.Record, typ string, content string,
 	rec.Set("lead", lead.Id)
 	rec.Set("content", content)
 	rec.Set("metadata", metadata)
+	setChangeActor(rec, changeSourceAgent, "")
 
 	if err := app.Save(rec); err != nil {
 		return "", err
@@ -763,7 +667,7 @@ func createActivity(app core.App, lead *core.Record, typ string, content string,
 }
 
 func ensureDealForLead(app core.App, lead *core.Record) (bool, error) {
-	_, err := app.FindFirstRecordByFilter(collectionDeals, "lead={:lead}", dbx.Params{"lead": lead.Id})
+	_, err := app.FindFirstRecordByFilter(collectionDeals, "lead={:lead} && archived=false", dbx.Params{"lead": lead.Id})
 	if err == nil {
 		return false, nil
 	}
@@ -780,6 +684,7 @@ func ensureDealForLead(app core.App, lead *core.Record) (bool, error) {
 	rec.Set("title", fmt.Sprintf("%s / New deal", safe(lead.GetString("company"))))
 	rec.Set("lead", lead.Id)
 	rec.Set("stage", "qualification")
+	setChangeActor(rec, changeSourceAgent, "")
 	if err := app.Save(rec); err != nil {
 		return false, err
 	}
@@ -787,15 +692,6 @@ func ensureDealForLead(app core.App, lead *core.Record) (bool, error) {
 	return true, nil
 }
 
-func markDealStage(app core.App, leadId string, stage string) error {
-	deal, err := app.FindFirstRecordByFilter(collectionDeals, "lead={:lead}", dbx.Params{"lead": leadId})
-	if err != nil {
-		return err
-	}
-	deal.Set("stage", stage)
-	return app.Save(deal)
-}
-
 func safe(s string) string {
 	s = strings.TrimSpace(s)
 	if s == "" {
@@ -813,6 +709,45 @@ type apifyLeadCandidate struct {
 	CompanyName     string
 	CompanyWebsite  string
 	CompanyLinkedin string
+
+	CompanyIndustry  string
+	CompanyCity      string
+	CompanyCountry   string
+	CompanyEmployees string
+
+	Place apifyPlace
+
+	// SourceDetail and Touch attribute a new lead (see applyLeadAttribution).
+	SourceDetail string
+	Touch        leadTouch
+
+	// ObservedAt is when the source saw the data (zero for now); keep_newest
+	// merges compare it against the time the current value was written.
+	ObservedAt time.Time
+}
+
+// apifyPlace holds the Google Places fields of the item a candidate was found on.
+type apifyPlace struct {
+	Title       string
+	Address     string
+	Category    string
+	City        string
+	CountryCode string
+	Website     string
+	Rating      float64
+}
+
+// accountDetails are the account fields an importer can fill.
+type accountDetails struct {
+	Name          string
+	Website       string
+	Linkedin      string
+	Industry      string
+	Address       string
+	City          string
+	Country       string
+	EmployeeRange string
+	SourceRating  float64
 }
 
 func importApifyDubaiEcommerceCSuite(app core.App) (map[string]any, error) {
@@ -900,6 +835,7 @@ func importApifyDubaiEcommerceCSuite(app core.App) (map[string]any, error) {
 
 	createdLeads := 0
 	updatedLeads := 0
+	conflicts := 0
 	skipped := 0
 
 	for _, c := range deduped {
@@ -908,17 +844,18 @@ func importApifyDubaiEcommerceCSuite(app core.App) (map[string]any, error) {
 			continue
 		}
 
-		acc, _, err := upsertAccountByName(app, c.CompanyName, c.CompanyWebsite)
+		acc, _, err := upsertAccount(app, leadSourceApify, accountDetailsFromCandidate(c))
 		if err != nil {
 			return nil, err
 		}
 
-		lead, created, err := upsertLead(app, acc.Id, c)
+		c.SourceDetail = "compass~crawler-google-places: e-commerce in Dubai"
+		res, err := upsertLead(app, leadSourceApify, acc.Id, c)
 		if err != nil {
 			return nil, err
 		}
-		_ = lead
-		if created {
+		conflicts += res.Conflicts
+		if res.Created {
 			createdLeads++
 		} else {
 			updatedLeads++
@@ -928,6 +865,7 @@ func importApifyDubaiEcommerceCSuite(app core.App) (map[string]any, error) {
 	return map[string]any{
 		"createdLeads": createdLeads,
 		"updatedLeads": updatedLeads,
+		"conflicts":    conflicts,
 		"skipped":      skipped,
 		"total":        len(deduped),
 	}, nil
@@ -952,8 +890,22 @@ func extractApifyCandidates(item map[string]any) []apifyLeadCandidate {
 		return nil
 	}
 
+	place := apifyPlace{
+		Title:       getString(item, "title"),
+		Address:     getString(item, "address"),
+		Category:    getString(item, "categoryName"),
+		City:        getString(item, "city"),
+		CountryCode: getString(item, "countryCode"),
+		Website:     getString(item, "website"),
+		Rating:      getFloat(item, "totalScore"),
+	}
+	observedAt, _ := time.Parse(time.RFC3339, getString(item, "scrapedAt"))
+
 	if getString(item, "fullName") != "" || getString(item, "personId") != "" {
-		return []apifyLeadCandidate{normalizeApifyLead(item)}
+		c := normalizeApifyLead(item)
+		c.Place = place
+		c.ObservedAt = observedAt
+		return []apifyLeadCandidate{c}
 	}
 
 	byIdx := map[int]map[string]any{}
@@ -1002,7 +954,10 @@ func extractApifyCandidates(item map[string]any) []apifyLeadCandidate {
 		if m == nil {
 			continue
 		}
-		out = append(out, normalizeApifyLead(m))
+		c := normalizeApifyLead(m)
+		c.Place = place
+		c.ObservedAt = observedAt
+		out = append(out, c)
 	}
 	return out
 }
@@ -1017,57 +972,139 @@ func normalizeApifyLead(m map[string]any) apifyLeadCandidate {
 		CompanyName:     firstNonEmpty(getString(m, "companyName"), getString(m, "csuiteProfile_companyName")),
 		CompanyWebsite:  getString(m, "companyWebsite"),
 		CompanyLinkedin: getString(m, "companyLinkedin"),
+
+		CompanyIndustry:  getString(m, "industry"),
+		CompanyCity:      getString(m, "companyCity"),
+		CompanyCountry:   getString(m, "companyCountry"),
+		CompanyEmployees: firstNonEmpty(getString(m, "companySize"), getString(m, "companyEmployeesCount")),
 	}
 }
 
-func upsertAccountByName(app core.App, companyName string, companyWebsite string) (*core.Record, bool, error) {
-	companyName = strings.TrimSpace(companyName)
+// accountDetailsFromCandidate builds the account fields of a candidate.
+// The Google Places item is only used when it belongs to the candidate's
+// company (same domain or name); its location then wins as a whole, since it
+// is the local branch the search found, over the company headquarters.
+func accountDetailsFromCandidate(c apifyLeadCandidate) accountDetails {
+	d := accountDetails{
+		Name:          c.CompanyName,
+		Website:       firstNonEmpty(c.CompanyWebsite, corporateEmailDomain(c.Email)),
+		Linkedin:      c.CompanyLinkedin,
+		Industry:      c.CompanyIndustry,
+		City:          c.CompanyCity,
+		Country:       c.CompanyCountry,
+		EmployeeRange: c.CompanyEmployees,
+	}
+
+	placeDomain := domainFromWebsite(c.Place.Website)
+	samePlace := (placeDomain != "" && placeDomain == domainFromWebsite(d.Website)) ||
+		(c.Place.Title != "" && normalizeCompanyName(c.Place.Title) == normalizeCompanyName(c.CompanyName))
+	if !samePlace {
+		return d
+	}
+
+	d.Website = firstNonEmpty(d.Website, c.Place.Website)
+	d.Industry = firstNonEmpty(d.Industry, c.Place.Category)
+	if c.Place.Address != "" || c.Place.CountryCode != "" {
+		d.Address = c.Place.Address
+		d.City = c.Place.City
+		d.Country = c.Place.CountryCode
+	}
+	d.SourceRating = c.Place.Rating
+	return d
+}
+
+// upsertAccount finds the account by domain first and by name second,
+// creating it when neither matches. Free-mail domains never match.
+// Enrichment fields are only filled in when empty, except source_rating
+// which always reflects the latest scrape.
+func upsertAccount(app core.App, source string, d accountDetails) (*core.Record, bool, error) {
+	companyName := strings.TrimSpace(d.Name)
 	if companyName == "" {
 		return nil, false, errors.New("missing company name")
 	}
 
-	acc, err := app.FindFirstRecordByFilter(collectionAccounts, "name={:name}", dbx.Params{"name": companyName})
-	if err == nil {
-		return acc, false, nil
+	domain := domainFromWebsite(d.Website)
+	if isFreeMailDomain(domain) {
+		domain = ""
 	}
-	if !errors.Is(err, sql.ErrNoRows) {
+
+	acc, err := findAccountByDomain(app, domain)
+	if err != nil && errors.Is(err, sql.ErrNoRows) {
+		acc, err = app.FindFirstRecordByFilter(collectionAccounts, "name={:name} && archived = false", dbx.Params{"name": companyName})
+	}
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
 		return nil, false, err
 	}
 
-	accounts, err := app.FindCollectionByNameOrId(collectionAccounts)
-	if err != nil {
-		return nil, false, err
+	created := false
+	if acc == nil {
+		accounts, err := app.FindCollectionByNameOrId(collectionAccounts)
+		if err != nil {
+			return nil, false, err
+		}
+		acc = core.NewRecord(accounts)
+		acc.Set("name", companyName)
+		created = true
 	}
 
-	rec := core.NewRecord(accounts)
-	rec.Set("name", companyName)
-	if domain := domainFromWebsite(companyWebsite); domain != "" {
-		rec.Set("domain", domain)
+	changed := created
+	fill := func(field string, value string) {
+		value = strings.TrimSpace(value)
+		if value != "" && acc.GetString(field) == "" {
+			acc.Set(field, value)
+			changed = true
+		}
 	}
-	if err := app.Save(rec); err != nil {
-		return nil, false, err
+	fill("domain", domain)
+	if domain != "" {
+		fill("website", websiteURL(d.Website))
+	}
+	fill("linkedin", d.Linkedin)
+	fill("industry", d.Industry)
+	fill("address", d.Address)
+	fill("city", d.City)
+	fill("country", d.Country)
+	fill("employee_range", d.EmployeeRange)
+	if d.SourceRating > 0 && acc.GetFloat("source_rating") != d.SourceRating {
+		acc.Set("source_rating", d.SourceRating)
+		changed = true
 	}
-	return rec, true, nil
+
+	if changed {
+		setChangeActor(acc, source, "")
+		if err := app.Save(acc); err != nil {
+			return nil, false, err
+		}
+	}
+	return acc, created, nil
+}
+
+type leadUpsertResult struct {
+	Lead      *core.Record
+	Created   bool
+	Conflicts int
 }
 
-func upsertLead(app core.App, accountId string, c apifyLeadCandidate) (*core.Record, bool, error) {
+func upsertLead(app core.App, source string, accountId string, c apifyLeadCandidate) (*leadUpsertResult, error) {
 	leads, err := app.FindCollectionByNameOrId(collectionLeads)
 	if err != nil {
-		return nil, false, err
+		return nil, err
 	}
 
 	var lead *core.Record
 	created := false
 
+	// archived leads are left alone: a re-import or capture of one creates a
+	// new lead, and restoring the archived one is a separate, explicit step
 	if strings.TrimSpace(c.Email) != "" {
-		lead, err = app.FindFirstRecordByFilter(collectionLeads, "email={:email}", dbx.Params{"email": strings.TrimSpace(c.Email)})
+		lead, err = app.FindFirstRecordByFilter(collectionLeads, "email={:email} && archived = false", dbx.Params{"email": strings.ToLower(strings.TrimSpace(c.Email))})
 	} else {
-		lead, err = app.FindFirstRecordByFilter(collectionLeads, "name={:name} && company={:company}", dbx.Params{"name": strings.TrimSpace(c.FullName), "company": strings.TrimSpace(c.CompanyName)})
+		lead, err = app.FindFirstRecordByFilter(collectionLeads, "name={:name} && company={:company} && archived = false", dbx.Params{"name": strings.TrimSpace(c.FullName), "company": strings.TrimSpace(c.CompanyName)})
 	}
 
 	if err != nil {
 		if !errors.Is(err, sql.ErrNoRows) {
-			return nil, false, err
+			return nil, err
 		}
 		lead = core.NewRecord(leads)
 		created = true
@@ -1075,27 +1112,42 @@ func upsertLead(app core.App, accountId string, c apifyLeadCandidate) (*core.Rec
 		lead.Set("score", 0)
 	}
 
-	lead.Set("name", strings.TrimSpace(c.FullName))
-	if strings.TrimSpace(c.Email) != "" {
-		lead.Set("email", strings.TrimSpace(c.Email))
-	}
-	lead.Set("company", strings.TrimSpace(c.CompanyName))
-	lead.Set("account", accountId)
-	if strings.TrimSpace(c.JobTitle) != "" {
-		lead.Set("job_title", strings.TrimSpace(c.JobTitle))
+	policy, err := loadMergePolicy(app, source)
+	if err != nil {
+		return nil, err
 	}
-	if strings.TrimSpace(c.Phone) != "" {
-		lead.Set("phone", strings.TrimSpace(c.Phone))
+
+	incoming := map[string]string{
+		"name":      c.FullName,
+		"email":     c.Email,
+		"company":   c.CompanyName,
+		"account":   accountId,
+		"job_title": c.JobTitle,
+		"phone":     c.Phone,
+		"linkedin":  c.Linkedin,
 	}
-	if strings.TrimSpace(c.Linkedin) != "" {
-		lead.Set("linkedin", strings.TrimSpace(c.Linkedin))
+	normalizeLeadInput(app, accountId, incoming)
+
+	// a source can't claim to have seen the data after it was imported
+	observedAt := time.Now().UTC()
+	if !c.ObservedAt.IsZero() && c.ObservedAt.Before(observedAt) {
+		observedAt = c.ObservedAt
 	}
 
+	conflicts := applyLeadMerge(lead, source, policy, observedAt, incoming)
+	applyLeadAttribution(lead, c.SourceDetail, c.Touch)
+
+	setChangeActor(lead, source, "")
 	if err := app.Save(lead); err != nil {
-		return nil, false, err
+		return nil, err
 	}
 
-	return lead, created, nil
+	recorded, err := recordMergeConflicts(app, lead, conflicts)
+	if err != nil {
+		return nil, err
+	}
+
+	return &leadUpsertResult{Lead: lead, Created: created, Conflicts: recorded}, nil
 }
 
 func domainFromWebsite(site string) string {
@@ -1115,6 +1167,23 @@ func domainFromWebsite(site string) string {
 	return host
 }
 
+// websiteURL returns site with an explicit scheme, e.g. "https://acme.com".
+func websiteURL(site string) string {
+	site = strings.TrimSpace(site)
+	if site == "" || strings.Contains(site, "://") {
+		return site
+	}
+	return "https://" + site
+}
+
+func getFloat(m map[string]any, key string) float64 {
+	v, err := strconv.ParseFloat(getString(m, key), 64)
+	if err != nil {
+		return 0
+	}
+	return v
+}
+
 func getString(m map[string]any, key string) string {
 	if m == nil {
 		return ""
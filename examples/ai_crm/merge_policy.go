@@ -0,0 +1,357 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/router"
+)
+
+const (
+	leadSourceSeed    = "seed"
+	leadSourceApify   = "apify"
+	leadSourceCSV     = "csv"
+	leadSourceWebForm = "web_form"
+	leadSourceManual  = "manual"
+)
+
+const (
+	mergeOverwrite      = "overwrite"
+	mergeFillIfEmpty    = "fill_if_empty"
+	mergeKeepNewest     = "keep_newest"
+	mergeNeverOverwrite = "never_overwrite"
+)
+
+// leadMergeFields are the lead fields an importer is allowed to write.
+var leadMergeFields = []string{"name", "email", "company", "account", "job_title", "phone", "linkedin"}
+
+// defaultLeadMergePolicy is used when no crm_merge_rules record matches.
+// Identity fields are only filled in, so a low-quality scrape can't clobber
+// data a rep already cleaned up.
+var defaultLeadMergePolicy = map[string]string{
+	"name":      mergeFillIfEmpty,
+	"email":     mergeFillIfEmpty,
+	"company":   mergeFillIfEmpty,
+	"account":   mergeFillIfEmpty,
+	"job_title": mergeKeepNewest,
+	"phone":     mergeFillIfEmpty,
+	"linkedin":  mergeFillIfEmpty,
+}
+
+type mergeConflict struct {
+	Field    string
+	Current  string
+	Incoming string
+	Source   string
+	Strategy string
+	Reason   string
+}
+
+type fieldMeta struct {
+	Source string `json:"source"`
+	At     string `json:"at"`
+}
+
+// loadMergePolicy resolves the strategy for every merge field of the given
+// source. Source specific rules win over "*" rules, which win over the defaults.
+func loadMergePolicy(app core.App, source string) (map[string]string, error) {
+	policy := make(map[string]string, len(defaultLeadMergePolicy))
+	for k, v := range defaultLeadMergePolicy {
+		policy[k] = v
+	}
+
+	rules, err := app.FindRecordsByFilter(
+		collectionMergeRules,
+		"source='*' || source={:source}",
+		"",
+		0,
+		0,
+		dbx.Params{"source": source},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, pass := range []string{"*", source} {
+		for _, r := range rules {
+			if r.GetString("source") == pass {
+				policy[r.GetString("field")] = r.GetString("strategy")
+			}
+		}
+	}
+
+	return policy, nil
+}
+
+// applyLeadMerge sets the incoming values on lead according to policy and the
+// lead's locked fields. Values that were not applied are returned as conflicts.
+// The lead is not saved.
+func applyLeadMerge(lead *core.Record, source string, policy map[string]string, observedAt time.Time, incoming map[string]string) []mergeConflict {
+	locked := leadLockedFields(lead)
+	meta := leadFieldMeta(lead)
+	isNew := lead.IsNew()
+
+	conflicts := []mergeConflict{}
+	for _, field := range leadMergeFields {
+		value := strings.TrimSpace(incoming[field])
+		if value == "" {
+			continue
+		}
+
+		current := lead.GetString(field)
+		if current == value {
+			continue
+		}
+
+		strategy := policy[field]
+		if strategy == "" {
+			strategy = mergeFillIfEmpty
+		}
+
+		apply := isNew
+		reason := ""
+		switch {
+		case isNew:
+		case slices.Contains(locked, field):
+			reason = "locked"
+		case strategy == mergeOverwrite:
+			apply = true
+		case strategy == mergeFillIfEmpty:
+			apply = current == ""
+			reason = "existing value kept"
+		case strategy == mergeKeepNewest:
+			prev, _ := time.Parse(time.RFC3339, meta[field].At)
+			apply = current == "" || !observedAt.Before(prev)
+			reason = "existing value is newer"
+		case strategy == mergeNeverOverwrite:
+			reason = "never overwritten"
+		}
+
+		if !apply {
+			conflicts = append(conflicts, mergeConflict{
+				Field:    field,
+				Current:  current,
+				Incoming: value,
+				Source:   source,
+				Strategy: strategy,
+				Reason:   reason,
+			})
+			continue
+		}
+
+		lead.Set(field, value)
+		meta[field] = fieldMeta{Source: source, At: observedAt.UTC().Format(time.RFC3339)}
+	}
+
+	lead.Set("field_meta", meta)
+
+	return conflicts
+}
+
+// recordMergeConflicts stores the conflicts for review, skipping the ones
+// that already have an identical open entry. It returns the number of new entries.
+func recordMergeConflicts(app core.App, lead *core.Record, conflicts []mergeConflict) (int, error) {
+	if len(conflicts) == 0 {
+		return 0, nil
+	}
+
+	col, err := app.FindCollectionByNameOrId(collectionMergeConflicts)
+	if err != nil {
+		return 0, err
+	}
+
+	recorded := 0
+	for _, c := range conflicts {
+		_, err := app.FindFirstRecordByFilter(
+			collectionMergeConflicts,
+			"lead={:lead} && field={:field} && incoming_value={:incoming} && status='open'",
+			dbx.Params{"lead": lead.Id, "field": c.Field, "incoming": c.Incoming},
+		)
+		if err == nil {
+			continue
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			return recorded, err
+		}
+
+		rec := core.NewRecord(col)
+		rec.Set("lead", lead.Id)
+		rec.Set("field", c.Field)
+		rec.Set("current_value", c.Current)
+		rec.Set("incoming_value", c.Incoming)
+		rec.Set("source", c.Source)
+		rec.Set("strategy", c.Strategy)
+		rec.Set("reason", c.Reason)
+		rec.Set("status", "open")
+		copyChangeActor(lead, rec)
+		if err := app.Save(rec); err != nil {
+			return recorded, err
+		}
+		recorded++
+	}
+
+	return recorded, nil
+}
+
+// resolveMergeConflict accepts or rejects an open conflict on behalf of
+// auth. Accepting writes the incoming value and locks the field, since a
+// human has now reviewed it.
+func resolveMergeConflict(app core.App, auth *core.Record, conflictId string, accept bool) (*core.Record, error) {
+	conflict, err := app.FindRecordById(collectionMergeConflicts, conflictId)
+	if err != nil {
+		return nil, err
+	}
+	if conflict.GetString("status") != "open" {
+		return nil, errors.New("conflict is already resolved")
+	}
+
+	err = app.RunInTransaction(func(txApp core.App) error {
+		if accept {
+			lead, err := txApp.FindRecordById(collectionLeads, conflict.GetString("lead"))
+			if err != nil {
+				return err
+			}
+
+			field := conflict.GetString("field")
+			meta := leadFieldMeta(lead)
+			meta[field] = fieldMeta{Source: leadSourceManual, At: time.Now().UTC().Format(time.RFC3339)}
+
+			lead.Set(field, conflict.GetString("incoming_value"))
+			lead.Set("field_meta", meta)
+			lead.Set("locked_fields", appendUnique(leadLockedFields(lead), field))
+			setAuthChangeActor(lead, auth)
+			if err := txApp.Save(lead); err != nil {
+				return err
+			}
+			conflict.Set("status", "accepted")
+		} else {
+			conflict.Set("status", "rejected")
+		}
+		setAuthChangeActor(conflict, auth)
+		return txApp.Save(conflict)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return conflict, nil
+}
+
+func leadLockedFields(lead *core.Record) []string {
+	locked := []string{}
+	_ = lead.UnmarshalJSONField("locked_fields", &locked)
+	return locked
+}
+
+func leadFieldMeta(lead *core.Record) map[string]fieldMeta {
+	meta := map[string]fieldMeta{}
+	_ = lead.UnmarshalJSONField("field_meta", &meta)
+	if meta == nil {
+		meta = map[string]fieldMeta{}
+	}
+	return meta
+}
+
+func appendUnique(list []string, values ...string) []string {
+	for _, v := range values {
+		if !slices.Contains(list, v) {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+// bindMergeHooks locks the merge fields a user edits through the records API,
+// so later imports leave them alone. Requests that set locked_fields
+// themselves are trusted as-is (that's how a field gets unlocked).
+func bindMergeHooks(app core.App) {
+	app.OnRecordUpdateRequest(collectionLeads).BindFunc(func(e *core.RecordRequestEvent) error {
+		original := e.Record.Original()
+
+		var before, after []string
+		_ = original.UnmarshalJSONField("locked_fields", &before)
+		_ = e.Record.UnmarshalJSONField("locked_fields", &after)
+		if !slices.Equal(before, after) {
+			return e.Next()
+		}
+
+		changed := []string{}
+		for _, field := range leadMergeFields {
+			if e.Record.GetString(field) != original.GetString(field) {
+				changed = append(changed, field)
+			}
+		}
+		if len(changed) > 0 {
+			e.Record.Set("locked_fields", appendUnique(leadLockedFields(e.Record), changed...))
+
+			meta := leadFieldMeta(e.Record)
+			now := time.Now().UTC().Format(time.RFC3339)
+			for _, field := range changed {
+				meta[field] = fieldMeta{Source: leadSourceManual, At: now}
+			}
+			e.Record.Set("field_meta", meta)
+		}
+
+		return e.Next()
+	})
+}
+
+func bindMergeRoutes(grp *router.RouterGroup[*core.RequestEvent]) {
+	grp.GET("/merge/conflicts", func(e *core.RequestEvent) error {
+		q := e.Request.URL.Query()
+
+		status := strings.TrimSpace(q.Get("status"))
+		if status == "" {
+			status = "open"
+		}
+		filter := "status={:status}"
+		params := dbx.Params{"status": status}
+		if lead := strings.TrimSpace(q.Get("lead")); lead != "" {
+			filter += " && lead={:lead}"
+			params["lead"] = lead
+		}
+
+		limit := 100
+		if raw := q.Get("limit"); raw != "" {
+			v, convErr := strconv.Atoi(raw)
+			if convErr != nil || v <= 0 {
+				return e.BadRequestError("Invalid limit.", convErr)
+			}
+			limit = min(v, 500)
+		}
+
+		items, err := e.App.FindRecordsByFilter(collectionMergeConflicts, filter, "-created", limit, 0, params)
+		if err != nil {
+			return e.InternalServerError("Failed to list merge conflicts.", err)
+		}
+		return e.JSON(http.StatusOK, map[string]any{"items": items})
+	}).Bind(requireCRMRole())
+
+	grp.POST("/merge/conflicts/{id}/resolve", func(e *core.RequestEvent) error {
+		var body struct {
+			Action string `json:"action"`
+		}
+		if err := e.BindBody(&body); err != nil {
+			return e.BadRequestError("Invalid body.", err)
+		}
+		if body.Action != "accept" && body.Action != "reject" {
+			return e.BadRequestError("action must be accept or reject.", nil)
+		}
+
+		conflict, err := resolveMergeConflict(e.App, e.Auth, e.Request.PathValue("id"), body.Action == "accept")
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return e.NotFoundError("Conflict not found.", err)
+			}
+			return e.BadRequestError("Failed to resolve conflict.", err)
+		}
+		return e.JSON(http.StatusOK, conflict)
+	}).Bind(requireCRMRole())
+}
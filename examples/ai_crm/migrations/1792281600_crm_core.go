@@ -0,0 +1,111 @@
+package migrations
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+)
+
+// Creates (or upgrades in place) crm_accounts, crm_leads, crm_deals and
+// crm_activities, replacing the former ensure*Collection bootstrap code.
+func init() {
+	m.Register(func(app core.App) error {
+		accounts, err := findOrNewBaseCollection(app, "crm_accounts")
+		if err != nil {
+			return err
+		}
+		setSuperuserOnlyRules(accounts)
+		accounts.Fields.Add(
+			&core.TextField{Name: "name", Required: true, Presentable: true, Max: 255},
+			&core.TextField{Name: "domain", Max: 255},
+			&core.TextField{Name: "website", Max: 1024},
+			&core.TextField{Name: "linkedin", Max: 1024},
+			&core.TextField{Name: "industry", Max: 255},
+			&core.TextField{Name: "address", Max: 1024},
+			&core.TextField{Name: "city", Max: 255},
+			&core.TextField{Name: "country", Max: 100},
+			&core.TextField{Name: "employee_range", Max: 50},
+			&core.NumberField{Name: "source_rating", Min: floatPointer(0), Max: floatPointer(5)},
+			&core.TextField{Name: "notes"},
+			&core.AutodateField{Name: "created", OnCreate: true},
+			&core.AutodateField{Name: "updated", OnCreate: true, OnUpdate: true},
+		)
+		accounts.AddIndex("idx_crm_accounts_domain", false, "domain", "")
+		accounts.AddIndex("idx_crm_accounts_name", false, "name", "")
+		if err := app.Save(accounts); err != nil {
+			return err
+		}
+
+		leads, err := findOrNewBaseCollection(app, "crm_leads")
+		if err != nil {
+			return err
+		}
+		setSuperuserOnlyRules(leads)
+		leads.Fields.Add(
+			&core.TextField{Name: "name", Required: true, Presentable: true, Max: 255},
+			&core.EmailField{Name: "email"},
+			&core.TextField{Name: "company", Max: 255},
+			&core.RelationField{Name: "account", CollectionId: accounts.Id, MaxSelect: 1},
+			&core.TextField{Name: "job_title", Max: 255},
+			&core.TextField{Name: "phone", Max: 255},
+			&core.TextField{Name: "phone_raw", Max: 255},
+			&core.TextField{Name: "linkedin", Max: 1024},
+			&core.SelectField{Name: "contact_flags", MaxSelect: 6, Values: []string{
+				"email_role_based", "email_disposable", "email_free_mail", "email_invalid", "phone_invalid", "linkedin_invalid",
+			}},
+			&core.SelectField{Name: "stage", Required: true, Values: []string{"new", "outreached", "replied", "qualified", "proposal", "won", "lost"}},
+			&core.NumberField{Name: "score", Min: floatPointer(0), Max: floatPointer(100)},
+			&core.DateField{Name: "last_contacted"},
+			&core.JSONField{Name: "agent_state"},
+			&core.JSONField{Name: "locked_fields"},
+			&core.JSONField{Name: "field_meta"},
+			&core.AutodateField{Name: "created", OnCreate: true},
+			&core.AutodateField{Name: "updated", OnCreate: true, OnUpdate: true},
+		)
+		leads.AddIndex("idx_crm_leads_email", false, "email", "")
+		leads.AddIndex("idx_crm_leads_account", false, "account", "")
+		leads.AddIndex("idx_crm_leads_stage", false, "stage", "")
+		if err := app.Save(leads); err != nil {
+			return err
+		}
+
+		deals, err := findOrNewBaseCollection(app, "crm_deals")
+		if err != nil {
+			return err
+		}
+		setSuperuserOnlyRules(deals)
+		deals.Fields.Add(
+			&core.TextField{Name: "title", Required: true, Presentable: true, Max: 255},
+			&core.RelationField{Name: "lead", CollectionId: leads.Id, MaxSelect: 1, Required: true},
+			&core.SelectField{Name: "stage", Required: true, Values: []string{"qualification", "proposal", "negotiation", "won", "lost"}},
+			&core.NumberField{Name: "amount"},
+			&core.DateField{Name: "close_date"},
+			&core.AutodateField{Name: "created", OnCreate: true},
+			&core.AutodateField{Name: "updated", OnCreate: true, OnUpdate: true},
+		)
+		deals.AddIndex("idx_crm_deals_lead", false, "lead", "")
+		deals.AddIndex("idx_crm_deals_stage", false, "stage", "")
+		if err := app.Save(deals); err != nil {
+			return err
+		}
+
+		activities, err := findOrNewBaseCollection(app, "crm_activities")
+		if err != nil {
+			return err
+		}
+		setSuperuserOnlyRules(activities)
+		activities.Fields.Add(
+			&core.SelectField{Name: "type", Required: true, Values: []string{"outreach_email", "outreach_call", "meeting", "note", "status_change"}},
+			&core.RelationField{Name: "lead", CollectionId: leads.Id, MaxSelect: 1, Required: true},
+			&core.RelationField{Name: "deal", CollectionId: deals.Id, MaxSelect: 1},
+			&core.TextField{Name: "content", Max: 5000},
+			&core.JSONField{Name: "metadata"},
+			&core.AutodateField{Name: "created", OnCreate: true},
+			&core.AutodateField{Name: "updated", OnCreate: true, OnUpdate: true},
+		)
+		activities.AddIndex("idx_crm_activities_lead", false, "lead", "")
+		activities.AddIndex("idx_crm_activities_deal", false, "deal", "")
+		return app.Save(activities)
+	}, func(app core.App) error {
+		return deleteCollections(app, "crm_activities", "crm_deals", "crm_leads", "crm_accounts")
+	})
+}
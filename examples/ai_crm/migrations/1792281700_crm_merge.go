@@ -0,0 +1,78 @@
+package migrations
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+)
+
+// Creates the import merge policy (crm_merge_rules), its review queue
+// (crm_merge_conflicts) and the duplicate merge audit trail (crm_merge_log).
+func init() {
+	m.Register(func(app core.App) error {
+		leads, err := app.FindCollectionByNameOrId("crm_leads")
+		if err != nil {
+			return err
+		}
+
+		rules, err := findOrNewBaseCollection(app, "crm_merge_rules")
+		if err != nil {
+			return err
+		}
+		setSuperuserOnlyRules(rules)
+		rules.Fields.Add(
+			&core.TextField{Name: "source", Required: true, Max: 100},
+			&core.SelectField{Name: "field", Required: true, Values: []string{"name", "email", "company", "account", "job_title", "phone", "linkedin"}},
+			&core.SelectField{Name: "strategy", Required: true, Values: []string{"overwrite", "fill_if_empty", "keep_newest", "never_overwrite"}},
+			&core.AutodateField{Name: "created", OnCreate: true},
+			&core.AutodateField{Name: "updated", OnCreate: true, OnUpdate: true},
+		)
+		rules.AddIndex("idx_crm_merge_rules_source_field", true, "source, field", "")
+		if err := app.Save(rules); err != nil {
+			return err
+		}
+
+		conflicts, err := findOrNewBaseCollection(app, "crm_merge_conflicts")
+		if err != nil {
+			return err
+		}
+		setSuperuserOnlyRules(conflicts)
+		conflicts.Fields.Add(
+			&core.RelationField{Name: "lead", CollectionId: leads.Id, MaxSelect: 1, Required: true, CascadeDelete: true},
+			&core.TextField{Name: "field", Required: true, Max: 100},
+			&core.TextField{Name: "current_value", Max: 2048},
+			&core.TextField{Name: "incoming_value", Max: 2048},
+			&core.TextField{Name: "source", Max: 100},
+			&core.TextField{Name: "strategy", Max: 100},
+			&core.TextField{Name: "reason", Max: 255},
+			&core.SelectField{Name: "status", Required: true, Values: []string{"open", "accepted", "rejected"}},
+			&core.AutodateField{Name: "created", OnCreate: true},
+			&core.AutodateField{Name: "updated", OnCreate: true, OnUpdate: true},
+		)
+		conflicts.AddIndex("idx_crm_merge_conflicts_lead_status", false, "lead, status", "")
+		if err := app.Save(conflicts); err != nil {
+			return err
+		}
+
+		mergeLog, err := findOrNewBaseCollection(app, "crm_merge_log")
+		if err != nil {
+			return err
+		}
+		mergeLog.ListRule = superuserOnlyRule()
+		mergeLog.ViewRule = superuserOnlyRule()
+		mergeLog.CreateRule = nil
+		mergeLog.UpdateRule = nil
+		mergeLog.DeleteRule = nil
+		mergeLog.Fields.Add(
+			&core.SelectField{Name: "entity", Required: true, Values: []string{"lead", "account"}},
+			&core.TextField{Name: "survivor", Required: true, Max: 50},
+			&core.JSONField{Name: "merged_ids"},
+			&core.JSONField{Name: "snapshots"},
+			&core.JSONField{Name: "repointed"},
+			&core.TextField{Name: "actor", Max: 255},
+			&core.AutodateField{Name: "created", OnCreate: true},
+		)
+		return app.Save(mergeLog)
+	}, func(app core.App) error {
+		return deleteCollections(app, "crm_merge_log", "crm_merge_conflicts", "crm_merge_rules")
+	})
+}
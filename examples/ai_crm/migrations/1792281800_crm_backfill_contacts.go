@@ -0,0 +1,34 @@
+package migrations
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+)
+
+// Backfills records written before the save hooks normalized them: lowercases
+// lead emails, strips scheme and "www." from account domains and defaults
+// empty lead stages to "new". Phones and LinkedIn URLs need the Go
+// normalizers, so they are left to POST /api/ai-crm/normalize/leads.
+//
+// The down migration is a no-op since the original values are not kept.
+func init() {
+	m.Register(func(app core.App) error {
+		queries := []string{
+			`UPDATE {{crm_leads}} SET [[email]] = lower(trim([[email]])) WHERE [[email]] != lower(trim([[email]]))`,
+			`UPDATE {{crm_leads}} SET [[stage]] = 'new' WHERE [[stage]] = '' OR [[stage]] IS NULL`,
+			`UPDATE {{crm_accounts}} SET [[domain]] = lower(trim([[domain]])) WHERE [[domain]] != lower(trim([[domain]]))`,
+			`UPDATE {{crm_accounts}} SET [[domain]] = substr([[domain]], 9) WHERE [[domain]] LIKE 'https://%'`,
+			`UPDATE {{crm_accounts}} SET [[domain]] = substr([[domain]], 8) WHERE [[domain]] LIKE 'http://%'`,
+			`UPDATE {{crm_accounts}} SET [[domain]] = substr([[domain]], 5) WHERE [[domain]] LIKE 'www.%'`,
+			`UPDATE {{crm_accounts}} SET [[domain]] = rtrim([[domain]], '/') WHERE [[domain]] LIKE '%/'`,
+		}
+		for _, q := range queries {
+			if _, err := app.DB().NewQuery(q).Execute(); err != nil {
+				return err
+			}
+		}
+		return nil
+	}, func(app core.App) error {
+		return nil
+	})
+}
@@ -0,0 +1,68 @@
+package migrations
+
+import (
+	"strings"
+
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+)
+
+// Creates crm_custom_fields, the registry of user-defined fields, and
+// crm_outreach_templates, which override the agent's built-in messages.
+//
+// The custom fields themselves are added to (and removed from) the target
+// collections at runtime by the crm_custom_fields record hooks, so the down
+// migration drops every "cf_" field before removing the registry.
+func init() {
+	m.Register(func(app core.App) error {
+		defs, err := findOrNewBaseCollection(app, "crm_custom_fields")
+		if err != nil {
+			return err
+		}
+		setSuperuserOnlyRules(defs)
+		defs.Fields.Add(
+			&core.SelectField{Name: "collection", Required: true, Values: []string{"crm_leads", "crm_accounts", "crm_deals"}},
+			&core.TextField{Name: "name", Required: true, Presentable: true, Min: 2, Max: 40, Pattern: `^[a-z][a-z0-9_]*$`},
+			&core.TextField{Name: "label", Max: 255},
+			&core.SelectField{Name: "type", Required: true, Values: []string{"text", "number", "select", "date", "bool"}},
+			&core.JSONField{Name: "options"},
+			&core.AutodateField{Name: "created", OnCreate: true},
+			&core.AutodateField{Name: "updated", OnCreate: true, OnUpdate: true},
+		)
+		defs.AddIndex("idx_crm_custom_fields_collection_name", true, "collection, name", "")
+		if err := app.Save(defs); err != nil {
+			return err
+		}
+
+		templates, err := findOrNewBaseCollection(app, "crm_outreach_templates")
+		if err != nil {
+			return err
+		}
+		setSuperuserOnlyRules(templates)
+		templates.Fields.Add(
+			&core.SelectField{Name: "action", Required: true, Values: []string{"draft_outreach", "follow_up", "qualify", "proposal", "close"}},
+			&core.TextField{Name: "body", Required: true, Max: 5000},
+			&core.BoolField{Name: "active"},
+			&core.AutodateField{Name: "created", OnCreate: true},
+			&core.AutodateField{Name: "updated", OnCreate: true, OnUpdate: true},
+		)
+		return app.Save(templates)
+	}, func(app core.App) error {
+		for _, name := range []string{"crm_leads", "crm_accounts", "crm_deals"} {
+			col, err := app.FindCollectionByNameOrId(name)
+			if err != nil {
+				return err
+			}
+			custom := []string{}
+			for _, f := range col.Fields {
+				if strings.HasPrefix(f.GetName(), "cf_") {
+					custom = append(custom, f.GetName())
+				}
+			}
+			if err := removeFields(app, name, custom...); err != nil {
+				return err
+			}
+		}
+		return deleteCollections(app, "crm_outreach_templates", "crm_custom_fields")
+	})
+}
@@ -0,0 +1,64 @@
+package migrations
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+)
+
+// Creates crm_tags with a multi "tags" relation on leads, accounts and deals,
+// and crm_segments, the saved filters with their last evaluated membership.
+func init() {
+	m.Register(func(app core.App) error {
+		tags, err := findOrNewBaseCollection(app, "crm_tags")
+		if err != nil {
+			return err
+		}
+		setSuperuserOnlyRules(tags)
+		tags.Fields.Add(
+			&core.TextField{Name: "name", Required: true, Presentable: true, Max: 60},
+			&core.TextField{Name: "color", Max: 20},
+			&core.AutodateField{Name: "created", OnCreate: true},
+			&core.AutodateField{Name: "updated", OnCreate: true, OnUpdate: true},
+		)
+		tags.AddIndex("idx_crm_tags_name", true, "name COLLATE NOCASE", "")
+		if err := app.Save(tags); err != nil {
+			return err
+		}
+
+		for _, name := range []string{"crm_leads", "crm_accounts", "crm_deals"} {
+			col, err := app.FindCollectionByNameOrId(name)
+			if err != nil {
+				return err
+			}
+			col.Fields.Add(&core.RelationField{Name: "tags", CollectionId: tags.Id, MaxSelect: 100})
+			if err := app.Save(col); err != nil {
+				return err
+			}
+		}
+
+		segments, err := findOrNewBaseCollection(app, "crm_segments")
+		if err != nil {
+			return err
+		}
+		setSuperuserOnlyRules(segments)
+		segments.Fields.Add(
+			&core.TextField{Name: "name", Required: true, Presentable: true, Max: 120},
+			&core.SelectField{Name: "collection", Required: true, Values: []string{"crm_leads", "crm_accounts", "crm_deals"}},
+			&core.TextField{Name: "filter", Max: 2000},
+			&core.NumberField{Name: "member_count", Min: floatPointer(0), OnlyInt: true},
+			&core.JSONField{Name: "member_ids", MaxSize: 5 << 20},
+			&core.DateField{Name: "evaluated_at"},
+			&core.AutodateField{Name: "created", OnCreate: true},
+			&core.AutodateField{Name: "updated", OnCreate: true, OnUpdate: true},
+		)
+		segments.AddIndex("idx_crm_segments_name", true, "name", "")
+		return app.Save(segments)
+	}, func(app core.App) error {
+		for _, name := range []string{"crm_leads", "crm_accounts", "crm_deals"} {
+			if err := removeFields(app, name, "tags"); err != nil {
+				return err
+			}
+		}
+		return deleteCollections(app, "crm_segments", "crm_tags")
+	})
+}
@@ -0,0 +1,81 @@
+package migrations
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+)
+
+// Creates crm_users (the reps records are assigned to), adds an "owner"
+// relation to leads, deals and activities and creates crm_assignment_rules,
+// which route new leads to owners.
+func init() {
+	m.Register(func(app core.App) error {
+		users, err := findOrNewAuthCollection(app, "crm_users")
+		if err != nil {
+			return err
+		}
+		setSuperuserOnlyRules(users)
+		users.Fields.Add(
+			&core.TextField{Name: "name", Required: true, Presentable: true, Max: 255},
+			&core.NumberField{Name: "assignment_weight", Min: floatPointer(0), Max: floatPointer(100)},
+			&core.BoolField{Name: "out_of_office"},
+			&core.AutodateField{Name: "created", OnCreate: true},
+			&core.AutodateField{Name: "updated", OnCreate: true, OnUpdate: true},
+		)
+		if err := app.Save(users); err != nil {
+			return err
+		}
+
+		for _, name := range []string{"crm_leads", "crm_deals", "crm_activities"} {
+			col, err := app.FindCollectionByNameOrId(name)
+			if err != nil {
+				return err
+			}
+			col.Fields.Add(&core.RelationField{Name: "owner", CollectionId: users.Id, MaxSelect: 1})
+			col.AddIndex("idx_"+name+"_owner", false, "owner", "")
+			if err := app.Save(col); err != nil {
+				return err
+			}
+		}
+
+		segments, err := app.FindCollectionByNameOrId("crm_segments")
+		if err != nil {
+			return err
+		}
+
+		rules, err := findOrNewBaseCollection(app, "crm_assignment_rules")
+		if err != nil {
+			return err
+		}
+		setSuperuserOnlyRules(rules)
+		rules.Fields.Add(
+			&core.TextField{Name: "name", Required: true, Presentable: true, Max: 120},
+			&core.SelectField{Name: "strategy", Required: true, Values: []string{"round_robin", "weighted", "territory", "segment"}},
+			&core.NumberField{Name: "priority", OnlyInt: true},
+			&core.BoolField{Name: "active"},
+			&core.RelationField{Name: "users", CollectionId: users.Id, MaxSelect: 100, Required: true},
+			&core.JSONField{Name: "territories"},
+			&core.RelationField{Name: "segment", CollectionId: segments.Id, MaxSelect: 1, CascadeDelete: true},
+			&core.JSONField{Name: "state"},
+			&core.AutodateField{Name: "created", OnCreate: true},
+			&core.AutodateField{Name: "updated", OnCreate: true, OnUpdate: true},
+		)
+		return app.Save(rules)
+	}, func(app core.App) error {
+		if err := deleteCollections(app, "crm_assignment_rules"); err != nil {
+			return err
+		}
+		for _, name := range []string{"crm_leads", "crm_deals", "crm_activities"} {
+			col, err := app.FindCollectionByNameOrId(name)
+			if err != nil {
+				return err
+			}
+			col.RemoveIndex("idx_" + name + "_owner")
+			col.Fields.RemoveByName("owner")
+			if err := app.Save(col); err != nil {
+				return err
+			}
+		}
+		return deleteCollections(app, "crm_users")
+	})
+}
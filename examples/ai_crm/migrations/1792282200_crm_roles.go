@@ -0,0 +1,136 @@
+package migrations
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+// Adds crm_teams and the admin/manager/rep role of crm_users, and replaces
+// the superuser-only API rules of the CRM collections with role based ones.
+// Superusers keep full access everywhere.
+//
+// Reps and managers see leads, deals and activities they own or their team
+// owns; managers also see unassigned ones, can hand records over and delete
+// them. Reps can't give records to someone else. Configuration collections
+// are readable by every CRM user and writable by admins only.
+func init() {
+	const (
+		superuser = "@request.auth.collectionName = '_superusers'"
+		crmUser   = "@request.auth.collectionName = 'crm_users'"
+	)
+	var (
+		admin     = "(" + superuser + " || (" + crmUser + " && @request.auth.role = 'admin'))"
+		manager   = "(" + admin + " || (" + crmUser + " && @request.auth.role = 'manager'))"
+		anyone    = "(" + superuser + " || " + crmUser + ")"
+		sameTeam  = "(@request.auth.team != '' && owner.team = @request.auth.team)"
+		owned     = "(" + admin + " || (" + crmUser + " && (owner = @request.auth.id || " + sameTeam + " || (@request.auth.role = 'manager' && owner = ''))))"
+		keepOwner = "(" + manager + " || @request.body.owner:isset = false || @request.body.owner = '' || @request.body.owner = @request.auth.id)"
+	)
+
+	setRules := func(col *core.Collection, list, create, update, del string) {
+		col.ListRule = types.Pointer(list)
+		col.ViewRule = types.Pointer(list)
+		col.CreateRule = types.Pointer(create)
+		col.UpdateRule = types.Pointer(update)
+		col.DeleteRule = types.Pointer(del)
+	}
+
+	m.Register(func(app core.App) error {
+		teams, err := findOrNewBaseCollection(app, "crm_teams")
+		if err != nil {
+			return err
+		}
+		setRules(teams, anyone, admin, admin, admin)
+		teams.Fields.Add(
+			&core.TextField{Name: "name", Required: true, Presentable: true, Max: 120},
+			&core.AutodateField{Name: "created", OnCreate: true},
+			&core.AutodateField{Name: "updated", OnCreate: true, OnUpdate: true},
+		)
+		teams.AddIndex("idx_crm_teams_name", true, "name", "")
+		if err := app.Save(teams); err != nil {
+			return err
+		}
+
+		users, err := app.FindCollectionByNameOrId("crm_users")
+		if err != nil {
+			return err
+		}
+		// users may toggle their own out_of_office, nothing that grants access
+		setRules(users, anyone, admin, admin+" || (id = @request.auth.id && @request.body.role:isset = false && @request.body.team:isset = false && @request.body.assignment_weight:isset = false)", admin)
+		users.ManageRule = types.Pointer(admin)
+		users.Fields.Add(
+			&core.SelectField{Name: "role", Required: true, Values: []string{"admin", "manager", "rep"}},
+			&core.RelationField{Name: "team", CollectionId: teams.Id, MaxSelect: 1},
+		)
+		if err := app.Save(users); err != nil {
+			return err
+		}
+
+		rules := map[string][4]string{
+			"crm_leads":              {owned, anyone + " && " + keepOwner, owned + " && " + keepOwner, manager + " && " + owned},
+			"crm_deals":              {owned, anyone + " && " + keepOwner, owned + " && " + keepOwner, manager + " && " + owned},
+			"crm_activities":         {owned, anyone + " && " + keepOwner, owned + " && " + keepOwner, manager + " && " + owned},
+			"crm_accounts":           {anyone, anyone, anyone, manager},
+			"crm_tags":               {anyone, anyone, manager, manager},
+			"crm_segments":           {anyone, manager, manager, manager},
+			"crm_custom_fields":      {anyone, admin, admin, admin},
+			"crm_outreach_templates": {anyone, admin, admin, admin},
+			"crm_assignment_rules":   {manager, admin, admin, admin},
+			"crm_merge_rules":        {admin, admin, admin, admin},
+			"crm_merge_conflicts":    {admin, admin, admin, admin},
+		}
+		for name, r := range rules {
+			col, err := app.FindCollectionByNameOrId(name)
+			if err != nil {
+				return err
+			}
+			setRules(col, r[0], r[1], r[2], r[3])
+			if err := app.Save(col); err != nil {
+				return err
+			}
+		}
+
+		// the merge log stays append-only
+		mergeLog, err := app.FindCollectionByNameOrId("crm_merge_log")
+		if err != nil {
+			return err
+		}
+		mergeLog.ListRule = types.Pointer(admin)
+		mergeLog.ViewRule = types.Pointer(admin)
+		return app.Save(mergeLog)
+	}, func(app core.App) error {
+		for _, name := range []string{
+			"crm_leads", "crm_deals", "crm_activities", "crm_accounts", "crm_tags", "crm_segments",
+			"crm_custom_fields", "crm_outreach_templates", "crm_assignment_rules", "crm_merge_rules",
+			"crm_merge_conflicts", "crm_users",
+		} {
+			col, err := app.FindCollectionByNameOrId(name)
+			if err != nil {
+				return err
+			}
+			setSuperuserOnlyRules(col)
+			if col.IsAuth() {
+				col.ManageRule = nil
+			}
+			if err := app.Save(col); err != nil {
+				return err
+			}
+		}
+
+		mergeLog, err := app.FindCollectionByNameOrId("crm_merge_log")
+		if err != nil {
+			return err
+		}
+		mergeLog.ListRule = superuserOnlyRule()
+		mergeLog.ViewRule = superuserOnlyRule()
+		if err := app.Save(mergeLog); err != nil {
+			return err
+		}
+
+		if err := removeFields(app, "crm_users", "role", "team"); err != nil {
+			return err
+		}
+		return deleteCollections(app, "crm_teams")
+	})
+}
@@ -0,0 +1,70 @@
+package migrations
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+// Creates crm_tasks, the to-dos for humans (agent suggested or manual) with
+// their reminder bookkeeping. Tasks are scoped by assignee the same way
+// owned records are scoped by owner.
+func init() {
+	const (
+		superuser = "@request.auth.collectionName = '_superusers'"
+		crmUser   = "@request.auth.collectionName = 'crm_users'"
+	)
+	var (
+		admin    = "(" + superuser + " || (" + crmUser + " && @request.auth.role = 'admin'))"
+		manager  = "(" + admin + " || (" + crmUser + " && @request.auth.role = 'manager'))"
+		anyone   = "(" + superuser + " || " + crmUser + ")"
+		assigned = "(" + admin + " || (" + crmUser + " && (assignee = @request.auth.id || (@request.auth.team != '' && assignee.team = @request.auth.team) || (@request.auth.role = 'manager' && assignee = ''))))"
+	)
+
+	m.Register(func(app core.App) error {
+		users, err := app.FindCollectionByNameOrId("crm_users")
+		if err != nil {
+			return err
+		}
+		leads, err := app.FindCollectionByNameOrId("crm_leads")
+		if err != nil {
+			return err
+		}
+		deals, err := app.FindCollectionByNameOrId("crm_deals")
+		if err != nil {
+			return err
+		}
+
+		tasks, err := findOrNewBaseCollection(app, "crm_tasks")
+		if err != nil {
+			return err
+		}
+		tasks.ListRule = types.Pointer(assigned)
+		tasks.ViewRule = types.Pointer(assigned)
+		tasks.CreateRule = types.Pointer(anyone)
+		tasks.UpdateRule = types.Pointer(assigned)
+		tasks.DeleteRule = types.Pointer(manager + " && " + assigned)
+		tasks.Fields.Add(
+			&core.TextField{Name: "title", Required: true, Presentable: true, Max: 255},
+			&core.TextField{Name: "description", Max: 5000},
+			&core.DateField{Name: "due_at"},
+			&core.RelationField{Name: "assignee", CollectionId: users.Id, MaxSelect: 1},
+			&core.SelectField{Name: "priority", Required: true, Values: []string{"low", "normal", "high", "urgent"}},
+			&core.SelectField{Name: "status", Required: true, Values: []string{"open", "done", "cancelled"}},
+			&core.RelationField{Name: "lead", CollectionId: leads.Id, MaxSelect: 1, CascadeDelete: true},
+			&core.RelationField{Name: "deal", CollectionId: deals.Id, MaxSelect: 1, CascadeDelete: true},
+			&core.SelectField{Name: "source", Values: []string{"agent", "manual"}},
+			&core.DateField{Name: "completed_at"},
+			&core.DateField{Name: "due_reminded_at"},
+			&core.DateField{Name: "overdue_reminded_at"},
+			&core.AutodateField{Name: "created", OnCreate: true},
+			&core.AutodateField{Name: "updated", OnCreate: true, OnUpdate: true},
+		)
+		tasks.AddIndex("idx_crm_tasks_assignee_status", false, "assignee, status", "")
+		tasks.AddIndex("idx_crm_tasks_status_due", false, "status, due_at", "")
+		tasks.AddIndex("idx_crm_tasks_lead", false, "lead", "")
+		return app.Save(tasks)
+	}, func(app core.App) error {
+		return deleteCollections(app, "crm_tasks")
+	})
+}
@@ -0,0 +1,95 @@
+package migrations
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+// Creates the product catalog (crm_products) and deal line items
+// (crm_deal_line_items), and adds the tax and gross totals next to the deal
+// amount, which the line item hooks keep in sync.
+func init() {
+	const (
+		superuser = "@request.auth.collectionName = '_superusers'"
+		crmUser   = "@request.auth.collectionName = 'crm_users'"
+	)
+	var (
+		admin     = "(" + superuser + " || (" + crmUser + " && @request.auth.role = 'admin'))"
+		anyone    = "(" + superuser + " || " + crmUser + ")"
+		dealOwned = "(" + admin + " || (" + crmUser + " && (deal.owner = @request.auth.id || (@request.auth.team != '' && deal.owner.team = @request.auth.team) || (@request.auth.role = 'manager' && deal.owner = ''))))"
+	)
+
+	m.Register(func(app core.App) error {
+		products, err := findOrNewBaseCollection(app, "crm_products")
+		if err != nil {
+			return err
+		}
+		products.ListRule = types.Pointer(anyone)
+		products.ViewRule = types.Pointer(anyone)
+		products.CreateRule = types.Pointer(admin)
+		products.UpdateRule = types.Pointer(admin)
+		products.DeleteRule = types.Pointer(admin)
+		products.Fields.Add(
+			&core.TextField{Name: "name", Required: true, Presentable: true, Max: 255},
+			&core.TextField{Name: "sku", Max: 100},
+			&core.TextField{Name: "description", Max: 5000},
+			&core.NumberField{Name: "unit_price", Min: floatPointer(0)},
+			&core.NumberField{Name: "tax_percent", Min: floatPointer(0), Max: floatPointer(100)},
+			&core.BoolField{Name: "active"},
+			&core.AutodateField{Name: "created", OnCreate: true},
+			&core.AutodateField{Name: "updated", OnCreate: true, OnUpdate: true},
+		)
+		products.AddIndex("idx_crm_products_sku", true, "sku", "sku != ''")
+		if err := app.Save(products); err != nil {
+			return err
+		}
+
+		deals, err := app.FindCollectionByNameOrId("crm_deals")
+		if err != nil {
+			return err
+		}
+		deals.Fields.Add(
+			&core.NumberField{Name: "tax_amount"},
+			&core.NumberField{Name: "total_amount"},
+		)
+		if err := app.Save(deals); err != nil {
+			return err
+		}
+
+		items, err := findOrNewBaseCollection(app, "crm_deal_line_items")
+		if err != nil {
+			return err
+		}
+		items.ListRule = types.Pointer(dealOwned)
+		items.ViewRule = types.Pointer(dealOwned)
+		items.CreateRule = types.Pointer(dealOwned)
+		items.UpdateRule = types.Pointer(dealOwned)
+		items.DeleteRule = types.Pointer(dealOwned)
+		items.Fields.Add(
+			&core.RelationField{Name: "deal", CollectionId: deals.Id, MaxSelect: 1, Required: true, CascadeDelete: true},
+			&core.RelationField{Name: "product", CollectionId: products.Id, MaxSelect: 1},
+			&core.TextField{Name: "description", Max: 1000},
+			&core.NumberField{Name: "quantity", Min: floatPointer(0)},
+			&core.NumberField{Name: "unit_price", Min: floatPointer(0)},
+			&core.NumberField{Name: "discount_percent", Min: floatPointer(0), Max: floatPointer(100)},
+			&core.NumberField{Name: "tax_percent", Min: floatPointer(0), Max: floatPointer(100)},
+			&core.NumberField{Name: "subtotal"},
+			&core.NumberField{Name: "tax_amount"},
+			&core.NumberField{Name: "total"},
+			&core.AutodateField{Name: "created", OnCreate: true},
+			&core.AutodateField{Name: "updated", OnCreate: true, OnUpdate: true},
+		)
+		items.AddIndex("idx_crm_deal_line_items_deal", false, "deal", "")
+		items.AddIndex("idx_crm_deal_line_items_product", false, "product", "")
+		return app.Save(items)
+	}, func(app core.App) error {
+		if err := deleteCollections(app, "crm_deal_line_items"); err != nil {
+			return err
+		}
+		if err := removeFields(app, "crm_deals", "tax_amount", "total_amount"); err != nil {
+			return err
+		}
+		return deleteCollections(app, "crm_products")
+	})
+}
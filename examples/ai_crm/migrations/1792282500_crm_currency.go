@@ -0,0 +1,56 @@
+package migrations
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+// Adds a currency to deals and creates crm_exchange_rates, the dated rates
+// used to convert deal amounts into the base currency.
+func init() {
+	const (
+		superuser = "@request.auth.collectionName = '_superusers'"
+		crmUser   = "@request.auth.collectionName = 'crm_users'"
+	)
+	var (
+		admin  = "(" + superuser + " || (" + crmUser + " && @request.auth.role = 'admin'))"
+		anyone = "(" + superuser + " || " + crmUser + ")"
+	)
+
+	m.Register(func(app core.App) error {
+		deals, err := app.FindCollectionByNameOrId("crm_deals")
+		if err != nil {
+			return err
+		}
+		deals.Fields.Add(&core.TextField{Name: "currency", Max: 3, Pattern: `^[A-Z]{3}$`})
+		if err := app.Save(deals); err != nil {
+			return err
+		}
+
+		rates, err := findOrNewBaseCollection(app, "crm_exchange_rates")
+		if err != nil {
+			return err
+		}
+		rates.ListRule = types.Pointer(anyone)
+		rates.ViewRule = types.Pointer(anyone)
+		rates.CreateRule = types.Pointer(admin)
+		rates.UpdateRule = types.Pointer(admin)
+		rates.DeleteRule = types.Pointer(admin)
+		rates.Fields.Add(
+			&core.TextField{Name: "from_currency", Required: true, Max: 3, Pattern: `^[A-Z]{3}$`},
+			&core.TextField{Name: "to_currency", Required: true, Max: 3, Pattern: `^[A-Z]{3}$`},
+			&core.NumberField{Name: "rate", Required: true, Min: floatPointer(0)},
+			&core.DateField{Name: "effective_date", Required: true},
+			&core.AutodateField{Name: "created", OnCreate: true},
+			&core.AutodateField{Name: "updated", OnCreate: true, OnUpdate: true},
+		)
+		rates.AddIndex("idx_crm_exchange_rates_pair_date", true, "from_currency, to_currency, effective_date", "")
+		return app.Save(rates)
+	}, func(app core.App) error {
+		if err := deleteCollections(app, "crm_exchange_rates"); err != nil {
+			return err
+		}
+		return removeFields(app, "crm_deals", "currency")
+	})
+}
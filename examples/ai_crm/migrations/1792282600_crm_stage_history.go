@@ -0,0 +1,58 @@
+package migrations
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+// Creates crm_stage_history, one entry per stage transition of a lead or a
+// deal. Entries are written by the record hooks only, so the collection is
+// read-only through the API and visible to whoever may see the record.
+func init() {
+	const (
+		superuser = "@request.auth.collectionName = '_superusers'"
+		crmUser   = "@request.auth.collectionName = 'crm_users'"
+	)
+	var (
+		admin   = "(" + superuser + " || (" + crmUser + " && @request.auth.role = 'admin'))"
+		ownedBy = func(rel string) string {
+			return "(" + rel + " != '' && (" + rel + ".owner = @request.auth.id || (@request.auth.team != '' && " + rel + ".owner.team = @request.auth.team) || (@request.auth.role = 'manager' && " + rel + ".owner = '')))"
+		}
+		visible = "(" + admin + " || (" + crmUser + " && (" + ownedBy("lead") + " || " + ownedBy("deal") + ")))"
+	)
+
+	m.Register(func(app core.App) error {
+		leads, err := app.FindCollectionByNameOrId("crm_leads")
+		if err != nil {
+			return err
+		}
+		deals, err := app.FindCollectionByNameOrId("crm_deals")
+		if err != nil {
+			return err
+		}
+
+		history, err := findOrNewBaseCollection(app, "crm_stage_history")
+		if err != nil {
+			return err
+		}
+		setSuperuserOnlyRules(history)
+		history.ListRule = types.Pointer(visible)
+		history.ViewRule = types.Pointer(visible)
+		history.Fields.Add(
+			&core.RelationField{Name: "lead", CollectionId: leads.Id, MaxSelect: 1, CascadeDelete: true},
+			&core.RelationField{Name: "deal", CollectionId: deals.Id, MaxSelect: 1, CascadeDelete: true},
+			&core.TextField{Name: "from_stage", Max: 50},
+			&core.TextField{Name: "to_stage", Required: true, Max: 50},
+			&core.SelectField{Name: "source", Required: true, Values: []string{"superuser", "user", "agent", "cron", "seed", "apify", "csv", "web_form", "system"}},
+			&core.TextField{Name: "actor", Max: 50},
+			&core.DateField{Name: "changed_at", Required: true},
+			&core.AutodateField{Name: "created", OnCreate: true},
+		)
+		history.AddIndex("idx_crm_stage_history_lead", false, "lead, changed_at", "lead != ''")
+		history.AddIndex("idx_crm_stage_history_deal", false, "deal, changed_at", "deal != ''")
+		return app.Save(history)
+	}, func(app core.App) error {
+		return deleteCollections(app, "crm_stage_history")
+	})
+}
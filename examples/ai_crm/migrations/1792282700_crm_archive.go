@@ -0,0 +1,86 @@
+package migrations
+
+import (
+	"strings"
+
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+// Adds archived/archived_at/deleted_at to accounts, leads, deals and
+// activities and hides archived records from the API rules. Admins can list
+// them with ?archived=true; nobody can edit them until they are restored.
+// Only admins can delete an archived record, which purges it for good.
+func init() {
+	const (
+		superuser = "@request.auth.collectionName = '_superusers'"
+		crmUser   = "@request.auth.collectionName = 'crm_users'"
+	)
+	var (
+		admin     = "(" + superuser + " || (" + crmUser + " && @request.auth.role = 'admin'))"
+		visible   = "(archived = false || (" + admin + " && @request.query.archived = 'true'))"
+		editable  = "archived = false"
+		deletable = "(archived = false || " + admin + ")"
+	)
+
+	collections := []string{"crm_accounts", "crm_leads", "crm_deals", "crm_activities"}
+
+	and := func(rule *string, cond string) *string {
+		if rule == nil {
+			return nil
+		}
+		return types.Pointer("(" + *rule + ") && " + cond)
+	}
+	strip := func(rule *string, cond string) *string {
+		if rule == nil {
+			return nil
+		}
+		r := strings.TrimSuffix(*rule, ") && "+cond)
+		return types.Pointer(strings.TrimPrefix(r, "("))
+	}
+
+	m.Register(func(app core.App) error {
+		for _, name := range collections {
+			col, err := app.FindCollectionByNameOrId(name)
+			if err != nil {
+				return err
+			}
+			col.Fields.Add(
+				&core.BoolField{Name: "archived"},
+				&core.DateField{Name: "archived_at"},
+				&core.DateField{Name: "deleted_at"},
+			)
+			col.AddIndex("idx_"+name+"_archived", false, "archived", "")
+			col.AddIndex("idx_"+name+"_deleted_at", false, "deleted_at", "deleted_at != ''")
+			col.ListRule = and(col.ListRule, visible)
+			col.ViewRule = and(col.ViewRule, visible)
+			col.UpdateRule = and(col.UpdateRule, editable)
+			col.DeleteRule = and(col.DeleteRule, deletable)
+			if err := app.Save(col); err != nil {
+				return err
+			}
+		}
+		return nil
+	}, func(app core.App) error {
+		for _, name := range collections {
+			col, err := app.FindCollectionByNameOrId(name)
+			if err != nil {
+				return err
+			}
+			col.RemoveIndex("idx_" + name + "_archived")
+			col.RemoveIndex("idx_" + name + "_deleted_at")
+			col.ListRule = strip(col.ListRule, visible)
+			col.ViewRule = strip(col.ViewRule, visible)
+			col.UpdateRule = strip(col.UpdateRule, editable)
+			col.DeleteRule = strip(col.DeleteRule, deletable)
+			for _, field := range []string{"archived", "archived_at", "deleted_at"} {
+				col.Fields.RemoveByName(field)
+			}
+			if err := app.Save(col); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,36 @@
+package migrations
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+)
+
+// Creates crm_audit_log, the field-level diffs of every create, update and
+// delete of a CRM record with the actor behind it. Entries are written by the
+// record hooks and read through the /api/ai-crm/audit routes, which apply
+// the access rules of the audited record; the collection itself is
+// superuser-only.
+func init() {
+	m.Register(func(app core.App) error {
+		audit, err := findOrNewBaseCollection(app, "crm_audit_log")
+		if err != nil {
+			return err
+		}
+		setSuperuserOnlyRules(audit)
+		audit.Fields.Add(
+			&core.TextField{Name: "record_collection", Required: true, Max: 100},
+			&core.TextField{Name: "record_id", Required: true, Max: 50},
+			&core.SelectField{Name: "action", Required: true, Values: []string{"create", "update", "delete"}},
+			&core.JSONField{Name: "changes"},
+			&core.SelectField{Name: "source", Required: true, Values: []string{"superuser", "user", "agent", "cron", "seed", "apify", "csv", "web_form", "system"}},
+			&core.TextField{Name: "actor", Max: 50},
+			&core.AutodateField{Name: "created", OnCreate: true},
+		)
+		audit.AddIndex("idx_crm_audit_log_record", false, "record_collection, record_id, created", "")
+		audit.AddIndex("idx_crm_audit_log_actor", false, "actor", "actor != ''")
+		audit.AddIndex("idx_crm_audit_log_created", false, "created", "")
+		return app.Save(audit)
+	}, func(app core.App) error {
+		return deleteCollections(app, "crm_audit_log")
+	})
+}
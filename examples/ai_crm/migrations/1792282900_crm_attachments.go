@@ -0,0 +1,62 @@
+package migrations
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+)
+
+// Adds protected attachments (proposals, contracts, call recordings) to
+// activities and deals. Files are served only with a file token and the view
+// rule of the record, so they follow its owner scope and archive state.
+func init() {
+	mimeTypes := []string{
+		"application/pdf",
+		"application/msword",
+		"application/vnd.openxmlformats-officedocument.wordprocessingml.document",
+		"application/vnd.ms-excel",
+		"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+		"application/vnd.ms-powerpoint",
+		"application/vnd.openxmlformats-officedocument.presentationml.presentation",
+		"application/vnd.oasis.opendocument.text",
+		"application/vnd.oasis.opendocument.spreadsheet",
+		"text/plain",
+		"text/csv",
+		"image/png",
+		"image/jpeg",
+		"image/webp",
+		"audio/mpeg",
+		"audio/mp4",
+		"audio/x-m4a",
+		"audio/wav",
+		"audio/x-wav",
+		"audio/ogg",
+		"audio/webm",
+	}
+
+	m.Register(func(app core.App) error {
+		for _, name := range []string{"crm_activities", "crm_deals"} {
+			col, err := app.FindCollectionByNameOrId(name)
+			if err != nil {
+				return err
+			}
+			col.Fields.Add(&core.FileField{
+				Name:      "attachments",
+				MaxSelect: 20,
+				MaxSize:   25 << 20,
+				MimeTypes: mimeTypes,
+				Protected: true,
+			})
+			if err := app.Save(col); err != nil {
+				return err
+			}
+		}
+		return nil
+	}, func(app core.App) error {
+		for _, name := range []string{"crm_activities", "crm_deals"} {
+			if err := removeFields(app, name, "attachments"); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
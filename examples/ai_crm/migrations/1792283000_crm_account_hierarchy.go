@@ -0,0 +1,28 @@
+package migrations
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+)
+
+// Adds parent to crm_accounts so groups can be modelled with their
+// subsidiaries. Cycles are rejected by the account hooks.
+func init() {
+	m.Register(func(app core.App) error {
+		accounts, err := app.FindCollectionByNameOrId("crm_accounts")
+		if err != nil {
+			return err
+		}
+		accounts.Fields.Add(&core.RelationField{Name: "parent", CollectionId: accounts.Id, MaxSelect: 1})
+		accounts.AddIndex("idx_crm_accounts_parent", false, "parent", "parent != ''")
+		return app.Save(accounts)
+	}, func(app core.App) error {
+		accounts, err := app.FindCollectionByNameOrId("crm_accounts")
+		if err != nil {
+			return err
+		}
+		accounts.RemoveIndex("idx_crm_accounts_parent")
+		accounts.Fields.RemoveByName("parent")
+		return app.Save(accounts)
+	})
+}
@@ -0,0 +1,104 @@
+package migrations
+
+import (
+	"slices"
+	"strings"
+
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+// Creates crm_deal_contacts, the leads involved in a deal with their buying
+// role, and backfills the lead of every deal as its primary contact. The
+// outreach templates get one action per role for the agent.
+func init() {
+	const (
+		superuser = "@request.auth.collectionName = '_superusers'"
+		crmUser   = "@request.auth.collectionName = 'crm_users'"
+	)
+	var (
+		admin     = "(" + superuser + " || (" + crmUser + " && @request.auth.role = 'admin'))"
+		dealOwned = "(" + admin + " || (" + crmUser + " && (deal.owner = @request.auth.id || (@request.auth.team != '' && deal.owner.team = @request.auth.team) || (@request.auth.role = 'manager' && deal.owner = ''))))"
+	)
+	roles := []string{"champion", "economic_buyer", "decision_maker", "technical", "legal", "procurement", "influencer", "other"}
+
+	m.Register(func(app core.App) error {
+		deals, err := app.FindCollectionByNameOrId("crm_deals")
+		if err != nil {
+			return err
+		}
+		leads, err := app.FindCollectionByNameOrId("crm_leads")
+		if err != nil {
+			return err
+		}
+
+		contacts, err := findOrNewBaseCollection(app, "crm_deal_contacts")
+		if err != nil {
+			return err
+		}
+		contacts.ListRule = types.Pointer(dealOwned)
+		contacts.ViewRule = types.Pointer(dealOwned)
+		contacts.CreateRule = types.Pointer(dealOwned + " && deal.archived = false")
+		contacts.UpdateRule = types.Pointer(dealOwned + " && deal.archived = false")
+		contacts.DeleteRule = types.Pointer(dealOwned + " && deal.archived = false")
+		contacts.Fields.Add(
+			&core.RelationField{Name: "deal", CollectionId: deals.Id, MaxSelect: 1, Required: true, CascadeDelete: true},
+			&core.RelationField{Name: "lead", CollectionId: leads.Id, MaxSelect: 1, Required: true, CascadeDelete: true},
+			&core.SelectField{Name: "role", MaxSelect: 1, Values: roles},
+			&core.BoolField{Name: "is_primary"},
+			&core.TextField{Name: "notes", Max: 1000},
+			&core.AutodateField{Name: "created", OnCreate: true},
+			&core.AutodateField{Name: "updated", OnCreate: true, OnUpdate: true},
+		)
+		contacts.AddIndex("idx_crm_deal_contacts_deal_lead", true, "deal, lead", "")
+		contacts.AddIndex("idx_crm_deal_contacts_lead", false, "lead", "")
+		if err := app.Save(contacts); err != nil {
+			return err
+		}
+
+		existing, err := app.FindAllRecords(deals)
+		if err != nil {
+			return err
+		}
+		for _, deal := range existing {
+			if deal.GetString("lead") == "" {
+				continue
+			}
+			contact := core.NewRecord(contacts)
+			contact.Set("deal", deal.Id)
+			contact.Set("lead", deal.GetString("lead"))
+			contact.Set("is_primary", true)
+			if err := app.Save(contact); err != nil {
+				return err
+			}
+		}
+
+		templates, err := app.FindCollectionByNameOrId("crm_outreach_templates")
+		if err != nil {
+			return err
+		}
+		if action, ok := templates.Fields.GetByName("action").(*core.SelectField); ok {
+			for _, role := range roles {
+				if !slices.Contains(action.Values, "contact_"+role) {
+					action.Values = append(action.Values, "contact_"+role)
+				}
+			}
+		}
+		return app.Save(templates)
+	}, func(app core.App) error {
+		templates, err := app.FindCollectionByNameOrId("crm_outreach_templates")
+		if err != nil {
+			return err
+		}
+		if action, ok := templates.Fields.GetByName("action").(*core.SelectField); ok {
+			action.Values = slices.DeleteFunc(action.Values, func(v string) bool {
+				return strings.HasPrefix(v, "contact_")
+			})
+		}
+		if err := app.Save(templates); err != nil {
+			return err
+		}
+		return deleteCollections(app, "crm_deal_contacts")
+	})
+}
@@ -0,0 +1,106 @@
+package migrations
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+// Creates crm_lost_reasons, the configurable list a lost lead or deal has to
+// pick from, and adds the loss details (reason, competitor, notes, the stage
+// it was lost at and when) to leads and deals. The lead and deal hooks
+// require the reason when the stage moves to lost.
+func init() {
+	const (
+		superuser = "@request.auth.collectionName = '_superusers'"
+		crmUser   = "@request.auth.collectionName = 'crm_users'"
+	)
+	var (
+		admin  = "(" + superuser + " || (" + crmUser + " && @request.auth.role = 'admin'))"
+		anyone = "(" + superuser + " || " + crmUser + ")"
+	)
+
+	defaults := []struct {
+		name       string
+		competitor bool
+	}{
+		{"Price", false},
+		{"Chose a competitor", true},
+		{"No budget", false},
+		{"Bad timing", false},
+		{"No decision", false},
+		{"Product fit", false},
+		{"Unresponsive", false},
+		{"Other", false},
+	}
+
+	m.Register(func(app core.App) error {
+		reasons, err := findOrNewBaseCollection(app, "crm_lost_reasons")
+		if err != nil {
+			return err
+		}
+		reasons.ListRule = types.Pointer(anyone)
+		reasons.ViewRule = types.Pointer(anyone)
+		reasons.CreateRule = types.Pointer(admin)
+		reasons.UpdateRule = types.Pointer(admin)
+		reasons.DeleteRule = types.Pointer(admin)
+		reasons.Fields.Add(
+			&core.TextField{Name: "name", Required: true, Presentable: true, Max: 120},
+			&core.TextField{Name: "description", Max: 1000},
+			&core.BoolField{Name: "requires_competitor"},
+			&core.BoolField{Name: "active"},
+			&core.NumberField{Name: "sort_order"},
+			&core.AutodateField{Name: "created", OnCreate: true},
+			&core.AutodateField{Name: "updated", OnCreate: true, OnUpdate: true},
+		)
+		reasons.AddIndex("idx_crm_lost_reasons_name", true, "name", "")
+		if err := app.Save(reasons); err != nil {
+			return err
+		}
+
+		for i, d := range defaults {
+			rec := core.NewRecord(reasons)
+			rec.Set("name", d.name)
+			rec.Set("requires_competitor", d.competitor)
+			rec.Set("active", true)
+			rec.Set("sort_order", i+1)
+			if err := app.Save(rec); err != nil {
+				return err
+			}
+		}
+
+		for _, name := range []string{"crm_leads", "crm_deals"} {
+			col, err := app.FindCollectionByNameOrId(name)
+			if err != nil {
+				return err
+			}
+			col.Fields.Add(
+				&core.RelationField{Name: "lost_reason", CollectionId: reasons.Id, MaxSelect: 1},
+				&core.TextField{Name: "lost_competitor", Max: 255},
+				&core.TextField{Name: "lost_notes", Max: 2000},
+				&core.TextField{Name: "lost_stage", Max: 50},
+				&core.DateField{Name: "lost_at"},
+			)
+			col.AddIndex("idx_"+name+"_lost_at", false, "lost_at", "lost_at != ''")
+			if err := app.Save(col); err != nil {
+				return err
+			}
+		}
+		return nil
+	}, func(app core.App) error {
+		for _, name := range []string{"crm_leads", "crm_deals"} {
+			col, err := app.FindCollectionByNameOrId(name)
+			if err != nil {
+				return err
+			}
+			col.RemoveIndex("idx_" + name + "_lost_at")
+			for _, field := range []string{"lost_reason", "lost_competitor", "lost_notes", "lost_stage", "lost_at"} {
+				col.Fields.RemoveByName(field)
+			}
+			if err := app.Save(col); err != nil {
+				return err
+			}
+		}
+		return deleteCollections(app, "crm_lost_reasons")
+	})
+}
@@ -0,0 +1,64 @@
+package migrations
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+)
+
+// Adds lead attribution: where a lead came from (source and source detail)
+// and the UTM parameters of its first and last touch. Existing leads get
+// the source their first stage history entry was saved by, or manual.
+func init() {
+	utm := []string{"source", "medium", "campaign", "term", "content"}
+
+	m.Register(func(app core.App) error {
+		leads, err := app.FindCollectionByNameOrId("crm_leads")
+		if err != nil {
+			return err
+		}
+		leads.Fields.Add(
+			&core.SelectField{Name: "source", MaxSelect: 1, Values: []string{"seed", "apify", "csv", "web_form", "manual"}},
+			&core.TextField{Name: "source_detail", Max: 255},
+		)
+		for _, touch := range []string{"first", "last"} {
+			for _, param := range utm {
+				leads.Fields.Add(&core.TextField{Name: touch + "_utm_" + param, Max: 255})
+			}
+			leads.Fields.Add(&core.DateField{Name: touch + "_touch_at"})
+		}
+		leads.AddIndex("idx_crm_leads_source", false, "source", "")
+		leads.AddIndex("idx_crm_leads_first_utm_campaign", false, "first_utm_campaign", "first_utm_campaign != ''")
+		if err := app.Save(leads); err != nil {
+			return err
+		}
+
+		_, err = app.DB().NewQuery(`
+			UPDATE {{crm_leads}} SET
+				[[source]] = COALESCE((
+					SELECT h.source FROM {{crm_stage_history}} h
+					WHERE h.lead = {{crm_leads}}.id AND h.from_stage = '' AND h.source IN ('seed', 'apify', 'csv', 'web_form')
+					LIMIT 1
+				), 'manual'),
+				[[first_touch_at]] = [[created]],
+				[[last_touch_at]] = [[created]]
+			WHERE [[source]] = ''
+		`).Execute()
+		return err
+	}, func(app core.App) error {
+		leads, err := app.FindCollectionByNameOrId("crm_leads")
+		if err != nil {
+			return err
+		}
+		leads.RemoveIndex("idx_crm_leads_source")
+		leads.RemoveIndex("idx_crm_leads_first_utm_campaign")
+		leads.Fields.RemoveByName("source")
+		leads.Fields.RemoveByName("source_detail")
+		for _, touch := range []string{"first", "last"} {
+			for _, param := range utm {
+				leads.Fields.RemoveByName(touch + "_utm_" + param)
+			}
+			leads.Fields.RemoveByName(touch + "_touch_at")
+		}
+		return app.Save(leads)
+	})
+}
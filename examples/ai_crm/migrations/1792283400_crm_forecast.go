@@ -0,0 +1,100 @@
+package migrations
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+// Creates crm_forecast_stages, the win probability and forecast category of
+// each open deal stage (rows with an owner override the defaults for that
+// owner's deals), and crm_forecast_snapshots, the weekly copies of the
+// forecast that are compared against the actual results. Snapshots are
+// written by the cron only.
+func init() {
+	const (
+		superuser = "@request.auth.collectionName = '_superusers'"
+		crmUser   = "@request.auth.collectionName = 'crm_users'"
+	)
+	var (
+		admin   = "(" + superuser + " || (" + crmUser + " && @request.auth.role = 'admin'))"
+		anyone  = "(" + superuser + " || " + crmUser + ")"
+		visible = "(" + admin + " || (" + crmUser + " && (owner = @request.auth.id || (@request.auth.team != '' && owner.team = @request.auth.team) || (@request.auth.role = 'manager' && owner = ''))))"
+	)
+
+	defaults := []struct {
+		stage       string
+		probability float64
+		category    string
+	}{
+		{"qualification", 10, "pipeline"},
+		{"proposal", 40, "best_case"},
+		{"negotiation", 75, "commit"},
+	}
+
+	m.Register(func(app core.App) error {
+		users, err := app.FindCollectionByNameOrId("crm_users")
+		if err != nil {
+			return err
+		}
+
+		stages, err := findOrNewBaseCollection(app, "crm_forecast_stages")
+		if err != nil {
+			return err
+		}
+		stages.ListRule = types.Pointer(anyone)
+		stages.ViewRule = types.Pointer(anyone)
+		stages.CreateRule = types.Pointer(admin)
+		stages.UpdateRule = types.Pointer(admin)
+		stages.DeleteRule = types.Pointer(admin)
+		stages.Fields.Add(
+			&core.SelectField{Name: "stage", Required: true, MaxSelect: 1, Values: []string{"qualification", "proposal", "negotiation"}},
+			&core.RelationField{Name: "owner", CollectionId: users.Id, MaxSelect: 1, CascadeDelete: true},
+			&core.NumberField{Name: "probability", Min: floatPointer(0), Max: floatPointer(100)},
+			&core.SelectField{Name: "category", Required: true, MaxSelect: 1, Values: []string{"commit", "best_case", "pipeline", "omitted"}},
+			&core.AutodateField{Name: "created", OnCreate: true},
+			&core.AutodateField{Name: "updated", OnCreate: true, OnUpdate: true},
+		)
+		stages.AddIndex("idx_crm_forecast_stages_owner_stage", true, "owner, stage", "")
+		if err := app.Save(stages); err != nil {
+			return err
+		}
+
+		for _, d := range defaults {
+			rec := core.NewRecord(stages)
+			rec.Set("stage", d.stage)
+			rec.Set("probability", d.probability)
+			rec.Set("category", d.category)
+			if err := app.Save(rec); err != nil {
+				return err
+			}
+		}
+
+		snapshots, err := findOrNewBaseCollection(app, "crm_forecast_snapshots")
+		if err != nil {
+			return err
+		}
+		setSuperuserOnlyRules(snapshots)
+		snapshots.ListRule = types.Pointer(visible)
+		snapshots.ViewRule = types.Pointer(visible)
+		snapshots.Fields.Add(
+			&core.DateField{Name: "snapshot_date", Required: true},
+			&core.SelectField{Name: "granularity", Required: true, MaxSelect: 1, Values: []string{"month", "quarter"}},
+			&core.TextField{Name: "period", Required: true, Max: 10},
+			&core.RelationField{Name: "owner", CollectionId: users.Id, MaxSelect: 1},
+			&core.NumberField{Name: "open_deals"},
+			&core.NumberField{Name: "commit"},
+			&core.NumberField{Name: "best_case"},
+			&core.NumberField{Name: "pipeline"},
+			&core.NumberField{Name: "weighted"},
+			&core.NumberField{Name: "closed_won"},
+			&core.TextField{Name: "currency", Max: 3},
+			&core.AutodateField{Name: "created", OnCreate: true},
+		)
+		snapshots.AddIndex("idx_crm_forecast_snapshots_period", false, "granularity, period, snapshot_date", "")
+		snapshots.AddIndex("idx_crm_forecast_snapshots_date", false, "snapshot_date", "")
+		return app.Save(snapshots)
+	}, func(app core.App) error {
+		return deleteCollections(app, "crm_forecast_snapshots", "crm_forecast_stages")
+	})
+}
@@ -0,0 +1,51 @@
+package migrations
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+// Creates crm_pipeline_snapshots, the daily count and amount of the leads
+// and deals per stage and owner that the trend report is built from.
+// Snapshots are written by the cron only and visible like the records they
+// count.
+func init() {
+	const (
+		superuser = "@request.auth.collectionName = '_superusers'"
+		crmUser   = "@request.auth.collectionName = 'crm_users'"
+	)
+	var (
+		admin   = "(" + superuser + " || (" + crmUser + " && @request.auth.role = 'admin'))"
+		visible = "(" + admin + " || (" + crmUser + " && (owner = @request.auth.id || (@request.auth.team != '' && owner.team = @request.auth.team) || (@request.auth.role = 'manager' && owner = ''))))"
+	)
+
+	m.Register(func(app core.App) error {
+		users, err := app.FindCollectionByNameOrId("crm_users")
+		if err != nil {
+			return err
+		}
+
+		snapshots, err := findOrNewBaseCollection(app, "crm_pipeline_snapshots")
+		if err != nil {
+			return err
+		}
+		setSuperuserOnlyRules(snapshots)
+		snapshots.ListRule = types.Pointer(visible)
+		snapshots.ViewRule = types.Pointer(visible)
+		snapshots.Fields.Add(
+			&core.DateField{Name: "snapshot_date", Required: true},
+			&core.SelectField{Name: "collection", Required: true, MaxSelect: 1, Values: []string{"leads", "deals"}},
+			&core.TextField{Name: "stage", Required: true, Max: 50},
+			&core.RelationField{Name: "owner", CollectionId: users.Id, MaxSelect: 1},
+			&core.NumberField{Name: "count"},
+			&core.NumberField{Name: "amount"},
+			&core.TextField{Name: "currency", Max: 3},
+			&core.AutodateField{Name: "created", OnCreate: true},
+		)
+		snapshots.AddIndex("idx_crm_pipeline_snapshots_date", false, "collection, snapshot_date", "")
+		return app.Save(snapshots)
+	}, func(app core.App) error {
+		return deleteCollections(app, "crm_pipeline_snapshots")
+	})
+}
@@ -0,0 +1,39 @@
+package migrations
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+// Limits account updates to managers and admins, and to reps who own a lead
+// under the account. Accounts stay visible to every CRM user, since leads
+// from anyone's scope link to them.
+func init() {
+	const (
+		superuser = "@request.auth.collectionName = '_superusers'"
+		crmUser   = "@request.auth.collectionName = 'crm_users'"
+	)
+	var (
+		admin    = "(" + superuser + " || (" + crmUser + " && @request.auth.role = 'admin'))"
+		manager  = "(" + admin + " || (" + crmUser + " && @request.auth.role = 'manager'))"
+		anyone   = "(" + superuser + " || " + crmUser + ")"
+		hasLeads = "(" + crmUser + " && crm_leads_via_account.owner ?= @request.auth.id)"
+		editable = "archived = false"
+	)
+
+	setUpdateRule := func(app core.App, rule string) error {
+		accounts, err := app.FindCollectionByNameOrId("crm_accounts")
+		if err != nil {
+			return err
+		}
+		accounts.UpdateRule = types.Pointer("(" + rule + ") && " + editable)
+		return app.Save(accounts)
+	}
+
+	m.Register(func(app core.App) error {
+		return setUpdateRule(app, manager+" || "+hasLeads)
+	}, func(app core.App) error {
+		return setUpdateRule(app, anyone)
+	})
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"net/http"
+	"net/mail"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/router"
+)
+
+const (
+	flagEmailRoleBased  = "email_role_based"
+	flagEmailDisposable = "email_disposable"
+	flagEmailFreeMail   = "email_free_mail"
+	flagEmailInvalid    = "email_invalid"
+	flagPhoneInvalid    = "phone_invalid"
+	flagLinkedinInvalid = "linkedin_invalid"
+)
+
+// countryCallingCodes maps ISO 3166-1 alpha-2 codes to their E.164 calling
+// code. National numbers in all of these drop a leading trunk "0".
+var countryCallingCodes = map[string]string{
+	"AE": "971", "SA": "966", "QA": "974", "KW": "965", "BH": "973", "OM": "968",
+	"JO": "962", "LB": "961", "EG": "20", "TR": "90", "IN": "91", "PK": "92",
+	"GB": "44", "IE": "353", "DE": "49", "FR": "33", "ES": "34", "IT": "39",
+	"NL": "31", "CH": "41", "SE": "46", "US": "1", "CA": "1", "SG": "65",
+	"AU": "61", "CN": "86", "PH": "63", "ZA": "27", "NG": "234", "KE": "254",
+}
+
+var countryNameCodes = map[string]string{
+	"united arab emirates": "AE", "uae": "AE", "saudi arabia": "SA", "ksa": "SA",
+	"qatar": "QA", "kuwait": "KW", "bahrain": "BH", "oman": "OM", "jordan": "JO",
+	"lebanon": "LB", "egypt": "EG", "turkey": "TR", "türkiye": "TR", "india": "IN",
+	"pakistan": "PK", "united kingdom": "GB", "uk": "GB", "england": "GB", "ireland": "IE",
+	"germany": "DE", "france": "FR", "spain": "ES", "italy": "IT", "netherlands": "NL",
+	"switzerland": "CH", "sweden": "SE", "united states": "US", "united states of america": "US",
+	"usa": "US", "canada": "CA", "singapore": "SG", "australia": "AU", "china": "CN",
+	"philippines": "PH", "south africa": "ZA", "nigeria": "NG", "kenya": "KE",
+}
+
+// normalizeCountry returns the ISO 3166-1 alpha-2 code for a country name or
+// code, or the trimmed input when it isn't known.
+func normalizeCountry(raw string) string {
+	raw = strings.TrimSpace(raw)
+	if len(raw) == 2 {
+		return strings.ToUpper(raw)
+	}
+	if code, ok := countryNameCodes[strings.ToLower(raw)]; ok {
+		return code
+	}
+	return raw
+}
+
+var roleEmailLocalParts = map[string]struct{}{
+	"info": {}, "sales": {}, "admin": {}, "support": {}, "contact": {}, "hello": {},
+	"office": {}, "team": {}, "hr": {}, "careers": {}, "jobs": {}, "billing": {},
+	"accounts": {}, "marketing": {}, "noreply": {}, "no-reply": {}, "enquiries": {},
+	"enquiry": {}, "inquiries": {}, "help": {}, "webmaster": {}, "media": {}, "press": {},
+}
+
+var disposableEmailDomains = map[string]struct{}{
+	"mailinator.com": {}, "guerrillamail.com": {}, "10minutemail.com": {}, "tempmail.com": {},
+	"temp-mail.org": {}, "yopmail.com": {}, "trashmail.com": {}, "getnada.com": {},
+	"sharklasers.com": {}, "dispostable.com": {}, "maildrop.cc": {}, "throwawaymail.com": {},
+	"fakeinbox.com": {}, "mintemail.com": {}, "mohmal.com": {}, "emailondeck.com": {},
+}
+
+// phoneExtensionPattern matches an extension after the digits of a phone
+// number.
+var phoneExtensionPattern = regexp.MustCompile(`(?i)\s*(?:ext\.?|extension|x|;\s*ext=|#)\s*\d+$`)
+
+// defaultPhoneCountry is used for national numbers when the lead's account
+// has no country. Override it with AI_CRM_DEFAULT_COUNTRY.
+func defaultPhoneCountry() string {
+	if v := strings.ToUpper(strings.TrimSpace(os.Getenv("AI_CRM_DEFAULT_COUNTRY"))); v != "" {
+		return v
+	}
+	return "AE"
+}
+
+// normalizePhoneE164 converts raw to E.164 ("+971501234567"), interpreting
+// national numbers in country. It returns "" when raw can't be converted.
+func normalizePhoneE164(raw string, country string) string {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return ""
+	}
+	// drop a trailing extension ("x123", "ext. 123", ";ext=123") and a label
+	// in front of the number ("Tel: ", "Phone ")
+	raw = phoneExtensionPattern.ReplaceAllString(raw, "")
+	raw = strings.TrimLeftFunc(raw, func(r rune) bool {
+		return r != '+' && (r < '0' || r > '9')
+	})
+
+	international := strings.HasPrefix(raw, "+")
+	digits := strings.Map(func(r rune) rune {
+		if r >= '0' && r <= '9' {
+			return r
+		}
+		return -1
+	}, raw)
+
+	switch {
+	case international:
+	case strings.HasPrefix(digits, "00"):
+		digits = digits[2:]
+	default:
+		cc := countryCallingCodes[strings.ToUpper(country)]
+		if cc == "" {
+			return ""
+		}
+		national := strings.TrimLeft(digits, "0")
+		// already carries the calling code, just without "+" or "00"
+		if strings.HasPrefix(digits, cc) && len(digits) >= 11 {
+			national = strings.TrimPrefix(digits, cc)
+		}
+		digits = cc + national
+	}
+
+	if len(digits) < 8 || len(digits) > 15 || digits[0] == '0' {
+		return ""
+	}
+	return "+" + digits
+}
+
+// canonicalLinkedinURL returns the "https://linkedin.com/in/<slug>" form of a
+// LinkedIn profile URL, or "" when raw is not a profile URL.
+func canonicalLinkedinURL(raw string) string {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return ""
+	}
+	if !strings.Contains(raw, "://") {
+		raw = "https://" + raw
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return ""
+	}
+
+	host := strings.ToLower(u.Hostname())
+	if host != "linkedin.com" && !strings.HasSuffix(host, ".linkedin.com") {
+		return ""
+	}
+
+	parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+	if len(parts) < 2 || (parts[0] != "in" && parts[0] != "pub") || parts[1] == "" {
+		return ""
+	}
+
+	slug, err := url.PathUnescape(parts[1])
+	if err != nil {
+		slug = parts[1]
+	}
+	return "https://linkedin.com/in/" + strings.ToLower(slug)
+}
+
+// emailFlags classifies an already lowercased address.
+func emailFlags(email string) []string {
+	if email == "" {
+		return nil
+	}
+
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Address != email {
+		return []string{flagEmailInvalid}
+	}
+
+	local, domain, _ := strings.Cut(email, "@")
+	if i := strings.Index(local, "+"); i > 0 {
+		local = local[:i]
+	}
+
+	flags := []string{}
+	if _, ok := roleEmailLocalParts[local]; ok {
+		flags = append(flags, flagEmailRoleBased)
+	}
+	if _, ok := disposableEmailDomains[domain]; ok {
+		flags = append(flags, flagEmailDisposable)
+	}
+	if isFreeMailDomain(domain) {
+		flags = append(flags, flagEmailFreeMail)
+	}
+	return flags
+}
+
+// leadPhoneCountry returns the country used to read national phone numbers
+// of leads linked to accountId.
+func leadPhoneCountry(app core.App, accountId string) string {
+	if accountId != "" {
+		if acc, err := app.FindRecordById(collectionAccounts, accountId); err == nil {
+			if c := strings.ToUpper(strings.TrimSpace(acc.GetString("country"))); c != "" {
+				return c
+			}
+		}
+	}
+	return defaultPhoneCountry()
+}
+
+// normalizeLeadInput rewrites contact values of incoming lead data into their
+// stored form, so the merge policy compares like with like.
+func normalizeLeadInput(app core.App, accountId string, incoming map[string]string) {
+	if v := strings.ToLower(strings.TrimSpace(incoming["email"])); v != "" {
+		incoming["email"] = v
+	}
+	if v := canonicalLinkedinURL(incoming["linkedin"]); v != "" {
+		incoming["linkedin"] = v
+	}
+	if raw := incoming["phone"]; raw != "" {
+		if v := normalizePhoneE164(raw, leadPhoneCountry(app, accountId)); v != "" {
+			incoming["phone"] = v
+		}
+	}
+}
+
+// normalizeLeadContact normalizes email, phone and linkedin of lead in place
+// and refreshes its contact_flags. Values that can't be normalized are kept
+// as-is and flagged.
+func normalizeLeadContact(app core.App, lead *core.Record) {
+	flags := []string{}
+
+	email := strings.ToLower(strings.TrimSpace(lead.GetString("email")))
+	if email != lead.GetString("email") {
+		lead.Set("email", email)
+	}
+	flags = append(flags, emailFlags(email)...)
+
+	if phone := strings.TrimSpace(lead.GetString("phone")); phone != "" {
+		normalized := normalizePhoneE164(phone, leadPhoneCountry(app, lead.GetString("account")))
+		if normalized == "" {
+			flags = append(flags, flagPhoneInvalid)
+		} else if normalized != phone {
+			lead.Set("phone_raw", phone)
+			lead.Set("phone", normalized)
+		}
+	}
+
+	if linkedin := strings.TrimSpace(lead.GetString("linkedin")); linkedin != "" {
+		canonical := canonicalLinkedinURL(linkedin)
+		if canonical == "" {
+			flags = append(flags, flagLinkedinInvalid)
+		} else if canonical != linkedin {
+			lead.Set("linkedin", canonical)
+		}
+	}
+
+	lead.Set("contact_flags", flags)
+}
+
+func bindNormalizationHooks(app core.App) {
+	normalize := func(e *core.RecordEvent) error {
+		normalizeLeadContact(e.App, e.Record)
+		return e.Next()
+	}
+	app.OnRecordCreate(collectionLeads).BindFunc(normalize)
+	app.OnRecordUpdate(collectionLeads).BindFunc(normalize)
+}
+
+// normalizeAllLeads re-saves, on behalf of auth, every lead so the
+// normalization hook runs on records stored before it existed.
+func normalizeAllLeads(app core.App, auth *core.Record) (map[string]any, error) {
+	leads, err := app.FindAllRecords(collectionLeads)
+	if err != nil {
+		return nil, err
+	}
+
+	updated := 0
+	for _, lead := range leads {
+		before := lead.GetString("email") + "|" + lead.GetString("phone") + "|" + lead.GetString("linkedin") + "|" + strings.Join(lead.GetStringSlice("contact_flags"), ",")
+		normalizeLeadContact(app, lead)
+		after := lead.GetString("email") + "|" + lead.GetString("phone") + "|" + lead.GetString("linkedin") + "|" + strings.Join(lead.GetStringSlice("contact_flags"), ",")
+		if before == after {
+			continue
+		}
+		setAuthChangeActor(lead, auth)
+		if err := app.Save(lead); err != nil {
+			return nil, err
+		}
+		updated++
+	}
+
+	return map[string]any{"total": len(leads), "updated": updated}, nil
+}
+
+func bindNormalizationRoutes(grp *router.RouterGroup[*core.RequestEvent]) {
+	grp.POST("/normalize/leads", func(e *core.RequestEvent) error {
+		res, err := normalizeAllLeads(e.App, e.Auth)
+		if err != nil {
+			return e.InternalServerError("Failed to normalize leads.", err)
+		}
+		return e.JSON(http.StatusOK, res)
+	}).Bind(requireCRMRole())
+}
@@ -0,0 +1,61 @@
+package main
+
+import "testing"
+
+func TestNormalizePhoneE164(t *testing.T) {
+	scenarios := []struct {
+		raw      string
+		country  string
+		expected string
+	}{
+		{"", "AE", ""},
+		{"+971 50 123 4567", "AE", "+971501234567"},
+		{"050 123 4567", "AE", "+971501234567"},
+		{"00971501234567", "GB", "+971501234567"},
+		{"971501234567", "AE", "+971501234567"},
+		{"Tel: +44 20 7946 0958", "AE", "+442079460958"},
+		{"Phone +1 (415) 555-0132", "AE", "+14155550132"},
+		{"+1 415 555 0132 x123", "US", "+14155550132"},
+		{"+1 415 555 0132 ext. 45", "US", "+14155550132"},
+		{"+1 415 555 0132 EXT 45", "US", "+14155550132"},
+		{"+14155550132;ext=9", "US", "+14155550132"},
+		{"020 7946 0958", "GB", "+442079460958"},
+		{"020 7946 0958", "XX", ""},
+		{"123", "AE", ""},
+		{"+0123456789", "AE", ""},
+		{"n/a", "AE", ""},
+	}
+
+	for _, s := range scenarios {
+		t.Run(s.raw+"_"+s.country, func(t *testing.T) {
+			if got := normalizePhoneE164(s.raw, s.country); got != s.expected {
+				t.Fatalf("Expected %q, got %q", s.expected, got)
+			}
+		})
+	}
+}
+
+func TestCanonicalLinkedinURL(t *testing.T) {
+	scenarios := []struct {
+		raw      string
+		expected string
+	}{
+		{"", ""},
+		{"https://www.linkedin.com/in/Jane-Doe/", "https://linkedin.com/in/jane-doe"},
+		{"linkedin.com/in/jane-doe?trk=abc", "https://linkedin.com/in/jane-doe"},
+		{"http://ae.linkedin.com/pub/jane-doe/1/2/3", "https://linkedin.com/in/jane-doe"},
+		{"https://www.linkedin.com/in/j%C3%BCrgen", "https://linkedin.com/in/jürgen"},
+		{"https://www.linkedin.com/company/acme", ""},
+		{"https://www.linkedin.com/in/", ""},
+		{"https://notlinkedin.com/in/jane-doe", ""},
+		{"https://linkedin.com.evil.test/in/jane-doe", ""},
+	}
+
+	for _, s := range scenarios {
+		t.Run(s.raw, func(t *testing.T) {
+			if got := canonicalLinkedinURL(s.raw); got != s.expected {
+				t.Fatalf("Expected %q, got %q", s.expected, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/router"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+type pipelineStage struct {
+	Stage  string  `db:"stage" json:"stage"`
+	Count  int     `db:"count" json:"count"`
+	Amount float64 `db:"amount" json:"amount"`
+}
+
+type pipelineConversion struct {
+	From      string  `json:"from"`
+	To        string  `json:"to"`
+	Reached   int     `json:"reached"`
+	Converted int     `json:"converted"`
+	Rate      float64 `json:"rate"`
+}
+
+type pipelineOutcome struct {
+	Won          int     `db:"won" json:"won"`
+	Lost         int     `db:"lost" json:"lost"`
+	WinRate      float64 `db:"-" json:"winRate"`
+	WonRevenue   float64 `db:"won_revenue" json:"wonRevenue"`
+	AvgDealSize  float64 `db:"avg_deal_size" json:"avgDealSize"`
+	AvgCycleDays float64 `db:"avg_cycle_days" json:"avgCycleDays"`
+}
+
+// pipelineFilter narrows the pipeline report to the records created within
+// [from, to) and to an owner, lead source and account.
+type pipelineFilter struct {
+	From    string
+	To      string
+	Owner   string
+	Source  string
+	Account string
+}
+
+// where returns the conditions of f over the record r (the lead or deal
+// itself) and its lead l.
+func (f pipelineFilter) where(scope dbx.Expression) []dbx.Expression {
+	where := []dbx.Expression{dbx.HashExp{"r.archived": false}, scope}
+	if f.From != "" {
+		where = append(where, dbx.NewExp("r.created >= {:from}", dbx.Params{"from": f.From}))
+	}
+	if f.To != "" {
+		where = append(where, dbx.NewExp("r.created < {:to}", dbx.Params{"to": f.To}))
+	}
+	if f.Owner != "" {
+		where = append(where, dbx.HashExp{"r.owner": f.Owner})
+	}
+	if f.Source != "" {
+		where = append(where, dbx.HashExp{"l.source": f.Source})
+	}
+	if f.Account != "" {
+		where = append(where, dbx.HashExp{"l.account": f.Account})
+	}
+	return where
+}
+
+// stageRankSQL maps stageExpr to its position in the open part of order
+// (won included, lost excluded), NULL for lost and unknown stages.
+func stageRankSQL(order []string, stageExpr string) string {
+	var b strings.Builder
+	b.WriteString("(CASE " + stageExpr)
+	for i, stage := range order {
+		if stage == "lost" {
+			continue
+		}
+		// stage names are constants, so they are safe to inline
+		b.WriteString(" WHEN '" + stage + "' THEN " + strconv.Itoa(i))
+	}
+	b.WriteString(" END)")
+	return b.String()
+}
+
+// pipelineConversions computes the stage-to-stage conversion rates of the
+// records matching where (field "lead" or "deal" in the stage history). A
+// record reached a stage when its current stage or any stage it moved to is
+// that stage or a later one, so skipped stages still count as passed.
+func pipelineConversions(app core.App, collection string, field string, order []string, where []dbx.Expression) ([]pipelineConversion, error) {
+	history := "(SELECT MAX(" + stageRankSQL(order, "h.to_stage") + ") FROM " + collectionStageHistory + " h WHERE h." + field + " = r.id)"
+	reached := "MAX(COALESCE(" + stageRankSQL(order, "r.stage") + ", -1), COALESCE(" + history + ", -1))"
+
+	rows := []struct {
+		Rank  int `db:"rank"`
+		Count int `db:"count"`
+	}{}
+	q := app.DB().
+		Select(reached+" AS rank", "COUNT(*) AS count").
+		From(collection + " r")
+	if collection == collectionDeals {
+		q.InnerJoin(collectionLeads+" l", dbx.NewExp("l.id = r.lead"))
+	} else {
+		q.InnerJoin(collectionLeads+" l", dbx.NewExp("l.id = r.id"))
+	}
+	if err := q.Where(dbx.And(where...)).GroupBy("rank").All(&rows); err != nil {
+		return nil, err
+	}
+
+	// reached[i] counts the records that got to stage i or further
+	counts := make([]int, len(order)+1)
+	for _, row := range rows {
+		if row.Rank >= 0 && row.Rank < len(order) {
+			counts[row.Rank] += row.Count
+		}
+	}
+	for i := len(order) - 1; i >= 0; i-- {
+		counts[i] += counts[i+1]
+	}
+
+	open := slices.DeleteFunc(slices.Clone(order), func(s string) bool { return s == "lost" })
+	conversions := make([]pipelineConversion, 0, len(open))
+	for i := 0; i+1 < len(open); i++ {
+		from, to := stageIndex(order, open[i]), stageIndex(order, open[i+1])
+		c := pipelineConversion{From: open[i], To: open[i+1], Reached: counts[from], Converted: counts[to]}
+		if c.Reached > 0 {
+			c.Rate = roundMoney(float64(c.Converted) / float64(c.Reached))
+		}
+		conversions = append(conversions, c)
+	}
+	return conversions, nil
+}
+
+// pipelineReport aggregates the leads and deals visible through scope (over
+// the owner of r) and matching filter. Lead amounts are the deals under
+// them; open deals are valued in the base currency at their close date (or
+// today), won deals at the date they closed.
+func pipelineReport(app core.App, scope dbx.Expression, filter pipelineFilter) (map[string]any, error) {
+	now := dbx.Params{"now": types.NowDateTime().String()}
+	dealAmount := baseAmountSQL("d.amount", "d.currency", dealValuationDateSQL("d", "now"))
+
+	leadWhere := filter.where(scope)
+	leadStages := []pipelineStage{}
+	err := app.DB().
+		Select("r.stage AS stage", "COUNT(DISTINCT r.id) AS count", "COALESCE(SUM("+dealAmount+"), 0) AS amount").
+		From(collectionLeads+" r").
+		InnerJoin(collectionLeads+" l", dbx.NewExp("l.id = r.id")).
+		LeftJoin(collectionDeals+" d", dbx.NewExp("d.lead = r.id AND d.archived = 0")).
+		Where(dbx.And(leadWhere...)).
+		GroupBy("r.stage").
+		Bind(now).
+		All(&leadStages)
+	if err != nil {
+		return nil, err
+	}
+	leadConversions, err := pipelineConversions(app, collectionLeads, "lead", leadStageOrder, leadWhere)
+	if err != nil {
+		return nil, err
+	}
+
+	dealWhere := filter.where(scope)
+	dealStages := []pipelineStage{}
+	err = app.DB().
+		Select("r.stage AS stage", "COUNT(*) AS count", "COALESCE(SUM("+baseAmountSQL("r.amount", "r.currency", dealValuationDateSQL("r", "now"))+"), 0) AS amount").
+		From(collectionDeals+" r").
+		InnerJoin(collectionLeads+" l", dbx.NewExp("l.id = r.lead")).
+		Where(dbx.And(dealWhere...)).
+		GroupBy("r.stage").
+		Bind(now).
+		All(&dealStages)
+	if err != nil {
+		return nil, err
+	}
+	dealConversions, err := pipelineConversions(app, collectionDeals, "deal", dealStageOrder, dealWhere)
+	if err != nil {
+		return nil, err
+	}
+
+	wonAt := dealWonAtSQL("r")
+	wonAmount := baseAmountSQL("r.amount", "r.currency", wonAt)
+	outcome := pipelineOutcome{}
+	err = app.DB().
+		Select(
+			"COALESCE(SUM(r.stage = 'won'), 0) AS won",
+			"COALESCE(SUM(r.stage = 'lost'), 0) AS lost",
+			"COALESCE(SUM(CASE WHEN r.stage = 'won' THEN "+wonAmount+" END), 0) AS won_revenue",
+			"COALESCE(AVG(CASE WHEN r.stage = 'won' THEN "+wonAmount+" END), 0) AS avg_deal_size",
+			"COALESCE(AVG(CASE WHEN r.stage = 'won' THEN julianday("+wonAt+") - julianday(r.created) END), 0) AS avg_cycle_days",
+		).
+		From(collectionDeals+" r").
+		InnerJoin(collectionLeads+" l", dbx.NewExp("l.id = r.lead")).
+		Where(dbx.And(dealWhere...)).
+		One(&outcome)
+	if err != nil {
+		return nil, err
+	}
+	if closed := outcome.Won + outcome.Lost; closed > 0 {
+		outcome.WinRate = roundMoney(float64(outcome.Won) / float64(closed))
+	}
+	outcome.WonRevenue = roundMoney(outcome.WonRevenue)
+	outcome.AvgDealSize = roundMoney(outcome.AvgDealSize)
+	outcome.AvgCycleDays = roundMoney(outcome.AvgCycleDays)
+
+	leadWon, leadLost := 0, 0
+	for _, s := range leadStages {
+		switch s.Stage {
+		case "won":
+			leadWon = s.Count
+		case "lost":
+			leadLost = s.Count
+		}
+	}
+	leadWinRate := 0.0
+	if leadWon+leadLost > 0 {
+		leadWinRate = roundMoney(float64(leadWon) / float64(leadWon+leadLost))
+	}
+
+	return map[string]any{
+		"leads": map[string]any{
+			"stages":      pipelineStages(leadStages, leadStageOrder),
+			"conversions": leadConversions,
+			"winRate":     leadWinRate,
+		},
+		"deals": map[string]any{
+			"stages":      pipelineStages(dealStages, dealStageOrder),
+			"conversions": dealConversions,
+			"outcome":     outcome,
+		},
+		"currency": baseCurrency(),
+	}, nil
+}
+
+// dealWonAtSQL is when the deal alias was won: the first time it moved to
+// won, falling back to its close date for deals older than the stage
+// history.
+func dealWonAtSQL(alias string) string {
+	return "COALESCE((SELECT MIN(h.changed_at) FROM " + collectionStageHistory + " h WHERE h.deal = " + alias + ".id AND h.to_stage = 'won'), " +
+		"NULLIF(" + alias + ".close_date, ''), " + alias + ".updated)"
+}
+
+// pipelineStages lists every stage of order, including the empty ones, with
+// the rounded amounts of rows.
+func pipelineStages(rows []pipelineStage, order []string) []pipelineStage {
+	stages := make([]pipelineStage, len(order))
+	for i, stage := range order {
+		stages[i].Stage = stage
+	}
+	for _, row := range rows {
+		if i := slices.Index(order, row.Stage); i >= 0 {
+			stages[i].Count = row.Count
+			stages[i].Amount = roundMoney(row.Amount)
+		}
+	}
+	return stages
+}
+
+func bindPipelineRoutes(grp *router.RouterGroup[*core.RequestEvent]) {
+	grp.GET("/reports/pipeline", func(e *core.RequestEvent) error {
+		q := e.Request.URL.Query()
+		filter := pipelineFilter{
+			From:    q.Get("from"),
+			To:      q.Get("to"),
+			Owner:   q.Get("owner"),
+			Source:  q.Get("source"),
+			Account: q.Get("account"),
+		}
+		if filter.Source != "" && !slices.Contains(leadSources, filter.Source) {
+			return e.BadRequestError("Unknown lead source.", nil)
+		}
+
+		report, err := pipelineReport(e.App, ownerScopeExpr(e.Auth, "r.owner"), filter)
+		if err != nil {
+			return e.InternalServerError("Failed to build pipeline report.", err)
+		}
+		return e.JSON(http.StatusOK, report)
+	}).Bind(requireCRMRole(roleManager, roleRep))
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/router"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+// defaultTrendDays is how far back the trend report goes without a from
+// date.
+const defaultTrendDays = 90
+
+type pipelineSnapshotRow struct {
+	Stage  string  `db:"stage"`
+	Owner  string  `db:"owner"`
+	Count  int     `db:"count"`
+	Amount float64 `db:"amount"`
+}
+
+// pipelineSnapshotRows counts the leads and deals per stage and owner, with
+// the same amounts as the pipeline report.
+func pipelineSnapshotRows(app core.App, collection string) ([]pipelineSnapshotRow, error) {
+	now := dbx.Params{"now": types.NowDateTime().String()}
+
+	rows := []pipelineSnapshotRow{}
+	if collection == collectionLeads {
+		err := app.DB().
+			Select(
+				"r.stage AS stage",
+				"r.owner AS owner",
+				"COUNT(DISTINCT r.id) AS count",
+				"COALESCE(SUM("+baseAmountSQL("d.amount", "d.currency", dealValuationDateSQL("d", "now"))+"), 0) AS amount",
+			).
+			From(collectionLeads+" r").
+			LeftJoin(collectionDeals+" d", dbx.NewExp("d.lead = r.id AND d.archived = 0")).
+			Where(dbx.HashExp{"r.archived": false}).
+			GroupBy("r.stage", "r.owner").
+			Bind(now).
+			All(&rows)
+		return rows, err
+	}
+
+	err := app.DB().
+		Select(
+			"r.stage AS stage",
+			"r.owner AS owner",
+			"COUNT(*) AS count",
+			"COALESCE(SUM("+baseAmountSQL("r.amount", "r.currency", dealValuationDateSQL("r", "now"))+"), 0) AS amount",
+		).
+		From(collectionDeals+" r").
+		Where(dbx.HashExp{"r.archived": false}).
+		GroupBy("r.stage", "r.owner").
+		Bind(now).
+		All(&rows)
+	return rows, err
+}
+
+// snapshotPipeline stores today's counts and amounts of the leads and deals
+// per stage and owner, replacing a snapshot already taken that day.
+func snapshotPipeline(app core.App, now time.Time) (map[string]int, error) {
+	col, err := app.FindCollectionByNameOrId(collectionPipelineSnapshots)
+	if err != nil {
+		return nil, err
+	}
+
+	date, err := types.ParseDateTime(now.UTC().Truncate(24 * time.Hour))
+	if err != nil {
+		return nil, err
+	}
+
+	created := map[string]int{}
+	err = app.RunInTransaction(func(txApp core.App) error {
+		for name, ref := range stageHistoryCollections {
+			rows, err := pipelineSnapshotRows(txApp, ref.collection)
+			if err != nil {
+				return err
+			}
+
+			old, err := txApp.FindRecordsByFilter(col, "snapshot_date = {:date} && collection = {:collection}", "", 0, 0,
+				dbx.Params{"date": date.String(), "collection": name})
+			if err != nil {
+				return err
+			}
+			for _, rec := range old {
+				if err := txApp.Delete(rec); err != nil {
+					return err
+				}
+			}
+
+			for _, row := range rows {
+				rec := core.NewRecord(col)
+				rec.Set("snapshot_date", date)
+				rec.Set("collection", name)
+				rec.Set("stage", row.Stage)
+				rec.Set("owner", row.Owner)
+				rec.Set("count", row.Count)
+				rec.Set("amount", roundMoney(row.Amount))
+				rec.Set("currency", baseCurrency())
+				if err := txApp.Save(rec); err != nil {
+					return err
+				}
+			}
+			created[name] = len(rows)
+		}
+		return nil
+	})
+	return created, err
+}
+
+// trendPoint is one day of a trend series. The changes are against the
+// snapshot a week earlier and are nil when there is none.
+type trendPoint struct {
+	Date         string   `json:"date"`
+	Count        int      `json:"count"`
+	Amount       float64  `json:"amount"`
+	CountChange  *int     `json:"countChange"`
+	AmountChange *float64 `json:"amountChange"`
+}
+
+type trendSeries struct {
+	Key    string       `json:"key"`
+	Label  string       `json:"label"`
+	Points []trendPoint `json:"points"`
+}
+
+// pipelineTrend builds one series per stage (by "stage") or per owner (by
+// "owner", open stages only) from the snapshots of collection ("leads" or
+// "deals") taken within [from, to) and visible through scope. Days a series
+// is missing from a snapshot count as zero.
+func pipelineTrend(app core.App, scope dbx.Expression, name string, by string, from string, to string, owner string) ([]string, []trendSeries, error) {
+	where := []dbx.Expression{dbx.HashExp{"s.collection": name}}
+	if from != "" {
+		where = append(where, dbx.NewExp("s.snapshot_date >= {:from}", dbx.Params{"from": from}))
+	}
+	if to != "" {
+		where = append(where, dbx.NewExp("s.snapshot_date < {:to}", dbx.Params{"to": to}))
+	}
+
+	// every snapshot day is a point, even when nothing visible was counted
+	dates := []string{}
+	err := app.DB().
+		Select("s.snapshot_date").
+		Distinct(true).
+		From(collectionPipelineSnapshots + " s").
+		Where(dbx.And(where...)).
+		OrderBy("s.snapshot_date").
+		Column(&dates)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	where = append(where, scope)
+	if owner != "" {
+		where = append(where, dbx.HashExp{"s.owner": owner})
+	}
+	key, label := "s.stage", "s.stage"
+	if by == "owner" {
+		key, label = "s.owner", "COALESCE(MAX(u.name), '')"
+		where = append(where, dbx.NewExp("s.stage NOT IN ('won', 'lost')"))
+	}
+
+	rows := []struct {
+		Date   string  `db:"date"`
+		Key    string  `db:"key"`
+		Label  string  `db:"label"`
+		Count  int     `db:"count"`
+		Amount float64 `db:"amount"`
+	}{}
+	err = app.DB().
+		Select(
+			"s.snapshot_date AS date",
+			key+" AS key",
+			label+" AS label",
+			"COALESCE(SUM(s.count), 0) AS count",
+			"COALESCE(SUM(s.amount), 0) AS amount",
+		).
+		From(collectionPipelineSnapshots+" s").
+		LeftJoin(collectionUsers+" u", dbx.NewExp("u.id = s.owner")).
+		Where(dbx.And(where...)).
+		GroupBy("date", "key").
+		All(&rows)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	series := []trendSeries{}
+	for _, row := range rows {
+		i := slices.IndexFunc(series, func(s trendSeries) bool { return s.Key == row.Key })
+		if i < 0 {
+			s := trendSeries{Key: row.Key, Label: row.Label, Points: make([]trendPoint, len(dates))}
+			for j, date := range dates {
+				s.Points[j].Date = date
+			}
+			series = append(series, s)
+			i = len(series) - 1
+		}
+		if j := slices.Index(dates, row.Date); j >= 0 {
+			series[i].Points[j].Count = row.Count
+			series[i].Points[j].Amount = roundMoney(row.Amount)
+		}
+	}
+
+	for j, date := range dates {
+		dt, err := types.ParseDateTime(date)
+		if err != nil {
+			continue
+		}
+		k := slices.Index(dates, dt.AddDate(0, 0, -7).String())
+		if k < 0 {
+			continue
+		}
+		for i := range series {
+			cur, prev := series[i].Points[j], series[i].Points[k]
+			count := cur.Count - prev.Count
+			amount := roundMoney(cur.Amount - prev.Amount)
+			series[i].Points[j].CountChange = &count
+			series[i].Points[j].AmountChange = &amount
+		}
+	}
+	return dates, series, nil
+}
+
+func bindPipelineSnapshotRoutes(grp *router.RouterGroup[*core.RequestEvent]) {
+	grp.GET("/reports/pipeline/trend/{collection}", func(e *core.RequestEvent) error {
+		name := e.Request.PathValue("collection")
+		ref, ok := stageHistoryCollections[name]
+		if !ok {
+			return e.NotFoundError("Unknown pipeline trend collection.", nil)
+		}
+
+		q := e.Request.URL.Query()
+		by := q.Get("by")
+		if by == "" {
+			by = "stage"
+		}
+		if by != "stage" && by != "owner" {
+			return e.BadRequestError("by must be stage or owner.", nil)
+		}
+		from := q.Get("from")
+		if from == "" {
+			from = time.Now().UTC().Truncate(24*time.Hour).AddDate(0, 0, -defaultTrendDays).Format(types.DefaultDateLayout)
+		}
+
+		dates, series, err := pipelineTrend(e.App, ownerScopeExpr(e.Auth, "s.owner"), name, by, from, q.Get("to"), q.Get("owner"))
+		if err != nil {
+			return e.InternalServerError("Failed to build pipeline trend.", err)
+		}
+
+		if by == "stage" {
+			slices.SortStableFunc(series, func(a, b trendSeries) int {
+				return stageIndex(ref.stages, a.Key) - stageIndex(ref.stages, b.Key)
+			})
+		} else if len(dates) > 0 {
+			last := len(dates) - 1
+			slices.SortStableFunc(series, func(a, b trendSeries) int {
+				switch {
+				case a.Points[last].Amount > b.Points[last].Amount:
+					return -1
+				case a.Points[last].Amount < b.Points[last].Amount:
+					return 1
+				}
+				return 0
+			})
+		}
+
+		return e.JSON(http.StatusOK, map[string]any{
+			"by":       by,
+			"dates":    dates,
+			"items":    series,
+			"currency": baseCurrency(),
+		})
+	}).Bind(requireCRMRole(roleManager, roleRep))
+
+	grp.POST("/reports/pipeline/snapshot", func(e *core.RequestEvent) error {
+		res, err := snapshotPipeline(e.App, time.Now())
+		if err != nil {
+			return e.InternalServerError("Failed to snapshot the pipeline.", err)
+		}
+		return e.JSON(http.StatusOK, res)
+	}).Bind(requireCRMRole())
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"math"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/router"
+)
+
+// demoProducts is the catalog the seeder creates when it is empty.
+var demoProducts = []struct {
+	Name      string
+	SKU       string
+	UnitPrice float64
+}{
+	{"Starter plan", "PLAN-STARTER", 4800},
+	{"Growth plan", "PLAN-GROWTH", 18000},
+	{"Enterprise plan", "PLAN-ENTERPRISE", 60000},
+	{"Onboarding package", "SVC-ONBOARDING", 2500},
+}
+
+func roundMoney(v float64) float64 {
+	return math.Round(v*100) / 100
+}
+
+// Custom (not persisted) record data keys: the line item fields a records
+// API request sent, and a deal whose line items just changed.
+const (
+	lineItemSentKey     = "@crmLineItemSent"
+	lineItemsChangedKey = "@crmLineItemsChanged"
+)
+
+// computeLineItem fills the price, tax rate and description of a new line
+// item from its product when they were not sent (an explicit 0 is kept), and
+// computes its totals. Catalog prices are in the base currency and get
+// converted into the deal currency. The discount applies before tax. The
+// item is not saved.
+func computeLineItem(app core.App, item *core.Record) error {
+	sent, _ := item.GetRaw(lineItemSentKey).([]string)
+	unset := func(field string) bool {
+		return item.IsNew() && item.GetFloat(field) == 0 && !slices.Contains(sent, field)
+	}
+
+	if productId := item.GetString("product"); productId != "" {
+		product, err := app.FindRecordById(collectionProducts, productId)
+		if err != nil {
+			return err
+		}
+		if unset("unit_price") {
+			price := product.GetFloat("unit_price")
+			deal, err := app.FindRecordById(collectionDeals, item.GetString("deal"))
+			if err != nil {
+				return err
+			}
+			if currency := deal.GetString("currency"); currency != "" && currency != baseCurrency() {
+				if price, err = convertFromBase(app, price, currency, time.Now()); err != nil {
+					return err
+				}
+			}
+			item.Set("unit_price", price)
+		}
+		if unset("tax_percent") {
+			item.Set("tax_percent", product.GetFloat("tax_percent"))
+		}
+		if item.GetString("description") == "" {
+			item.Set("description", product.GetString("name"))
+		}
+	}
+	if item.GetFloat("quantity") == 0 {
+		item.Set("quantity", 1)
+	}
+
+	gross := item.GetFloat("quantity") * item.GetFloat("unit_price")
+	subtotal := roundMoney(gross * (1 - item.GetFloat("discount_percent")/100))
+	tax := roundMoney(subtotal * item.GetFloat("tax_percent") / 100)
+	item.Set("subtotal", subtotal)
+	item.Set("tax_amount", tax)
+	item.Set("total", roundMoney(subtotal+tax))
+	return nil
+}
+
+// applyDealLineItemTotals sets amount (net of discounts, before tax),
+// tax_amount and total_amount of a deal from its line items. Deals without
+// line items keep their manually entered amount, except that removing the
+// last line item resets it to 0. The deal is not saved.
+func applyDealLineItemTotals(app core.App, deal *core.Record) error {
+	var sums struct {
+		Items    int     `db:"items"`
+		Subtotal float64 `db:"subtotal"`
+		Tax      float64 `db:"tax"`
+	}
+	if !deal.IsNew() {
+		err := app.DB().
+			Select("COUNT(*) AS items", "COALESCE(SUM(subtotal), 0) AS subtotal", "COALESCE(SUM(tax_amount), 0) AS tax").
+			From(collectionDealLineItems).
+			Where(dbx.HashExp{"deal": deal.Id}).
+			One(&sums)
+		if err != nil {
+			return err
+		}
+	}
+
+	if sums.Items == 0 {
+		if changed, _ := deal.GetRaw(lineItemsChangedKey).(bool); changed {
+			deal.Set("amount", 0)
+		}
+		deal.Set("tax_amount", 0)
+		deal.Set("total_amount", deal.GetFloat("amount"))
+		return nil
+	}
+
+	deal.Set("amount", roundMoney(sums.Subtotal))
+	deal.Set("tax_amount", roundMoney(sums.Tax))
+	deal.Set("total_amount", roundMoney(sums.Subtotal+sums.Tax))
+	return nil
+}
+
+// touchDeal re-saves a deal so its save hook recomputes the amounts, on
+// behalf of whoever saved the line item. Deals that no longer exist (e.g.
+// being cascade deleted) are skipped.
+func touchDeal(app core.App, item *core.Record, dealId string) error {
+	if dealId == "" {
+		return nil
+	}
+	deal, err := app.FindRecordById(collectionDeals, dealId)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
+		return err
+	}
+	copyChangeActor(item, deal)
+	deal.SetRaw(lineItemsChangedKey, true)
+	return app.Save(deal)
+}
+
+func bindProductHooks(app core.App) {
+	dealTotals := func(e *core.RecordEvent) error {
+		if err := applyDealLineItemTotals(e.App, e.Record); err != nil {
+			return err
+		}
+		return e.Next()
+	}
+	app.OnRecordCreate(collectionDeals).BindFunc(dealTotals)
+	app.OnRecordUpdate(collectionDeals).BindFunc(dealTotals)
+
+	app.OnRecordCreateRequest(collectionDealLineItems).BindFunc(func(e *core.RecordRequestEvent) error {
+		info, err := e.RequestInfo()
+		if err != nil {
+			return err
+		}
+		sent := []string{}
+		for _, field := range []string{"unit_price", "tax_percent"} {
+			if _, ok := info.Body[field]; ok {
+				sent = append(sent, field)
+			}
+		}
+		e.Record.SetRaw(lineItemSentKey, sent)
+		return e.Next()
+	})
+
+	app.OnRecordCreate(collectionDealLineItems).BindFunc(func(e *core.RecordEvent) error {
+		if err := computeLineItem(e.App, e.Record); err != nil {
+			return err
+		}
+		if err := e.Next(); err != nil {
+			return err
+		}
+		return touchDeal(e.App, e.Record, e.Record.GetString("deal"))
+	})
+
+	app.OnRecordUpdate(collectionDealLineItems).BindFunc(func(e *core.RecordEvent) error {
+		if err := computeLineItem(e.App, e.Record); err != nil {
+			return err
+		}
+		if err := e.Next(); err != nil {
+			return err
+		}
+		if previous := e.Record.Original().GetString("deal"); previous != e.Record.GetString("deal") {
+			if err := touchDeal(e.App, e.Record, previous); err != nil {
+				return err
+			}
+		}
+		return touchDeal(e.App, e.Record, e.Record.GetString("deal"))
+	})
+
+	app.OnRecordDelete(collectionDealLineItems).BindFunc(func(e *core.RecordEvent) error {
+		if err := e.Next(); err != nil {
+			return err
+		}
+		return touchDeal(e.App, e.Record, e.Record.GetString("deal"))
+	})
+}
+
+type productRevenue struct {
+	Product  string  `db:"product" json:"product"`
+	Name     string  `db:"name" json:"name"`
+	Deals    int     `db:"deals" json:"deals"`
+	Quantity float64 `db:"quantity" json:"quantity"`
+	Revenue  float64 `db:"revenue" json:"revenue"`
+	Tax      float64 `db:"tax" json:"tax"`
+}
+
+// productRevenueReport sums the line items of won deals per product, within
+// the optional [from, to) close date range (deals without close date count
+// at their last update). Amounts are converted into the base currency at the
+// close date. Items without product are grouped under "".
+func productRevenueReport(app core.App, scope dbx.Expression, from string, to string) ([]productRevenue, error) {
+	closedAt := "COALESCE(NULLIF(d.close_date, ''), d.updated)"
+
+	where := []dbx.Expression{dbx.HashExp{"d.stage": "won", "d.archived": false}, scope}
+	if from != "" {
+		where = append(where, dbx.NewExp(closedAt+" >= {:from}", dbx.Params{"from": from}))
+	}
+	if to != "" {
+		where = append(where, dbx.NewExp(closedAt+" < {:to}", dbx.Params{"to": to}))
+	}
+
+	rows := []productRevenue{}
+	err := app.DB().
+		Select(
+			"li.product AS product",
+			"COALESCE(MAX(p.name), '') AS name",
+			"COUNT(DISTINCT li.deal) AS deals",
+			"COALESCE(SUM(li.quantity), 0) AS quantity",
+			"COALESCE(SUM("+baseAmountSQL("li.subtotal", "d.currency", closedAt)+"), 0) AS revenue",
+			"COALESCE(SUM("+baseAmountSQL("li.tax_amount", "d.currency", closedAt)+"), 0) AS tax",
+		).
+		From(collectionDealLineItems+" li").
+		InnerJoin(collectionDeals+" d", dbx.NewExp("d.id = li.deal")).
+		LeftJoin(collectionProducts+" p", dbx.NewExp("p.id = li.product")).
+		Where(dbx.And(where...)).
+		GroupBy("li.product").
+		OrderBy("revenue DESC").
+		All(&rows)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range rows {
+		rows[i].Revenue = roundMoney(rows[i].Revenue)
+		rows[i].Tax = roundMoney(rows[i].Tax)
+	}
+	return rows, nil
+}
+
+// ensureDemoProducts returns the active products, creating the demo catalog
+// when there are none.
+func ensureDemoProducts(app core.App) ([]*core.Record, error) {
+	products, err := app.FindRecordsByFilter(collectionProducts, "active=true", "unit_price", 0, 0)
+	if err != nil || len(products) > 0 {
+		return products, err
+	}
+
+	col, err := app.FindCollectionByNameOrId(collectionProducts)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range demoProducts {
+		rec := core.NewRecord(col)
+		rec.Set("name", p.Name)
+		rec.Set("sku", p.SKU)
+		rec.Set("unit_price", p.UnitPrice)
+		rec.Set("tax_percent", 5)
+		rec.Set("active", true)
+		setChangeActor(rec, leadSourceSeed, "")
+		if err := app.Save(rec); err != nil {
+			return nil, err
+		}
+		products = append(products, rec)
+	}
+	return products, nil
+}
+
+// addDealLineItem adds a product line to a seeded deal; the hooks update the
+// deal.
+func addDealLineItem(app core.App, dealId string, product *core.Record, quantity float64, discountPercent float64) error {
+	col, err := app.FindCollectionByNameOrId(collectionDealLineItems)
+	if err != nil {
+		return err
+	}
+	item := core.NewRecord(col)
+	item.Set("deal", dealId)
+	item.Set("product", product.Id)
+	item.Set("quantity", quantity)
+	item.Set("discount_percent", discountPercent)
+	setChangeActor(item, leadSourceSeed, "")
+	return app.Save(item)
+}
+
+func bindProductRoutes(grp *router.RouterGroup[*core.RequestEvent]) {
+	grp.GET("/reports/products", func(e *core.RequestEvent) error {
+		q := e.Request.URL.Query()
+		rows, err := productRevenueReport(e.App, ownerScopeExpr(e.Auth, "d.owner"), q.Get("from"), q.Get("to"))
+		if err != nil {
+			return e.InternalServerError("Failed to build product revenue report.", err)
+		}
+
+		total := 0.0
+		for _, r := range rows {
+			total += r.Revenue
+		}
+		return e.JSON(http.StatusOK, map[string]any{
+			"items":        rows,
+			"totalRevenue": roundMoney(total),
+			"currency":     baseCurrency(),
+		})
+	}).Bind(requireCRMRole(roleManager))
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"slices"
+	"strings"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/hook"
+	"github.com/pocketbase/pocketbase/tools/search"
+)
+
+const (
+	roleAdmin   = "admin"
+	roleManager = "manager"
+	roleRep     = "rep"
+)
+
+// crmRole returns the CRM role of an authenticated record. Superusers act as
+// admins; records of any other auth collection have no role.
+func crmRole(auth *core.Record) string {
+	if auth == nil {
+		return ""
+	}
+	if auth.IsSuperuser() {
+		return roleAdmin
+	}
+	if auth.Collection().Name != collectionUsers {
+		return ""
+	}
+	return auth.GetString("role")
+}
+
+// requireCRMRole lets superusers, CRM admins and CRM users with one of the
+// given roles through. It mirrors the collection API rules for the custom
+// /api/ai-crm routes; record level scoping is up to the handler.
+func requireCRMRole(roles ...string) *hook.Handler[*core.RequestEvent] {
+	return &hook.Handler[*core.RequestEvent]{
+		Func: func(e *core.RequestEvent) error {
+			if e.Auth == nil {
+				return e.UnauthorizedError("The request requires valid record authorization token.", nil)
+			}
+			role := crmRole(e.Auth)
+			if role != roleAdmin && (role == "" || !slices.Contains(roles, role)) {
+				return e.ForbiddenError("Your CRM role is not allowed to perform this action.", nil)
+			}
+			return e.Next()
+		},
+	}
+}
+
+// ownerScopeFilter returns the filter (and its params) limiting an owned
+// collection (leads, deals, activities) to the records auth may see, the same
+// way the collection list rules do. Admins get an empty filter.
+func ownerScopeFilter(auth *core.Record) (string, dbx.Params) {
+	return userScopeFilter(auth, "owner")
+}
+
+// userScopeFilter is ownerScopeFilter for any crm_users relation field.
+func userScopeFilter(auth *core.Record, field string) (string, dbx.Params) {
+	role := crmRole(auth)
+	if role == roleAdmin {
+		return "", dbx.Params{}
+	}
+
+	clauses := []string{field + "={:scopeUser}"}
+	params := dbx.Params{"scopeUser": auth.Id}
+	if team := auth.GetString("team"); team != "" {
+		clauses = append(clauses, field+".team={:scopeTeam}")
+		params["scopeTeam"] = team
+	}
+	if role == roleManager {
+		clauses = append(clauses, field+"=''")
+	}
+	return strings.Join(clauses, " || "), params
+}
+
+// ownerScopeExpr is ownerScopeFilter for raw SQL reports: it limits the
+// crm_users id in column to what auth may see. Admins get nil, which dbx
+// drops from And().
+func ownerScopeExpr(auth *core.Record, column string) dbx.Expression {
+	role := crmRole(auth)
+	if role == roleAdmin {
+		return nil
+	}
+
+	clauses := []string{column + " = {:scopeUser}"}
+	params := dbx.Params{"scopeUser": auth.Id}
+	if team := auth.GetString("team"); team != "" {
+		clauses = append(clauses, column+" IN (SELECT id FROM "+collectionUsers+" WHERE team = {:scopeTeam})")
+		params["scopeTeam"] = team
+	}
+	if role == roleManager {
+		clauses = append(clauses, column+" = ''")
+	}
+	return dbx.NewExp("("+strings.Join(clauses, " OR ")+")", params)
+}
+
+// isOwnedCollection reports whether records of the collection have an owner.
+func isOwnedCollection(name string) bool {
+	return name == collectionLeads || name == collectionDeals || name == collectionActivities
+}
+
+// canAccessOwned reports whether auth may see an owned record.
+func canAccessOwned(app core.App, auth *core.Record, rec *core.Record) bool {
+	role := crmRole(auth)
+	owner := rec.GetString("owner")
+	switch {
+	case role == "":
+		return false
+	case role == roleAdmin, owner == auth.Id:
+		return true
+	case owner == "":
+		return role == roleManager
+	}
+
+	team := auth.GetString("team")
+	if team == "" {
+		return false
+	}
+	ownerRec, err := app.FindRecordById(collectionUsers, owner)
+	return err == nil && ownerRec.GetString("team") == team
+}
+
+// joinFilters ANDs the non-empty filters together.
+func joinFilters(filters ...string) string {
+	parts := []string{}
+	for _, f := range filters {
+		if strings.TrimSpace(f) != "" {
+			parts = append(parts, "("+f+")")
+		}
+	}
+	return strings.Join(parts, " && ")
+}
+
+// listRecords lists the records of col matching filter (built by the route,
+// bound with params) with the page, perPage, sort and filter query params of
+// the records list API. Both filters resolve like the records API does for
+// the caller, so neither can reach hidden fields (password hashes, token
+// keys) or records of collections the caller may not list.
+func listRecords(e *core.RequestEvent, col *core.Collection, filter string, params dbx.Params, defaultSort search.SortField) (*search.Result, error) {
+	info, err := e.RequestInfo()
+	if err != nil {
+		return nil, err
+	}
+	resolver := core.NewRecordFieldResolver(e.App, col, info, false)
+
+	query := e.App.RecordQuery(col)
+	if filter != "" {
+		expr, err := search.FilterData(filter).BuildExpr(resolver, params)
+		if err != nil {
+			return nil, err
+		}
+		query.AndWhere(expr)
+	}
+
+	q := e.Request.URL.Query()
+	provider := search.NewProvider(resolver).Query(query).CountCol("_rowid_")
+	if q.Get(search.SortQueryParam) == "" {
+		provider.AddSort(defaultSort)
+	}
+
+	records := []*core.Record{}
+	return provider.ParseAndExec(q.Encode(), &records)
+}
+
+// findRecordsAs finds up to limit (0 for all) records of col matching filter
+// (bound with params), ordered by sort. Filter and sort resolve like the
+// records API does for auth, so they can't reach hidden fields even when a
+// user wrote them (e.g. a segment filter). A nil auth resolves as a
+// superuser, for hooks and jobs.
+func findRecordsAs(app core.App, auth *core.Record, col *core.Collection, filter string, params dbx.Params, sort string, limit int) ([]*core.Record, error) {
+	if auth == nil {
+		superusers, err := app.FindCollectionByNameOrId(core.CollectionNameSuperusers)
+		if err != nil {
+			return nil, err
+		}
+		auth = core.NewRecord(superusers)
+	}
+	info := &core.RequestInfo{Auth: auth, Context: core.RequestInfoContextDefault}
+	resolver := core.NewRecordFieldResolver(app, col, info, false)
+
+	query := app.RecordQuery(col)
+	if filter != "" {
+		expr, err := search.FilterData(filter).BuildExpr(resolver, params)
+		if err != nil {
+			return nil, err
+		}
+		query.AndWhere(expr)
+	}
+	if sort != "" {
+		for _, field := range search.ParseSortFromString(sort) {
+			expr, err := field.BuildExpr(resolver)
+			if err != nil {
+				return nil, err
+			}
+			query.AndOrderBy(expr)
+		}
+	}
+	if err := resolver.UpdateQuery(query); err != nil {
+		return nil, err
+	}
+	if limit > 0 {
+		query.Limit(int64(limit))
+	}
+
+	records := []*core.Record{}
+	if err := query.All(&records); err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// bindRoleHooks makes reps the owner of the leads they create through the
+// records API, so the lead doesn't get routed to someone else and vanish
+// from their view.
+func bindRoleHooks(app core.App) {
+	app.OnRecordCreateRequest(collectionLeads).BindFunc(func(e *core.RecordRequestEvent) error {
+		if crmRole(e.Auth) == roleRep && e.Record.GetString("owner") == "" {
+			e.Record.Set("owner", e.Auth.Id)
+		}
+		return e.Next()
+	})
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	validation "github.com/go-ozzo/ozzo-validation/v4"
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/router"
+	"github.com/pocketbase/pocketbase/tools/search"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+// maxSegmentAgentRun caps the leads processed by one bulk agent run.
+const maxSegmentAgentRun = 200
+
+type segmentEvaluation struct {
+	SegmentId           string   `json:"segmentId"`
+	Count               int      `json:"count"`
+	PreviousCount       int      `json:"previousCount"`
+	Added               []string `json:"added"`
+	Removed             []string `json:"removed"`
+	EvaluatedAt         string   `json:"evaluatedAt"`
+	PreviousEvaluatedAt string   `json:"previousEvaluatedAt"`
+}
+
+// segmentFilterFor returns the filter of a segment, checking that it
+// targets the given collection.
+func segmentFilterFor(app core.App, segmentId string, collection string) (string, error) {
+	seg, err := app.FindRecordById(collectionSegments, segmentId)
+	if err != nil {
+		return "", err
+	}
+	if seg.GetString("collection") != collection {
+		return "", fmt.Errorf("segment %q targets %s, not %s", seg.GetString("name"), seg.GetString("collection"), collection)
+	}
+	return seg.GetString("filter"), nil
+}
+
+// segmentMemberIds returns the ids of the records currently matching the
+// segment filter that auth may see (all of them for a nil auth), oldest
+// first.
+func segmentMemberIds(app core.App, seg *core.Record, auth *core.Record) ([]string, error) {
+	col, err := app.FindCollectionByNameOrId(seg.GetString("collection"))
+	if err != nil {
+		return nil, err
+	}
+	scope, params := "", dbx.Params{}
+	if auth != nil && isOwnedCollection(col.Name) {
+		scope, params = ownerScopeFilter(auth)
+	}
+
+	records, err := findRecordsAs(app, auth, col, joinFilters("archived = false", scope, seg.GetString("filter")), params, "created", 0)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, len(records))
+	for i, r := range records {
+		ids[i] = r.Id
+	}
+	return ids, nil
+}
+
+// evaluateSegment compares the current members of a segment that auth may
+// see with the ones stored by the previous evaluation and sets the new
+// membership, count and evaluation time on seg. The segment is not saved.
+func evaluateSegment(app core.App, seg *core.Record, auth *core.Record) (*segmentEvaluation, error) {
+	ids, err := segmentMemberIds(app, seg, auth)
+	if err != nil {
+		return nil, err
+	}
+
+	previous := []string{}
+	_ = seg.UnmarshalJSONField("member_ids", &previous)
+
+	// the previous members may have been evaluated by someone seeing more
+	if auth != nil && crmRole(auth) != roleAdmin && isOwnedCollection(seg.GetString("collection")) {
+		records, err := app.FindRecordsByIds(seg.GetString("collection"), previous)
+		if err != nil {
+			return nil, err
+		}
+		previous = previous[:0]
+		for _, r := range records {
+			if canAccessOwned(app, auth, r) {
+				previous = append(previous, r.Id)
+			}
+		}
+	}
+
+	res := &segmentEvaluation{
+		SegmentId:     seg.Id,
+		Count:         len(ids),
+		PreviousCount: len(previous),
+		Added:         []string{},
+		Removed:       []string{},
+		EvaluatedAt:   types.NowDateTime().String(),
+	}
+	if at := seg.GetDateTime("evaluated_at"); !at.IsZero() {
+		res.PreviousEvaluatedAt = at.String()
+	}
+
+	for _, id := range ids {
+		if !slices.Contains(previous, id) {
+			res.Added = append(res.Added, id)
+		}
+	}
+	for _, id := range previous {
+		if !slices.Contains(ids, id) {
+			res.Removed = append(res.Removed, id)
+		}
+	}
+
+	seg.Set("member_ids", ids)
+	seg.Set("member_count", len(ids))
+	seg.Set("evaluated_at", res.EvaluatedAt)
+
+	return res, nil
+}
+
+// bindSegmentHooks rejects segments whose filter doesn't compile against
+// the target collection (hidden fields included) and refreshes the cached
+// membership, as seen by whoever saves the segment, whenever the filter or
+// the target changes.
+func bindSegmentHooks(app core.App) {
+	validate := func(e *core.RecordEvent) error {
+		col, err := e.App.FindCollectionByNameOrId(e.Record.GetString("collection"))
+		if err == nil {
+			_, err = findRecordsAs(e.App, nil, col, e.Record.GetString("filter"), nil, "", 1)
+		}
+		if err != nil {
+			return validation.Errors{"filter": validation.NewError("validation_invalid_segment_filter", "Invalid filter: "+err.Error())}
+		}
+		return nil
+	}
+
+	app.OnRecordCreate(collectionSegments).BindFunc(func(e *core.RecordEvent) error {
+		if err := validate(e); err != nil {
+			return err
+		}
+		if _, err := evaluateSegment(e.App, e.Record, changeActorAuth(e.App, e.Record)); err != nil {
+			return err
+		}
+		return e.Next()
+	})
+
+	app.OnRecordUpdate(collectionSegments).BindFunc(func(e *core.RecordEvent) error {
+		original := e.Record.Original()
+		changed := e.Record.GetString("filter") != original.GetString("filter") ||
+			e.Record.GetString("collection") != original.GetString("collection")
+		if !changed {
+			return e.Next()
+		}
+
+		if err := validate(e); err != nil {
+			return err
+		}
+		// the old membership belongs to a different definition
+		e.Record.Set("member_ids", []string{})
+		if _, err := evaluateSegment(e.App, e.Record, changeActorAuth(e.App, e.Record)); err != nil {
+			return err
+		}
+		return e.Next()
+	})
+}
+
+func bindSegmentRoutes(grp *router.RouterGroup[*core.RequestEvent]) {
+	grp.GET("/segments/{id}/members", func(e *core.RequestEvent) error {
+		seg, err := e.App.FindRecordById(collectionSegments, e.Request.PathValue("id"))
+		if err != nil {
+			return e.NotFoundError("Segment not found.", err)
+		}
+		col, err := e.App.FindCollectionByNameOrId(seg.GetString("collection"))
+		if err != nil {
+			return e.InternalServerError("Failed to load segment collection.", err)
+		}
+
+		scope, params := "", dbx.Params{}
+		if isOwnedCollection(col.Name) {
+			scope, params = ownerScopeFilter(e.Auth)
+		}
+
+		// archived records are left out like in the member counts; page, perPage,
+		// sort and an extra filter work as in the records list API
+		result, err := listRecords(e, col, joinFilters("archived = false", scope, seg.GetString("filter")), params, search.SortField{Name: "created", Direction: search.SortDesc})
+		if err != nil {
+			return e.BadRequestError("Failed to list segment members.", err)
+		}
+		return e.JSON(http.StatusOK, result)
+	}).Bind(requireCRMRole(roleManager, roleRep))
+
+	grp.GET("/segments/{id}/changes", func(e *core.RequestEvent) error {
+		seg, err := e.App.FindRecordById(collectionSegments, e.Request.PathValue("id"))
+		if err != nil {
+			return e.NotFoundError("Segment not found.", err)
+		}
+		// the evaluation is only reported, the segment isn't saved
+		res, err := evaluateSegment(e.App, seg, e.Auth)
+		if err != nil {
+			return e.BadRequestError("Failed to evaluate segment.", err)
+		}
+		return e.JSON(http.StatusOK, res)
+	}).Bind(requireCRMRole(roleManager))
+
+	grp.POST("/segments/{id}/evaluate", func(e *core.RequestEvent) error {
+		seg, err := e.App.FindRecordById(collectionSegments, e.Request.PathValue("id"))
+		if err != nil {
+			return e.NotFoundError("Segment not found.", err)
+		}
+		res, err := evaluateSegment(e.App, seg, e.Auth)
+		if err != nil {
+			return e.BadRequestError("Failed to evaluate segment.", err)
+		}
+		setAuthChangeActor(seg, e.Auth)
+		if err := e.App.Save(seg); err != nil {
+			return e.InternalServerError("Failed to save segment.", err)
+		}
+		return e.JSON(http.StatusOK, res)
+	}).Bind(requireCRMRole(roleManager))
+
+	grp.POST("/segments/{id}/agents/run", func(e *core.RequestEvent) error {
+		filter, err := segmentFilterFor(e.App, e.Request.PathValue("id"), collectionLeads)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return e.NotFoundError("Segment not found.", err)
+			}
+			return e.BadRequestError(err.Error(), nil)
+		}
+
+		limit := 50
+		if raw := e.Request.URL.Query().Get("limit"); raw != "" {
+			v, convErr := strconv.Atoi(raw)
+			if convErr != nil || v <= 0 {
+				return e.BadRequestError("Invalid limit.", convErr)
+			}
+			limit = min(v, maxSegmentAgentRun)
+		}
+
+		col, err := e.App.FindCollectionByNameOrId(collectionLeads)
+		if err != nil {
+			return e.InternalServerError("Failed to load leads collection.", err)
+		}
+
+		// finalized leads are skipped by the agent anyway
+		scope, params := ownerScopeFilter(e.Auth)
+		leads, err := findRecordsAs(e.App, e.Auth, col, joinFilters(scope, filter, "stage != 'won' && stage != 'lost' && archived = false"), params, "-updated", limit)
+		if err != nil {
+			return e.BadRequestError("Failed to load segment leads.", err)
+		}
+
+		started := time.Now()
+		results := []*agentRunResult{}
+		failed := 0
+		for _, lead := range leads {
+			res, err := runLeadAgent(e.App, lead.Id)
+			if err != nil {
+				e.App.Logger().Warn("ai_crm segment agent run failed", "leadId", lead.Id, "error", err)
+				failed++
+				continue
+			}
+			results = append(results, res)
+		}
+
+		return e.JSON(http.StatusOK, map[string]any{
+			"processed":  len(results),
+			"failed":     failed,
+			"results":    results,
+			"durationMs": time.Since(started).Milliseconds(),
+		})
+	}).Bind(requireCRMRole(roleManager))
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/router"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+// Pipeline order of the lead and deal stages, used to sort the reports.
+var (
+	leadStageOrder = []string{"new", "outreached", "replied", "qualified", "proposal", "won", "lost"}
+	dealStageOrder = []string{"qualification", "proposal", "negotiation", "won", "lost"}
+)
+
+// stageHistoryCollections maps the path segment of the stage history routes
+// to the collection and the crm_stage_history relation field.
+var stageHistoryCollections = map[string]struct {
+	collection string
+	field      string
+	stages     []string
+}{
+	"leads": {collectionLeads, "lead", leadStageOrder},
+	"deals": {collectionDeals, "deal", dealStageOrder},
+}
+
+// recordStageChange appends a transition of a lead or deal to
+// crm_stage_history, attributed to whoever saved the record.
+func recordStageChange(app core.App, rec *core.Record, field string, from string, to string) error {
+	col, err := app.FindCollectionByNameOrId(collectionStageHistory)
+	if err != nil {
+		return err
+	}
+
+	source, actorId := changeActorOf(rec)
+
+	entry := core.NewRecord(col)
+	entry.Set(field, rec.Id)
+	entry.Set("from_stage", from)
+	entry.Set("to_stage", to)
+	entry.Set("source", source)
+	entry.Set("actor", actorId)
+	entry.Set("changed_at", types.NowDateTime())
+	return app.Save(entry)
+}
+
+// bindStageHistoryHooks records the initial stage of every new lead and deal
+// and each later stage change, whatever path saved it.
+func bindStageHistoryHooks(app core.App) {
+	for _, ref := range stageHistoryCollections {
+		field := ref.field
+
+		app.OnRecordCreate(ref.collection).BindFunc(func(e *core.RecordEvent) error {
+			if err := e.Next(); err != nil {
+				return err
+			}
+			return recordStageChange(e.App, e.Record, field, "", e.Record.GetString("stage"))
+		})
+
+		app.OnRecordUpdate(ref.collection).BindFunc(func(e *core.RecordEvent) error {
+			from := e.Record.Original().GetString("stage")
+			if err := e.Next(); err != nil {
+				return err
+			}
+			if to := e.Record.GetString("stage"); to != from {
+				return recordStageChange(e.App, e.Record, field, from, to)
+			}
+			return nil
+		})
+	}
+}
+
+// stageStay is one continuous period a record spent in a stage.
+type stageStay struct {
+	Stage     string         `json:"stage"`
+	EnteredAt types.DateTime `json:"enteredAt"`
+	LeftAt    types.DateTime `json:"leftAt"`
+	Seconds   float64        `json:"seconds"`
+	Current   bool           `json:"current"`
+}
+
+// stageStays turns the ordered history of a record into the periods spent in
+// each stage; the last one lasts until now. Records created before the
+// history existed count as in their current stage since creation.
+func stageStays(rec *core.Record, history []*core.Record, now time.Time) []stageStay {
+	if len(history) == 0 {
+		return []stageStay{{
+			Stage:     rec.GetString("stage"),
+			EnteredAt: rec.GetDateTime("created"),
+			Seconds:   now.Sub(rec.GetDateTime("created").Time()).Seconds(),
+			Current:   true,
+		}}
+	}
+
+	stays := make([]stageStay, 0, len(history))
+	for i, h := range history {
+		stay := stageStay{Stage: h.GetString("to_stage"), EnteredAt: h.GetDateTime("changed_at")}
+		end := now
+		if i+1 < len(history) {
+			stay.LeftAt = history[i+1].GetDateTime("changed_at")
+			end = stay.LeftAt.Time()
+		} else {
+			stay.Current = true
+		}
+		stay.Seconds = end.Sub(stay.EnteredAt.Time()).Seconds()
+		stays = append(stays, stay)
+	}
+	return stays
+}
+
+type stageTime struct {
+	Stage      string  `db:"stage" json:"stage"`
+	Stays      int     `db:"stays" json:"stays"`
+	AvgSeconds float64 `db:"avg_seconds" json:"avgSeconds"`
+	MinSeconds float64 `db:"min_seconds" json:"minSeconds"`
+	MaxSeconds float64 `db:"max_seconds" json:"maxSeconds"`
+	Current    int     `db:"current" json:"current"`
+}
+
+// averageTimeInStage aggregates the completed stays per stage of the leads or
+// deals (field "lead" or "deal") visible through scope, for stays entered in
+// the optional [from, to) range. Current counts the records still in a stage.
+func averageTimeInStage(app core.App, collection string, field string, scope dbx.Expression, from string, to string) ([]stageTime, error) {
+	where := []dbx.Expression{dbx.NewExp("h." + field + " != ''"), dbx.HashExp{"r.archived": false}, scope}
+	if from != "" {
+		where = append(where, dbx.NewExp("h.changed_at >= {:from}", dbx.Params{"from": from}))
+	}
+	if to != "" {
+		where = append(where, dbx.NewExp("h.changed_at < {:to}", dbx.Params{"to": to}))
+	}
+
+	// each stay ends when the next transition of the same record starts
+	next := "(SELECT MIN(n.changed_at) FROM " + collectionStageHistory + " n WHERE n." + field + " = h." + field +
+		" AND (n.changed_at > h.changed_at OR (n.changed_at = h.changed_at AND n._rowid_ > h._rowid_)))"
+	seconds := "((julianday(" + next + ") - julianday(h.changed_at)) * 86400)"
+
+	rows := []stageTime{}
+	err := app.DB().
+		Select(
+			"h.to_stage AS stage",
+			"COUNT("+seconds+") AS stays",
+			"COALESCE(AVG("+seconds+"), 0) AS avg_seconds",
+			"COALESCE(MIN("+seconds+"), 0) AS min_seconds",
+			"COALESCE(MAX("+seconds+"), 0) AS max_seconds",
+			"SUM("+next+" IS NULL) AS current",
+		).
+		From(collectionStageHistory+" h").
+		InnerJoin(collection+" r", dbx.NewExp("r.id = h."+field)).
+		Where(dbx.And(where...)).
+		GroupBy("h.to_stage").
+		All(&rows)
+	return rows, err
+}
+
+func bindStageHistoryRoutes(grp *router.RouterGroup[*core.RequestEvent]) {
+	grp.GET("/stage-history/{collection}/{id}", func(e *core.RequestEvent) error {
+		ref, ok := stageHistoryCollections[e.Request.PathValue("collection")]
+		if !ok {
+			return e.NotFoundError("Unknown stage history collection.", nil)
+		}
+		rec, err := e.App.FindRecordById(ref.collection, e.Request.PathValue("id"))
+		if err != nil || !canAccessOwned(e.App, e.Auth, rec) {
+			return e.NotFoundError("Record not found.", err)
+		}
+
+		history, err := e.App.FindRecordsByFilter(
+			collectionStageHistory,
+			ref.field+"={:id}",
+			"changed_at,created",
+			0,
+			0,
+			dbx.Params{"id": rec.Id},
+		)
+		if err != nil {
+			return e.InternalServerError("Failed to load stage history.", err)
+		}
+
+		stays := stageStays(rec, history, time.Now())
+		totals := map[string]float64{}
+		for _, s := range stays {
+			totals[s.Stage] += s.Seconds
+		}
+
+		return e.JSON(http.StatusOK, map[string]any{
+			"stage":       rec.GetString("stage"),
+			"history":     history,
+			"stays":       stays,
+			"timeInStage": totals,
+		})
+	}).Bind(requireCRMRole(roleManager, roleRep))
+
+	grp.GET("/reports/time-in-stage/{collection}", func(e *core.RequestEvent) error {
+		ref, ok := stageHistoryCollections[e.Request.PathValue("collection")]
+		if !ok {
+			return e.NotFoundError("Unknown stage history collection.", nil)
+		}
+
+		q := e.Request.URL.Query()
+		rows, err := averageTimeInStage(e.App, ref.collection, ref.field, ownerScopeExpr(e.Auth, "r.owner"), q.Get("from"), q.Get("to"))
+		if err != nil {
+			return e.InternalServerError("Failed to build time-in-stage report.", err)
+		}
+
+		slices.SortStableFunc(rows, func(a, b stageTime) int {
+			return stageIndex(ref.stages, a.Stage) - stageIndex(ref.stages, b.Stage)
+		})
+		return e.JSON(http.StatusOK, map[string]any{"items": rows})
+	}).Bind(requireCRMRole(roleManager))
+}
+
+// stageIndex is the position of stage in order; unknown stages sort last.
+func stageIndex(order []string, stage string) int {
+	if i := slices.Index(order, stage); i >= 0 {
+		return i
+	}
+	return len(order)
+}
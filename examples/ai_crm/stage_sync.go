@@ -0,0 +1,210 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+
+	validation "github.com/go-ozzo/ozzo-validation/v4"
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+)
+
+// dealStageByLeadStage is the stage the deals of a lead move to (at least)
+// when the lead enters a stage.
+var dealStageByLeadStage = map[string]string{
+	"new":        "qualification",
+	"outreached": "qualification",
+	"replied":    "qualification",
+	"qualified":  "qualification",
+	"proposal":   "proposal",
+	"won":        "won",
+	"lost":       "lost",
+}
+
+// stageSyncKey marks records saved by the stage sync itself (custom, not
+// persisted data), so a cascade doesn't bounce back to where it started.
+const stageSyncKey = "@crmStageSync"
+
+func isClosedStage(stage string) bool {
+	return stage == "won" || stage == "lost"
+}
+
+func isStageSync(rec *core.Record) bool {
+	v, _ := rec.GetRaw(stageSyncKey).(bool)
+	return v
+}
+
+func stageMismatch(message string) error {
+	return validation.Errors{"stage": validation.NewError("validation_stage_mismatch", message)}
+}
+
+func findLeadDeals(app core.App, leadId string) ([]*core.Record, error) {
+	return app.FindRecordsByFilter(collectionDeals, "lead={:lead} && archived=false", "created", 0, 0, dbx.Params{"lead": leadId})
+}
+
+// validateLeadStage rejects lead stages its deals contradict: a lost lead
+// can't have a won deal, and a won lead needs a deal that is won or can
+// still be won.
+func validateLeadStage(app core.App, lead *core.Record) error {
+	stage := lead.GetString("stage")
+	if lead.IsNew() || !isClosedStage(stage) {
+		return nil
+	}
+
+	deals, err := findLeadDeals(app, lead.Id)
+	if err != nil || len(deals) == 0 {
+		return err
+	}
+
+	winnable := false
+	for _, deal := range deals {
+		dealStage := deal.GetString("stage")
+		if stage == "lost" && dealStage == "won" {
+			return stageMismatch(fmt.Sprintf("Deal %q is won; mark it lost before losing the lead.", deal.GetString("title")))
+		}
+		winnable = winnable || dealStage != "lost"
+	}
+	if stage == "won" && !winnable {
+		return stageMismatch("All deals of the lead are lost; reopen one before winning the lead.")
+	}
+	return nil
+}
+
+// syncDealsToLead moves the deals of a lead after its stage changed from
+// previous: closing the lead closes its open deals, advancing it advances
+// deals that are behind, and reopening it reopens the deals it closed.
+func syncDealsToLead(app core.App, lead *core.Record, previous string) error {
+	stage := lead.GetString("stage")
+	target := dealStageByLeadStage[stage]
+	if target == "" {
+		return nil
+	}
+
+	deals, err := findLeadDeals(app, lead.Id)
+	if err != nil {
+		return err
+	}
+
+	for _, deal := range deals {
+		dealStage := deal.GetString("stage")
+		move := false
+		switch {
+		case isClosedStage(stage):
+			move = !isClosedStage(dealStage)
+		case isClosedStage(dealStage):
+			move = dealStage == previous
+		default:
+			move = slices.Index(dealStageOrder, target) > slices.Index(dealStageOrder, dealStage)
+		}
+		if !move {
+			continue
+		}
+
+		deal.Set("stage", target)
+		if target == "lost" {
+			copyLostDetails(lead, deal)
+		}
+		deal.SetRaw(stageSyncKey, true)
+		copyChangeActor(lead, deal)
+		if err := app.Save(deal); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateDealStage rejects open deals of a closed lead; the lead has to be
+// reopened first.
+func validateDealStage(app core.App, deal *core.Record) error {
+	stage := deal.GetString("stage")
+	if isClosedStage(stage) || deal.GetString("lead") == "" {
+		return nil
+	}
+
+	lead, err := app.FindRecordById(collectionLeads, deal.GetString("lead"))
+	if err != nil {
+		return err
+	}
+	if leadStage := lead.GetString("stage"); isClosedStage(leadStage) {
+		return stageMismatch(fmt.Sprintf("The lead is %s; reopen it before moving its deal to %s.", leadStage, stage))
+	}
+	return nil
+}
+
+// syncLeadToDeal closes the lead of a deal that was just closed: a won deal
+// wins the lead, and the lead is lost once all its deals are lost.
+func syncLeadToDeal(app core.App, deal *core.Record) error {
+	stage := deal.GetString("stage")
+	if !isClosedStage(stage) || deal.GetString("lead") == "" {
+		return nil
+	}
+
+	lead, err := app.FindRecordById(collectionLeads, deal.GetString("lead"))
+	if err != nil {
+		return err
+	}
+	if lead.GetString("stage") == stage {
+		return nil
+	}
+
+	if stage == "lost" {
+		deals, err := findLeadDeals(app, lead.Id)
+		if err != nil {
+			return err
+		}
+		for _, other := range deals {
+			if other.GetString("stage") != "lost" {
+				return nil
+			}
+		}
+	}
+
+	lead.Set("stage", stage)
+	if stage == "lost" {
+		copyLostDetails(deal, lead)
+	}
+	lead.SetRaw(stageSyncKey, true)
+	copyChangeActor(deal, lead)
+	return app.Save(lead)
+}
+
+// bindStageSyncHooks keeps lead and deal stages consistent whatever path
+// changes them (API, admin UI, agent, importers).
+func bindStageSyncHooks(app core.App) {
+	app.OnRecordUpdate(collectionLeads).BindFunc(func(e *core.RecordEvent) error {
+		previous := e.Record.Original().GetString("stage")
+		changed := e.Record.GetString("stage") != previous
+		if changed && !isStageSync(e.Record) {
+			if err := validateLeadStage(e.App, e.Record); err != nil {
+				return err
+			}
+		}
+		if err := e.Next(); err != nil {
+			return err
+		}
+		if !changed || isStageSync(e.Record) {
+			return nil
+		}
+		return syncDealsToLead(e.App, e.Record, previous)
+	})
+
+	syncDeal := func(e *core.RecordEvent) error {
+		original := e.Record.Original()
+		changed := e.Record.IsNew() ||
+			e.Record.GetString("stage") != original.GetString("stage") ||
+			e.Record.GetString("lead") != original.GetString("lead")
+		if !changed || isStageSync(e.Record) {
+			return e.Next()
+		}
+
+		if err := validateDealStage(e.App, e.Record); err != nil {
+			return err
+		}
+		if err := e.Next(); err != nil {
+			return err
+		}
+		return syncLeadToDeal(e.App, e.Record)
+	}
+	app.OnRecordCreate(collectionDeals).BindFunc(syncDeal)
+	app.OnRecordUpdate(collectionDeals).BindFunc(syncDeal)
+}
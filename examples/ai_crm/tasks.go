@@ -0,0 +1,332 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"html"
+	"net/http"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/mailer"
+	"github.com/pocketbase/pocketbase/tools/router"
+	"github.com/pocketbase/pocketbase/tools/search"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+const (
+	taskStatusOpen      = "open"
+	taskStatusDone      = "done"
+	taskStatusCancelled = "cancelled"
+)
+
+// taskDueSoonWindow is how long before its due date a task gets its
+// "due soon" reminder.
+const taskDueSoonWindow = time.Hour
+
+// agentTaskStep describes the task the agent creates for a human step.
+type agentTaskStep struct {
+	Title    string
+	DueIn    time.Duration
+	Priority string
+}
+
+// agentTaskSteps are the agent actions that need a person to act. The agent
+// creates a crm_tasks record for them instead of a note activity.
+var agentTaskSteps = map[string]agentTaskStep{
+	"follow_up": {Title: "Follow up with %s", DueIn: 48 * time.Hour, Priority: "normal"},
+	"qualify":   {Title: "Qualify %s", DueIn: 24 * time.Hour, Priority: "high"},
+	"proposal":  {Title: "Send proposal to %s", DueIn: 72 * time.Hour, Priority: "high"},
+}
+
+// createAgentTask creates the task for a human agent step, assigned to the
+// lead owner and linked to the lead's unarchived deal. An identical open
+// task is reused.
+func createAgentTask(app core.App, lead *core.Record, step agentTaskStep, message string) (string, error) {
+	title := fmt.Sprintf(step.Title, safe(lead.GetString("name")))
+
+	existing, err := app.FindFirstRecordByFilter(
+		collectionTasks,
+		"lead={:lead} && title={:title} && status='open'",
+		dbx.Params{"lead": lead.Id, "title": title},
+	)
+	if err == nil {
+		return existing.Id, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return "", err
+	}
+
+	col, err := app.FindCollectionByNameOrId(collectionTasks)
+	if err != nil {
+		return "", err
+	}
+
+	rec := core.NewRecord(col)
+	rec.Set("title", title)
+	rec.Set("description", message)
+	rec.Set("due_at", time.Now().Add(step.DueIn).UTC())
+	rec.Set("priority", step.Priority)
+	rec.Set("status", taskStatusOpen)
+	rec.Set("lead", lead.Id)
+	rec.Set("source", "agent")
+	setChangeActor(rec, changeSourceAgent, "")
+	if deal, err := app.FindFirstRecordByFilter(collectionDeals, "lead={:lead} && archived = false", dbx.Params{"lead": lead.Id}); err == nil {
+		rec.Set("deal", deal.Id)
+	}
+	if err := app.Save(rec); err != nil {
+		return "", err
+	}
+
+	return rec.Id, nil
+}
+
+// bindTaskHooks fills task defaults (assignee from the lead or deal owner),
+// stamps completed_at and re-arms the reminders when the due date moves.
+func bindTaskHooks(app core.App) {
+	app.OnRecordCreate(collectionTasks).BindFunc(func(e *core.RecordEvent) error {
+		if e.Record.GetString("status") == "" {
+			e.Record.Set("status", taskStatusOpen)
+		}
+		if e.Record.GetString("priority") == "" {
+			e.Record.Set("priority", "normal")
+		}
+		if e.Record.GetString("source") == "" {
+			e.Record.Set("source", "manual")
+		}
+		if e.Record.GetString("assignee") == "" {
+			for _, ref := range []struct{ collection, field string }{
+				{collectionDeals, "deal"},
+				{collectionLeads, "lead"},
+			} {
+				id := e.Record.GetString(ref.field)
+				if id == "" {
+					continue
+				}
+				if rec, err := e.App.FindRecordById(ref.collection, id); err == nil && rec.GetString("owner") != "" {
+					e.Record.Set("assignee", rec.GetString("owner"))
+					break
+				}
+			}
+		}
+		return e.Next()
+	})
+
+	app.OnRecordUpdate(collectionTasks).BindFunc(func(e *core.RecordEvent) error {
+		original := e.Record.Original()
+
+		status := e.Record.GetString("status")
+		if status != original.GetString("status") {
+			if status == taskStatusDone {
+				e.Record.Set("completed_at", types.NowDateTime())
+			} else {
+				e.Record.Set("completed_at", "")
+			}
+		}
+
+		if !e.Record.GetDateTime("due_at").Equal(original.GetDateTime("due_at")) {
+			e.Record.Set("due_reminded_at", "")
+			e.Record.Set("overdue_reminded_at", "")
+		}
+
+		return e.Next()
+	})
+}
+
+// sendTaskReminders mails every assignee one digest of their open tasks that
+// are due within taskDueSoonWindow or overdue, and marks the tasks so each
+// reminder is sent once. Tasks of an assignee whose mail fails stay unmarked
+// and are retried on the next run.
+func sendTaskReminders(app core.App) (map[string]int, error) {
+	now := time.Now().UTC()
+	params := dbx.Params{
+		"now":  now.Format(types.DefaultDateLayout),
+		"soon": now.Add(taskDueSoonWindow).Format(types.DefaultDateLayout),
+	}
+
+	overdue, err := app.FindRecordsByFilter(
+		collectionTasks,
+		"status='open' && assignee != '' && due_at != '' && due_at <= {:now} && overdue_reminded_at = ''",
+		"due_at",
+		0,
+		0,
+		params,
+	)
+	if err != nil {
+		return nil, err
+	}
+	dueSoon, err := app.FindRecordsByFilter(
+		collectionTasks,
+		"status='open' && assignee != '' && due_at > {:now} && due_at <= {:soon} && due_reminded_at = ''",
+		"due_at",
+		0,
+		0,
+		params,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	type digest struct {
+		overdue []*core.Record
+		dueSoon []*core.Record
+	}
+	byAssignee := map[string]*digest{}
+	order := []string{}
+	add := func(task *core.Record, isOverdue bool) {
+		id := task.GetString("assignee")
+		d, ok := byAssignee[id]
+		if !ok {
+			d = &digest{}
+			byAssignee[id] = d
+			order = append(order, id)
+		}
+		if isOverdue {
+			d.overdue = append(d.overdue, task)
+		} else {
+			d.dueSoon = append(d.dueSoon, task)
+		}
+	}
+	for _, t := range overdue {
+		add(t, true)
+	}
+	for _, t := range dueSoon {
+		add(t, false)
+	}
+
+	res := map[string]int{"emails": 0, "overdue": 0, "dueSoon": 0, "failed": 0}
+	for _, assigneeId := range order {
+		d := byAssignee[assigneeId]
+
+		assignee, err := app.FindRecordById(collectionUsers, assigneeId)
+		if err != nil {
+			res["failed"]++
+			continue
+		}
+
+		if err := mailTaskDigest(app, assignee, d.overdue, d.dueSoon); err != nil {
+			app.Logger().Warn("ai_crm task reminder failed", "assignee", assigneeId, "error", err)
+			res["failed"]++
+			continue
+		}
+		res["emails"]++
+
+		stamp := types.NowDateTime()
+		for _, t := range append(d.overdue, d.dueSoon...) {
+			setChangeActor(t, changeSourceCron, "")
+		}
+		for _, t := range d.overdue {
+			t.Set("overdue_reminded_at", stamp)
+			// an overdue task doesn't need the "due soon" mail any more
+			t.Set("due_reminded_at", stamp)
+			if err := app.Save(t); err != nil {
+				return res, err
+			}
+			res["overdue"]++
+		}
+		for _, t := range d.dueSoon {
+			t.Set("due_reminded_at", stamp)
+			if err := app.Save(t); err != nil {
+				return res, err
+			}
+			res["dueSoon"]++
+		}
+	}
+
+	return res, nil
+}
+
+func mailTaskDigest(app core.App, assignee *core.Record, overdue []*core.Record, dueSoon []*core.Record) error {
+	var body strings.Builder
+	section := func(heading string, tasks []*core.Record) {
+		if len(tasks) == 0 {
+			return
+		}
+		body.WriteString("<h3>" + heading + "</h3><ul>")
+		for _, t := range tasks {
+			fmt.Fprintf(&body, "<li><strong>%s</strong> (%s, due %s)</li>",
+				html.EscapeString(t.GetString("title")),
+				html.EscapeString(t.GetString("priority")),
+				t.GetDateTime("due_at").Time().Format("Mon 2 Jan 15:04 MST"),
+			)
+		}
+		body.WriteString("</ul>")
+	}
+	section("Overdue", overdue)
+	section("Due soon", dueSoon)
+
+	subject := fmt.Sprintf("%d CRM task(s) need your attention", len(overdue)+len(dueSoon))
+	if len(overdue) > 0 {
+		subject = fmt.Sprintf("%d overdue CRM task(s)", len(overdue))
+	}
+
+	meta := app.Settings().Meta
+	return app.NewMailClient().Send(&mailer.Message{
+		From:    mail.Address{Name: meta.SenderName, Address: meta.SenderAddress},
+		To:      []mail.Address{{Name: assignee.GetString("name"), Address: assignee.Email()}},
+		Subject: subject,
+		HTML:    body.String(),
+	})
+}
+
+func bindTaskRoutes(grp *router.RouterGroup[*core.RequestEvent]) {
+	grp.GET("/tasks", func(e *core.RequestEvent) error {
+		q := e.Request.URL.Query()
+
+		scope, params := userScopeFilter(e.Auth, "assignee")
+		filters := []string{scope}
+		switch assignee := strings.TrimSpace(q.Get("assignee")); assignee {
+		case "":
+		case "me":
+			filters = append(filters, "assignee={:assignee}")
+			params["assignee"] = e.Auth.Id
+		case "none":
+			filters = append(filters, "assignee=''")
+		default:
+			filters = append(filters, "assignee={:assignee}")
+			params["assignee"] = assignee
+		}
+		if status := strings.TrimSpace(q.Get("status")); status != "" {
+			filters = append(filters, "status={:status}")
+			params["status"] = status
+		}
+		switch q.Get("due") {
+		case "":
+		case "overdue":
+			filters = append(filters, "status='open' && due_at != '' && due_at <= {:now}")
+			params["now"] = types.NowDateTime().String()
+		case "today":
+			now := time.Now().UTC()
+			start := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+			filters = append(filters, "due_at >= {:dayStart} && due_at < {:dayEnd}")
+			params["dayStart"] = start.Format(types.DefaultDateLayout)
+			params["dayEnd"] = start.Add(24 * time.Hour).Format(types.DefaultDateLayout)
+		default:
+			return e.BadRequestError("due must be overdue or today.", nil)
+		}
+
+		col, err := e.App.FindCollectionByNameOrId(collectionTasks)
+		if err != nil {
+			return e.InternalServerError("Failed to load tasks collection.", err)
+		}
+
+		// page, perPage, sort and filter work as in the records list API
+		result, err := listRecords(e, col, joinFilters(filters...), params, search.SortField{Name: "due_at", Direction: search.SortAsc})
+		if err != nil {
+			return e.BadRequestError("Failed to list tasks.", err)
+		}
+		return e.JSON(http.StatusOK, result)
+	}).Bind(requireCRMRole(roleManager, roleRep))
+
+	grp.POST("/tasks/reminders/run", func(e *core.RequestEvent) error {
+		res, err := sendTaskReminders(e.App)
+		if err != nil {
+			return e.InternalServerError("Failed to send task reminders.", err)
+		}
+		return e.JSON(http.StatusOK, res)
+	}).Bind(requireCRMRole())
+}
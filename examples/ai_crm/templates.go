@@ -0,0 +1,63 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+)
+
+var templatePlaceholder = regexp.MustCompile(`\{\{\s*([a-zA-Z0-9_.]+)\s*\}\}`)
+
+// findOutreachTemplate returns the newest active crm_outreach_templates body
+// for an agent action.
+func findOutreachTemplate(app core.App, action string) (string, bool) {
+	recs, err := app.FindRecordsByFilter(collectionOutreachTemplates, "action={:action} && active=true", "-updated", 1, 0, dbx.Params{"action": action})
+	if err != nil || len(recs) == 0 {
+		return "", false
+	}
+	return recs[0].GetString("body"), true
+}
+
+// renderLeadTemplate fills {{placeholders}} with lead values. A placeholder is
+// a lead field ("company", "cf_budget"), a custom field name without its
+// prefix ("budget"), "first_name", or "account.<field>" for the linked account.
+// Unknown placeholders render empty.
+func renderLeadTemplate(app core.App, tpl string, lead *core.Record) string {
+	var account *core.Record
+	accountLoaded := false
+
+	lookup := func(rec *core.Record, key string) string {
+		if rec == nil {
+			return ""
+		}
+		for _, name := range []string{key, customFieldPrefix + key} {
+			if rec.Collection().Fields.GetByName(name) != nil {
+				return rec.GetString(name)
+			}
+		}
+		return ""
+	}
+
+	return templatePlaceholder.ReplaceAllStringFunc(tpl, func(m string) string {
+		key := templatePlaceholder.FindStringSubmatch(m)[1]
+
+		if field, ok := strings.CutPrefix(key, "account."); ok {
+			if !accountLoaded {
+				accountLoaded = true
+				if id := lead.GetString("account"); id != "" {
+					account, _ = app.FindRecordById(collectionAccounts, id)
+				}
+			}
+			return lookup(account, field)
+		}
+
+		if key == "first_name" {
+			first, _, _ := strings.Cut(strings.TrimSpace(lead.GetString("name")), " ")
+			return safe(first)
+		}
+
+		return lookup(lead, key)
+	})
+}